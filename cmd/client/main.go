@@ -1,9 +1,17 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"sync"
+	"tor/pkg/dht"
+	"tor/pkg/lsd"
 	"tor/pkg/torrent"
 	"tor/pkg/util"
+	"tor/pkg/utp"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -13,12 +21,142 @@ func prettyPrint(i interface{}) string {
 	return string(s)
 }
 
+// Torrent file to scrape the trackers for instead of downloading
+var scrapeFile = flag.String("scrape", "", "print what the trackers of a torrent file know about its swarm and exit")
+
+// Whether an updatable magnet's newer torrents are downloaded as they're
+// published, otherwise only the current one is
+var followUpdates = flag.Bool("follow-updates", true, "download each newer torrent published under an updatable magnet's key")
+
 func main() {
+	flag.Parse()
+	if *scrapeFile != "" {
+		scrape(*scrapeFile)
+		return
+	}
+
+	listenTCP()
+	listenUTP()
+	listenLSD()
+	listenDHT()
+	if dhtNodes != nil {
+		defer dhtNodes.Close()
+	}
 	// downloadFromFile("C:\\Users\\usa_m\\Downloads\\openttd-13.4-windows-win64.exe.torrent")
 	downloadFromMagnet("magnet:?xt=urn:btih:98FF12FB63293C887517917B5CF968431FD96F1A&dn=The.Super.Mario.Bros.Movie.2023.1080p.HDRip.Dual.Audio.X26&tr=udp%3A%2F%2Ftracker.coppersurfer.tk%3A6969%2Fannounce&tr=udp%3A%2F%2Ftracker.openbittorrent.com%3A6969%2Fannounce&tr=udp%3A%2F%2Ftracker.opentrackr.org%3A1337&tr=udp%3A%2F%2Fmovies.zsw.ca%3A6969%2Fannounce&tr=udp%3A%2F%2Ftracker.dler.org%3A6969%2Fannounce&tr=udp%3A%2F%2Fopentracker.i2p.rocks%3A6969%2Fannounce&tr=udp%3A%2F%2Fopen.stealth.si%3A80%2Fannounce&tr=udp%3A%2F%2Ftracker.0x.tf%3A6969%2Fannounce")
 	// metadata()
 }
 
+// listenTCP lets peers connect to every torrent we have on ListenPort
+func listenTCP() {
+	// No host so we accept both IPv4 and IPv6 peers
+	l, err := net.Listen("tcp", fmt.Sprintf(":%v", torrent.ListenPort))
+	if err != nil {
+		log.Warnf("Couldn't listen for TCP peers: %s", err)
+		return
+	}
+	torrent.TCPListener = l
+}
+
+// listenUTP lets peers connect over uTP on the same port as TCP
+func listenUTP() {
+	s, err := utp.Listen("udp", fmt.Sprintf(":%v", torrent.ListenPort))
+	if err != nil {
+		log.Warnf("Couldn't listen for uTP, only using TCP: %s", err)
+		return
+	}
+	torrent.UTPSocket = s
+}
+
+// Finds peers on the local network, nil if we couldn't join the LSD groups
+var lanPeers *lsd.Service
+
+func listenLSD() {
+	s, err := lsd.Listen(torrent.ListenPort)
+	if err != nil {
+		log.Warnf("Couldn't start local service discovery: %s", err)
+		return
+	}
+	lanPeers = s
+}
+
+// Our nodes on the IPv4 and IPv6 DHTs, nil if neither could be started
+var dhtNodes *dht.DualStack
+
+// Where the DHT node IDs and nodes are kept between runs, each DHT has its own
+const dhtStateFile = "dht.dat"
+const dht6StateFile = "dht6.dat"
+
+// listenDHT runs the DHT on the uTP socket, or on its own sockets on the
+// same port if uTP couldn't listen
+func listenDHT() {
+	var d *dht.DualStack
+	if torrent.UTPSocket != nil {
+		d = dht.NewSharedDualStack(torrent.UTPSocket.PacketConn(), dhtStateFile, dht6StateFile)
+	} else {
+		var ipv4, ipv6 *dht.DHTNodeClient
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			ipv4 = startDHTNode(fmt.Sprintf("0.0.0.0:%v", torrent.ListenPort), dhtStateFile)
+		}()
+		go func() {
+			defer wg.Done()
+			ipv6 = startDHTNode(fmt.Sprintf("[::]:%v", torrent.ListenPort), dht6StateFile)
+		}()
+		wg.Wait()
+		if ipv4 == nil && ipv6 == nil {
+			return
+		}
+		d = dht.NewDualStack(ipv4, ipv6)
+	}
+
+	dhtNodes = d
+	torrent.DHTPeerFetcher = func(infoHash [20]byte) torrent.PeerFetcher {
+		return d.PeerFetcher(infoHash)
+	}
+	if ipv4 := d.IPv4; ipv4 != nil {
+		torrent.DHTTorrentResolver = func(k ed25519.PublicKey, salt []byte) ([20]byte, error) {
+			update, err := ipv4.ResolveTorrent(k, salt)
+			return update.InfoHash, err
+		}
+	}
+}
+
+func startDHTNode(addr, stateFile string) *dht.DHTNodeClient {
+	n, err := dht.NewDHTClient(addr, stateFile)
+	if err != nil {
+		log.Warnf("Couldn't start the DHT on %s: %s", addr, err)
+		return nil
+	}
+	return n
+}
+
+// withDecentralisedPeers adds local service discovery and the DHT to a
+// torrent's peer fetcher, private torrents drop them again
+func withDecentralisedPeers(infoHash [20]byte, pf torrent.PeerFetcher) torrent.PeerFetcher {
+	m := torrent.MultiPeerFetcher{pf}
+	if lanPeers != nil {
+		m = append(m, lanPeers.PeerFetcher(infoHash))
+	}
+	if dhtNodes != nil {
+		m = append(m, dhtNodes.PeerFetcher(infoHash))
+	}
+	return m
+}
+
+// liveTrackerTiers drops the trackers that don't respond, keeping the tiers
+func liveTrackerTiers(tiers [][]string) [][]string {
+	live := make([][]string, 0, len(tiers))
+	for _, tier := range tiers {
+		if urls := torrent.LiveTrackerUrls(tier); len(urls) > 0 {
+			live = append(live, urls)
+		}
+	}
+	return live
+}
+
 func metadata() {
 	log.StandardLogger().SetLevel(log.DebugLevel)
 
@@ -36,11 +174,32 @@ func metadata() {
 		panic(err)
 	}
 
-	pf := torrent.NewTrackersPeerFetcher(ih, util.GetLiveTrackerAddresses(tf.GetTrackerAddresses()))
+	pf := torrent.NewTieredTrackersPeerFetcher(ih, liveTrackerTiers(tf.GetTrackerTiers()))
 	ts := torrent.NewTorrentSession(ih, tf.Info, pf)
 	ts.GetMetadata()
 }
 
+// scrape prints what the trackers know about a torrent's swarm
+func scrape(fileName string) {
+	ih, err := util.CalcInfoHash(fileName)
+	if err != nil {
+		panic(err)
+	}
+
+	tf, err := torrent.ParseTorrentFile(fileName)
+	if err != nil {
+		panic(err)
+	}
+
+	pf := torrent.NewTieredTrackersPeerFetcher(ih, tf.GetTrackerTiers())
+	res, err := pf.Scrape()
+	if err != nil {
+		log.Errorf("Couldn't scrape %s: %s", tf.Info.Name, err)
+		return
+	}
+	fmt.Printf("%s: %s\n", tf.Info.Name, res)
+}
+
 func downloadFromFile(fileName string) {
 	// log.StandardLogger().SetLevel(log.DebugLevel)
 
@@ -59,23 +218,64 @@ func downloadFromFile(fileName string) {
 		panic(err)
 	}
 
-	pf := torrent.NewTrackersPeerFetcher(ih, util.GetLiveTrackerAddresses(tf.GetTrackerAddresses()))
+	pf := torrent.NewTieredTrackersPeerFetcher(ih, liveTrackerTiers(tf.GetTrackerTiers()))
+	if dhtNodes != nil && len(tf.Nodes) > 0 {
+		go dhtNodes.Bootstrap(tf.Nodes)
+	}
 
-	ts := torrent.NewTorrentSession(ih, tf.Info, pf)
+	ts := torrent.NewTorrentSession(ih, tf.Info, withDecentralisedPeers(ih, pf))
+	ts.AddWebSeeds(tf.UrlList)
 	ts.StartSession()
+	log.Infof("%s: %s", tf.Info.Name, ts.Stats())
+	ts.Stop()
 }
 
 func downloadFromMagnet(uriString string) {
 	// uriString = "magnet:?xt=urn:btih:C9523B834E597B4A8926C99E66C84A6AB0B4B520&dn=The+Everything+Solar+Power+For+Beginners+-+2+Books+in+1+-+A+Detailed+Guide+on+How+to+Design+%26amp%3B+install&tr=https%3A%2F%2Finferno.demonoid.is%2Fannounce&tr=udp%3A%2F%2Ftracker.internetwarriors.net%3A1337%2Fannounce&tr=udp%3A%2F%2Ftracker.openbittorrent.com%3A1337%2Fannounce&tr=udp%3A%2F%2Ftracker.opentrackr.org%3A1337%2Fannounce&tr=udp%3A%2F%2Ftracker.torrent.eu.org%3A451%2Fannounce&tr=udp%3A%2F%2Ftracker.openbittorrent.com%3A80%2Fannounce&tr=udp%3A%2F%2Fexplodie.org%3A6969%2Fannounce&tr=udp%3A%2F%2Ftracker.moeking.me%3A6969%2Fannounce&tr=udp%3A%2F%2Fexodus.desync.com%3A6969%2Fannounce&tr=udp%3A%2F%2Fipv4.tracker.harry.lu%3A80%2Fannounce&tr=udp%3A%2F%2Fp4p.arenabg.com%3A1337%2Fannounce&tr=udp%3A%2F%2Ftracker.dler.org%3A6969%2Fannounce&tr=udp%3A%2F%2Ftracker.leechers-paradise.org%3A6969%2Fannounce&tr=udp%3A%2F%2Ftracker.coppersurfer.tk%3A6969%2Fannounce&tr=udp%3A%2F%2Ftracker.opentrackr.org%3A1337%2Fannounce&tr=http%3A%2F%2Ftracker.openbittorrent.com%3A80%2Fannounce&tr=udp%3A%2F%2Fopentracker.i2p.rocks%3A6969%2Fannounce&tr=udp%3A%2F%2Ftracker.internetwarriors.net%3A1337%2Fannounce&tr=udp%3A%2F%2Ftracker.leechers-paradise.org%3A6969%2Fannounce&tr=udp%3A%2F%2Fcoppersurfer.tk%3A6969%2Fannounce&tr=udp%3A%2F%2Ftracker.zer0day.to%3A1337%2Fannounce"
 	uri, err := torrent.ParseMagnetUri(uriString)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	if uri.Updatable() {
+		downloadUpdatable(uri)
+		return
+	}
+	downloadMagnet(uri)
+}
+
+// downloadUpdatable downloads the torrent currently published under the
+// magnet's key, then switches to each newer one if followUpdates is set
+func downloadUpdatable(uri *torrent.MagnetUri) {
+	if dhtNodes == nil || dhtNodes.IPv4 == nil {
+		log.Error("Updatable magnets need the IPv4 DHT")
+		return
+	}
 
-	ti, err := torrent.GetMetadataFromMagnetUri(uriString)
+	stop := make(chan struct{})
+	defer close(stop)
+	for update := range dhtNodes.IPv4.FollowTorrent(uri.PublicKey, uri.Salt, stop) {
+		log.Infof("Torrent %x is at version %v: %x", uri.PublicKey, update.Seq, update.InfoHash)
+		uri.InfoHash = update.InfoHash
+		downloadMagnet(uri)
+		if !*followUpdates {
+			return
+		}
+	}
+}
 
-	if err == nil {
-		log.Infof("I got the metadata for: %s", ti.Name)
-		// os.Exit(2)
+func downloadMagnet(uri *torrent.MagnetUri) {
+	ti, err := torrent.GetMetadataFromMagnet(uri)
+	if err != nil {
+		log.Error(err)
+		return
 	}
-	pf := torrent.NewTrackersPeerFetcher(uri.InfoHash, util.GetLiveTrackerAddresses(util.ParseTrackerAddressFromUrls(uri.Trackers)))
-	ts := torrent.NewTorrentSession(uri.InfoHash, *ti, pf)
+	log.Infof("I got the metadata for: %s", ti.Name)
+
+	pf := torrent.NewTrackersPeerFetcher(uri.InfoHash, torrent.LiveTrackerUrls(uri.Trackers))
+	ts := torrent.NewTorrentSession(uri.InfoHash, *ti, withDecentralisedPeers(uri.InfoHash, pf))
 	ts.StartSession()
+	log.Infof("%s: %s", ti.Name, ts.Stats())
+	ts.Stop()
 }
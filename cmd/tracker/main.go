@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"tor/pkg/tracker"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	udpAddr := flag.String("udp", ":6969", "address to serve UDP announces on, empty to disable")
+	httpAddr := flag.String("http", ":6969", "address to serve HTTP announces on, empty to disable")
+	whitelist := flag.String("whitelist", "", "file of hex info hashes, one per line, to only track those")
+	interval := flag.Duration("interval", tracker.AnnounceInterval, "announce interval given to clients")
+	flag.Parse()
+
+	tracker.AnnounceInterval = *interval
+	s := tracker.NewServer()
+
+	if *whitelist != "" {
+		infoHashes, err := readWhitelist(*whitelist)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.Allow(infoHashes...)
+		log.Infof("Tracking %v whitelisted torrents", len(infoHashes))
+	}
+
+	go s.RunExpiry(time.Minute, nil)
+
+	errs := make(chan error, 2)
+	if *udpAddr != "" {
+		conn, err := net.ListenPacket("udp", *udpAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Serving UDP tracker on %s", conn.LocalAddr())
+		go func() { errs <- s.ServeUDP(conn) }()
+	}
+
+	if *httpAddr != "" {
+		log.Infof("Serving HTTP tracker on %s", *httpAddr)
+		go func() { errs <- http.ListenAndServe(*httpAddr, s) }()
+	}
+
+	log.Fatal(<-errs)
+}
+
+func readWhitelist(fileName string) ([][20]byte, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var infoHashes [][20]byte
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		b, err := hex.DecodeString(line)
+		if err != nil || len(b) != 20 {
+			return nil, fmt.Errorf("Bad info hash in whitelist: %s", line)
+		}
+
+		var ih [20]byte
+		copy(ih[:], b)
+		infoHashes = append(infoHashes, ih)
+	}
+	return infoHashes, scanner.Err()
+}
@@ -22,10 +22,6 @@ require (
 
 require (
 	github.com/charmbracelet/bubbletea v0.25.0
-	github.com/go-ping/ping v1.1.0 // indirect
-	github.com/google/uuid v1.4.0 // indirect
-	github.com/tmthrgd/go-bitwise v0.0.0-20190904053232-1430ee983fca // indirect
-	golang.org/x/net v0.19.0 // indirect
 	golang.org/x/sync v0.5.0 // indirect
 	golang.org/x/sys v0.15.0 // indirect
 )
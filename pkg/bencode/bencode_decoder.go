@@ -98,6 +98,16 @@ func decodeDict(in []byte) (map[string]interface{}, int, error) {
 	rv := make(map[string]interface{})
 
 	for {
+		if len(s) == 0 {
+			return nil, 0, fmt.Errorf("no end character found for dict: %s", in)
+		}
+
+		// We done
+		if s[0] == 'e' {
+			totalConsumed += 1
+			break
+		}
+
 		key, consumed, err := decodeByteString(s)
 		if err != nil {
 			return nil, 0, fmt.Errorf("error decoding key: %s error: %w", s, err)
@@ -116,12 +126,6 @@ func decodeDict(in []byte) (map[string]interface{}, int, error) {
 		s = s[consumed:]
 
 		rv[string(key)] = val
-
-		// We done
-		if s[0] == 'e' {
-			totalConsumed += 1
-			break
-		}
 	}
 
 	return rv, totalConsumed, nil
@@ -135,8 +139,17 @@ func decodeList(in []byte) ([]interface{}, int, error) {
 
 	totalConsumed := 1
 	s = s[1:]
-	var rv []interface{}
+	rv := []interface{}{}
 	for {
+		if len(s) == 0 {
+			return nil, 0, fmt.Errorf("no end character found for list: %s", in)
+		}
+
+		if s[0] == 'e' {
+			totalConsumed += 1
+			break
+		}
+
 		val, consumed, err := DecodeWithCount(s)
 		if err != nil {
 			return nil, 0, err
@@ -145,11 +158,6 @@ func decodeList(in []byte) ([]interface{}, int, error) {
 		rv = append(rv, val)
 		totalConsumed += consumed
 		s = s[consumed:]
-
-		if s[0] == 'e' {
-			totalConsumed += 1
-			break
-		}
 	}
 
 	return rv, totalConsumed, nil
@@ -99,6 +99,8 @@ var validListDecodes = map[string][]interface{}{
 	"l4:spami42ee":       {[]byte("spam"), 42},
 	"l5:spamsi42e3:dike": {[]byte("spams"), 42, []byte("dik")},
 	"lli11eee":           {[]interface{}{11}},
+	"le":                 {},
+	"llee":               {[]interface{}{}},
 }
 
 func TestListDecode(t *testing.T) {
@@ -117,6 +119,8 @@ func TestListDecode(t *testing.T) {
 
 var validDictDecodes = map[string]map[string]interface{}{
 	"d3:bar4:spam3:fooi42ee": {"bar": []byte("spam"), "foo": 42},
+	"de":                     {},
+	"d5:filesdee":            {"files": map[string]interface{}{}},
 }
 
 func TestDictDecode(t *testing.T) {
@@ -0,0 +1,141 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"tor/pkg/bencode"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Nodes to join the DHT through when there are no saved ones
+var BootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+	"dht.libtorrent.org:25401",
+}
+
+// How often stale buckets are refreshed, questionable nodes pinged and the
+// state saved
+var RefreshCheckInterval = time.Minute
+
+// Bootstrap pings addrs then looks up our own ID to fill the routing table
+// with the nodes around us
+func (n *DHTNodeClient) Bootstrap(addrs []string) error {
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			n.checkAddress(addr)
+		}(addr)
+	}
+	wg.Wait()
+
+	if n.Len() == 0 {
+		return fmt.Errorf("None of the %v bootstrap nodes answered", len(addrs))
+	}
+
+	_, err := n.FindNode(n.ID())
+	return err
+}
+
+func (n *DHTNodeClient) refreshLoop() {
+	ticker := time.NewTicker(RefreshCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.closed:
+			return
+		case <-ticker.C:
+			n.refresh()
+		}
+	}
+}
+
+// refresh pings questionable nodes, looks up a random ID in each stale bucket
+// and saves the state
+func (n *DHTNodeClient) refresh() {
+	var wg sync.WaitGroup
+	for _, node := range n.Questionable() {
+		wg.Add(1)
+		go func(node DHTNode) {
+			defer wg.Done()
+			if _, err := n.ping(node.GetAddress()); err != nil {
+				n.NodeFailed(node.DHTNodeId)
+				return
+			}
+			n.PutNode(node)
+		}(node)
+	}
+	wg.Wait()
+
+	if n.useSecureId() {
+		n.FindNode(n.ID())
+	}
+
+	for _, target := range n.refreshTargets(time.Now()) {
+		if _, err := n.FindNode(target); err != nil {
+			log.Debugf("Couldn't refresh bucket: %s", err)
+		}
+	}
+
+	if err := n.save(); err != nil {
+		log.Warnf("Couldn't save the DHT state: %s", err)
+	}
+}
+
+type dhtState struct {
+	id    [20]byte
+	nodes []DHTNode
+}
+
+// save writes the node ID and good nodes to the state file
+func (n *DHTNodeClient) save() error {
+	if n.stateFile == "" {
+		return nil
+	}
+
+	id := n.ID()
+	b, err := bencode.Encode(map[string]interface{}{
+		"id":             id[:],
+		nodesKey(n.ipv6): compactNodes(n.GoodNodes(), n.ipv6),
+	})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(n.stateFile, b, 0644)
+}
+
+// loadState reads a state file, a new ID is made if there isn't one
+func loadState(fileName string) (dhtState, error) {
+	st := dhtState{id: GetRandNodeID()}
+	if fileName == "" {
+		return st, nil
+	}
+
+	b, err := os.ReadFile(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+
+	decoded, err := bencode.Decode(b)
+	if err != nil {
+		return st, err
+	}
+	d, _ := decoded.(map[string]interface{})
+	id, _ := d["id"].([]byte)
+	if len(id) != 20 {
+		return st, fmt.Errorf("Bad node ID in %s", fileName)
+	}
+	copy(st.id[:], id)
+	st.nodes = parseNodes(d)
+	return st, nil
+}
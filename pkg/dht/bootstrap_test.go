@@ -0,0 +1,88 @@
+package dht
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLocalNetworkBootstraps(t *testing.T) {
+	first := listenLocal(t)
+	nodes := []*DHTNodeClient{first}
+	for i := 0; i < 9; i++ {
+		n := listenLocal(t)
+		if err := n.Bootstrap([]string{nodes[len(nodes)-1].Addr().String()}); err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, n)
+	}
+
+	for _, target := range nodes {
+		res, err := nodes[1].FindNode(target.NodeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target != nodes[1] && res.Nodes[0].DHTNodeId != target.NodeID {
+			t.Errorf("Expected to find %x but the closest was %x", target.NodeID, res.Nodes[0].DHTNodeId)
+		}
+	}
+
+	QueryTimeout = 200 * time.Millisecond
+	defer func() { QueryTimeout = 2 * time.Second }()
+	if err := listenLocal(t).Bootstrap([]string{"127.0.0.1:1"}); err == nil {
+		t.Errorf("Expected an error when no bootstrap node answers")
+	}
+}
+
+func TestStatePersists(t *testing.T) {
+	bootstrapNodes := BootstrapNodes
+	defer func() { BootstrapNodes = bootstrapNodes }()
+
+	other := listenLocal(t)
+	stateFile := filepath.Join(t.TempDir(), "dht.dat")
+
+	BootstrapNodes = []string{other.Addr().String()}
+	n, err := NewDHTClient("127.0.0.1:0", stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Len() != 1 {
+		t.Errorf("Expected to bootstrap from the bootstrap nodes")
+	}
+	n.Close()
+
+	BootstrapNodes = nil
+	restarted, err := NewDHTClient("127.0.0.1:0", stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+
+	if restarted.NodeID != n.NodeID {
+		t.Errorf("Expected the saved node ID")
+	}
+	if closest := restarted.Closest(other.NodeID, 1); len(closest) != 1 || closest[0].DHTNodeId != other.NodeID {
+		t.Errorf("Expected the saved node to be used")
+	}
+}
+
+func TestRefreshTargets(t *testing.T) {
+	table := NewRoutingTable(GetRandNodeID())
+	for i := 0; i < 100; i++ {
+		table.PutNode(genNode())
+	}
+
+	if len(table.refreshTargets(time.Now())) != 0 {
+		t.Errorf("Buckets that just changed don't need refreshing")
+	}
+
+	targets := table.refreshTargets(time.Now().Add(BucketRefreshInterval))
+	if len(targets) != len(table.buckets) {
+		t.Fatalf("Expected every bucket to need refreshing")
+	}
+	for i, target := range targets {
+		if table.bucketIndex(target) != i {
+			t.Errorf("Refresh target for bucket %v is in bucket %v", i, table.bucketIndex(target))
+		}
+	}
+}
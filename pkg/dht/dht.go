@@ -1,144 +1,386 @@
 package dht
 
 import (
+	crand "crypto/rand"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"math/rand"
 	"net"
+	"net/netip"
+	"sync"
 	"time"
 	"tor/pkg/bencode"
+	"tor/pkg/util"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// How long to wait for a node to answer a query
+var QueryTimeout = 2 * time.Second
+
+// DHTNodeClient is our DHT node, it sends queries and answers other nodes'
+// on one UDP socket
 type DHTNodeClient struct {
 	NodeID [20]byte
-	*RoutingBucket
+	*RoutingTable
+
+	// Can be shared with our node on the other family's DHT
+	conn net.PacketConn
+	// Each family has its own DHT (BEP 32), a node is only on one of them
+	ipv6 bool
+	// Secret for the tokens we give to get_peers queries
+	secret [20]byte
+	peers  *peerStore
+	items  *itemStore
+
+	// Where the node ID and good nodes are saved
+	stateFile string
+	// Decides our external IP for BEP 42 node IDs
+	externalIP *util.ExternalIPVoter
+	closed     chan struct{}
+	closeOnce  sync.Once
+
+	mx              sync.Mutex
+	nextTransaction uint16
+	pending         map[string]*pendingQuery
+	// Our node on the other family's DHT, for queries that want its nodes
+	other *DHTNodeClient
 }
 
-func NewDHTClient() *DHTNodeClient {
-	client := &DHTNodeClient{
-		NodeID: GetRandNodeID(),
-		// RoutingBucket: NewRoutingBucket(),
-	}
-	client.initRoutingBucket()
-
-	return client
+type pendingQuery struct {
+	addr netip.AddrPort
+	res  chan map[string]interface{}
 }
 
-func (n *DHTNodeClient) initRoutingBucket() {
-	n.checkAddress(DHTPeer{"router.bittorrent.com", "6881"})
+// Listen starts a DHT node on addr with a random node ID, it's on the IPv6
+// DHT if addr is an IPv6 address
+func Listen(addr string) (*DHTNodeClient, error) {
+	return listen(addr, GetRandNodeID())
 }
 
-func (n *DHTNodeClient) checkAddress(p DHTPeer) {
-	pr, err := n.ping(p.GetAddress())
+func listen(addr string, nodeId [20]byte) (*DHTNodeClient, error) {
+	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
-		log.Warnf("Peer failed check address %s\n, err: %s", p.GetAddress(), err)
-		log.Error(err)
-		return
+		return nil, err
 	}
+	ip, err := netip.ParseAddr(host)
+	ipv6 := err == nil && ip.Unmap().Is6()
 
-	n.RoutingBucket.AddNode(DHTNode{
-		DHTNodeId: pr.DHTNodeId,
-		DHTPeer:   p,
-	})
-}
-
-func (n *DHTNodeClient) SendQuery(q DHTQuery, addr string) ([]byte, error) {
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
-
+	udpAddr, err := net.ResolveUDPAddr(network(ipv6), addr)
 	if err != nil {
 		return nil, err
 	}
 
-	conn, err := net.DialUDP("udp", nil, udpAddr)
-	conn.SetDeadline(time.Now().Add(time.Millisecond * 500))
-	defer conn.Close()
+	conn, err := net.ListenUDP(network(ipv6), udpAddr)
 	if err != nil {
 		return nil, err
 	}
+	n := newNode(conn, ipv6, nodeId)
+	go n.serve()
+	return n, nil
+}
 
-	msg, err := q.Serialize()
+// newNode makes a node on conn, it doesn't read from it until serve is started
+func newNode(conn net.PacketConn, ipv6 bool, nodeId [20]byte) *DHTNodeClient {
+	n := &DHTNodeClient{
+		NodeID:       nodeId,
+		RoutingTable: NewRoutingTable(nodeId),
+		conn:         conn,
+		ipv6:         ipv6,
+		peers:        newPeerStore(),
+		items:        newItemStore(),
+		pending:      make(map[string]*pendingQuery),
+		closed:       make(chan struct{}),
+		externalIP:   util.ExternalIP,
+	}
+	crand.Read(n.secret[:])
+	return n
+}
+
+// NewDHTClient starts a DHT node on addr and joins the DHT. The node ID and
+// nodes saved in stateFile are used if there are any, otherwise it bootstraps
+// from BootstrapNodes. stateFile can be empty to not save anything
+func NewDHTClient(addr string, stateFile string) (*DHTNodeClient, error) {
+	st := startState(stateFile)
+	client, err := listen(addr, st.id)
 	if err != nil {
 		return nil, err
 	}
+	client.join(st, stateFile)
+	return client, nil
+}
 
-	buf := make([]byte, 512)
-	conn.Write(msg)
-	r, err := conn.Read(buf)
-
+func startState(stateFile string) dhtState {
+	st, err := loadState(stateFile)
 	if err != nil {
-		return nil, err
+		log.Warnf("Couldn't load the DHT state, starting again: %s", err)
+		st = dhtState{id: GetRandNodeID()}
 	}
-	return buf[:r], nil
+	return st
 }
 
-func (n *DHTNodeClient) Ping(address string) (*PingResponse, error) {
-	pr, err := n.ping(address)
+// join bootstraps from the nodes in st and keeps the routing table fresh
+func (client *DHTNodeClient) join(st dhtState, stateFile string) {
+	client.stateFile = stateFile
 
-	if err != nil {
-		// TODO: Update bucket becuse this is a good node
+	saved := make([]string, len(st.nodes))
+	for i, node := range st.nodes {
+		saved[i] = node.GetAddress()
+	}
+	if len(saved) == 0 || client.Bootstrap(saved) != nil {
+		if err := client.Bootstrap(BootstrapNodes); err != nil {
+			log.Warnf("Couldn't bootstrap the DHT: %s", err)
+		}
 	}
-	return pr, err
+
+	// Bootstrapping tells us our external IP
+	if client.useSecureId() {
+		client.FindNode(client.ID())
+	}
+
+	go client.refreshLoop()
 }
 
-func (n *DHTNodeClient) ping(address string) (*PingResponse, error) {
-	pq := PingQuery{n.NodeID}
+// Close saves the node's state and stops it
+func (n *DHTNodeClient) Close() error {
+	n.closeOnce.Do(func() {
+		close(n.closed)
+		if err := n.save(); err != nil {
+			log.Warnf("Couldn't save the DHT state: %s", err)
+		}
+	})
+	return n.conn.Close()
+}
+
+// ID is our node ID, it changes when we learn our external IP
+func (n *DHTNodeClient) ID() DHTNodeId {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	return n.NodeID
+}
+
+// Addr is the address the node is listening on
+func (n *DHTNodeClient) Addr() netip.AddrPort {
+	addr, _ := netip.ParseAddrPort(n.conn.LocalAddr().String())
+	return addr
+}
+
+// IPv6 is whether the node is on the IPv6 DHT
+func (n *DHTNodeClient) IPv6() bool {
+	return n.ipv6
+}
+
+func network(ipv6 bool) string {
+	if ipv6 {
+		return "udp6"
+	}
+	return "udp4"
+}
 
-	buf, err := n.SendQuery(pq, address)
+func (n *DHTNodeClient) otherFamily() *DHTNodeClient {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	return n.other
+}
 
+// checkAddress pings addr and adds the node if it answers
+func (n *DHTNodeClient) checkAddress(addr string) bool {
+	udpAddr, err := net.ResolveUDPAddr(network(n.ipv6), addr)
 	if err != nil {
-		return nil, err
+		log.Debugf("Couldn't resolve DHT node %s: %s", addr, err)
+		return false
 	}
 
-	resDecoded, err := bencode.Decode(buf)
+	pr, err := n.ping(udpAddr.String())
 	if err != nil {
-		return nil, err
+		log.Debugf("DHT node %s didn't answer: %s", addr, err)
+		return false
 	}
 
-	pingResponse, err := ParsePingResponse(resDecoded)
+	n.RoutingTable.PutNode(DHTNode{
+		DHTNodeId: pr.DHTNodeId,
+		DHTPeer:   newDHTPeer(udpAddr.AddrPort()),
+	})
+	return true
+}
+
+func (n *DHTNodeClient) serve() {
+	buf := make([]byte, 2048)
+	for {
+		r, addr, err := n.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Warnf("DHT node stopped: %s", err)
+			}
+			return
+		}
+
+		from, err := netip.ParseAddrPort(addr.String())
+		if err != nil {
+			continue
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+
+		// On a dual stack socket the other family's messages are for our
+		// node on its DHT
+		node := n
+		if from.Addr().Is6() != n.ipv6 {
+			if node = n.otherFamily(); node == nil || node.conn != n.conn {
+				continue
+			}
+		}
+		node.handle(buf[:r], from)
+	}
+}
+
+// handle answers queries and gives responses to the queries waiting on them
+func (n *DHTNodeClient) handle(b []byte, from netip.AddrPort) {
+	decoded, err := bencode.Decode(b)
 	if err != nil {
-		return nil, err
+		log.Debugf("Bad DHT message from %s: %s", from, err)
+		return
 	}
 
-	return &pingResponse, nil
+	msg, ok := decoded.(map[string]interface{})
+	if !ok {
+		return
+	}
+	t, _ := msg["t"].([]byte)
+	y, _ := msg["y"].([]byte)
+
+	if string(y) == "q" {
+		n.reply(t, n.handleQuery(msg, from), from)
+		return
+	}
+
+	n.mx.Lock()
+	p, ok := n.pending[string(t)]
+	if ok && p.addr == from {
+		delete(n.pending, string(t))
+	}
+	n.mx.Unlock()
+
+	if ok && p.addr == from {
+		n.voteExternalIP(msg, from)
+		p.res <- msg
+	}
 }
 
-func (n *DHTNodeClient) GetPeers(infoHash [20]byte) ([]byte, error) {
-	closestNode := n.FindClosestNode(DHTNodeId(infoHash))
+func (n *DHTNodeClient) reply(t []byte, res interface{}, to netip.AddrPort) {
+	var b []byte
+	var err error
+	switch r := res.(type) {
+	case KRPCError:
+		b, err = serializeError(t, r)
+	case map[string]interface{}:
+		b, err = serializeResponse(t, r, to)
+	}
+	if err != nil {
+		log.Debugf("Couldn't serialize DHT response: %s", err)
+		return
+	}
 
-	r := GetPeersQuery{n.NodeID, infoHash}
-	return n.SendQuery(r, closestNode.GetAddress())
+	if _, err := n.conn.WriteTo(b, net.UDPAddrFromAddrPort(to)); err != nil {
+		log.Debugf("Couldn't reply to %s: %s", to, err)
+	}
 }
 
-func (n *DHTNodeClient) FindNode(node DHTNodeId) (FindNodeResponse, error) {
-	r := FindNodeQuery{n.NodeID, node}
-	ret := FindNodeResponse{}
+func (n *DHTNodeClient) newTransactionId() string {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	n.nextTransaction++
+	return string(binary.BigEndian.AppendUint16(nil, n.nextTransaction))
+}
 
-	closestNode := n.FindClosestNode(node)
-	res, err := n.SendQuery(r, closestNode.GetAddress())
+// SendQuery sends q to addr and waits QueryTimeout for the response
+func (n *DHTNodeClient) SendQuery(q DHTQuery, addr string) (map[string]interface{}, error) {
+	udpAddr, err := net.ResolveUDPAddr(network(n.ipv6), addr)
 	if err != nil {
-		return ret, err
+		return nil, err
 	}
+	to := udpAddr.AddrPort()
+	to = netip.AddrPortFrom(to.Addr().Unmap(), to.Port())
 
-	resDict, err := bencode.Decode(res)
+	t := n.newTransactionId()
+	msg, err := serializeQuery(q, t)
 	if err != nil {
-		return ret, err
+		return nil, err
+	}
+
+	p := &pendingQuery{addr: to, res: make(chan map[string]interface{}, 1)}
+	n.mx.Lock()
+	n.pending[t] = p
+	n.mx.Unlock()
+	defer func() {
+		n.mx.Lock()
+		delete(n.pending, t)
+		n.mx.Unlock()
+	}()
+
+	if _, err := n.conn.WriteTo(msg, net.UDPAddrFromAddrPort(to)); err != nil {
+		return nil, err
 	}
 
-	return ParseFindNodeResponse(resDict.(map[string]interface{}))
+	select {
+	case res := <-p.res:
+		if y, _ := res["y"].([]byte); string(y) == "e" {
+			return nil, parseError(res)
+		}
+		return res, nil
+	case <-time.After(QueryTimeout):
+		return nil, fmt.Errorf("%s query to %s timed out", q.queryName(), addr)
+	}
 }
 
-func (n *DHTNodeClient) RefreshBucket() error {
-	randomId := GetRandNodeID()
-	r, err := n.FindNode(randomId)
+func (n *DHTNodeClient) Ping(address string) (*PingResponse, error) {
+	return n.ping(address)
+}
+
+func (n *DHTNodeClient) ping(address string) (*PingResponse, error) {
+	res, err := n.SendQuery(PingQuery{n.ID()}, address)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	for _, node := range r.Nodes {
-		n.checkAddress(node.DHTPeer)
+	pingResponse, err := ParsePingResponse(res)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+
+	return &pingResponse, nil
+}
+
+// GetPeers looks up the peers for a torrent, the result has the tokens of the
+// closest nodes for announcing to them
+func (n *DHTNodeClient) GetPeers(infoHash [20]byte) (LookupResult, error) {
+	return n.lookup(DHTNodeId(infoHash), func(node DHTNode) (lookupResponse, error) {
+		res, err := n.SendQuery(GetPeersQuery{n.ID(), infoHash}, node.GetAddress())
+		if err != nil {
+			return lookupResponse{}, err
+		}
+
+		r, err := ParseGetPeersResponse(res)
+		return lookupResponse{DHTNodeId: r.DHTNodeId, Nodes: r.Nodes, Token: r.Token, Peers: r.Peers}, err
+	})
+}
+
+// FindNode looks up the nodes closest to target
+func (n *DHTNodeClient) FindNode(target DHTNodeId) (LookupResult, error) {
+	return n.lookup(target, func(node DHTNode) (lookupResponse, error) {
+		res, err := n.SendQuery(FindNodeQuery{n.ID(), target}, node.GetAddress())
+		if err != nil {
+			return lookupResponse{}, err
+		}
+
+		r, err := ParseFindNodeResponse(res)
+		return lookupResponse{DHTNodeId: r.DHTNodeId, Nodes: r.Nodes}, err
+	})
+}
+
+func (n *DHTNodeClient) RefreshBucket() error {
+	_, err := n.FindNode(GetRandNodeID())
+	return err
 }
 
 func GetRandNodeID() [20]byte {
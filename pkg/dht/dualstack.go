@@ -0,0 +1,127 @@
+package dht
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"tor/pkg/torrent"
+)
+
+// DualStack is our nodes on the IPv4 and IPv6 DHTs (BEP 32). Each has its own
+// routing table but they answer queries that want the other family's nodes
+// from each other's
+type DualStack struct {
+	IPv4 *DHTNodeClient
+	IPv6 *DHTNodeClient
+}
+
+// NewDualStack links the nodes on each DHT, either can be nil if we're only
+// on one of them
+func NewDualStack(ipv4, ipv6 *DHTNodeClient) *DualStack {
+	if ipv4 != nil && ipv6 != nil {
+		ipv4.mx.Lock()
+		ipv4.other = ipv6
+		ipv4.mx.Unlock()
+
+		ipv6.mx.Lock()
+		ipv6.other = ipv4
+		ipv6.mx.Unlock()
+	}
+	return &DualStack{IPv4: ipv4, IPv6: ipv6}
+}
+
+// NewSharedDualStack runs our nodes on both DHTs on one dual stack socket,
+// like the uTP socket's PacketConn, and joins the DHTs. Each node answers the
+// messages from its own family
+func NewSharedDualStack(conn net.PacketConn, stateFile, stateFile6 string) *DualStack {
+	st, st6 := startState(stateFile), startState(stateFile6)
+	d := sharedDualStack(conn, st.id, st6.id)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		d.IPv4.join(st, stateFile)
+	}()
+	go func() {
+		defer wg.Done()
+		d.IPv6.join(st6, stateFile6)
+	}()
+	wg.Wait()
+	return d
+}
+
+// sharedDualStack links the nodes before either reads from conn, so no
+// message is dropped for coming from the other family
+func sharedDualStack(conn net.PacketConn, id, id6 [20]byte) *DualStack {
+	d := NewDualStack(newNode(conn, false, id), newNode(conn, true, id6))
+	go d.IPv4.serve()
+	go d.IPv6.serve()
+	return d
+}
+
+func (d *DualStack) nodes() []*DHTNodeClient {
+	var nodes []*DHTNodeClient
+	for _, n := range []*DHTNodeClient{d.IPv4, d.IPv6} {
+		if n != nil {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// GetPeers looks up a torrent's peers on both DHTs at once, it only fails if
+// every lookup does
+func (d *DualStack) GetPeers(infoHash [20]byte) ([]torrent.TorrentPeer, error) {
+	nodes := d.nodes()
+	if len(nodes) == 0 {
+		return nil, errors.New("No DHT nodes to look up peers on")
+	}
+
+	results := make([]LookupResult, len(nodes))
+	errs := make([]error, len(nodes))
+
+	var wg sync.WaitGroup
+	for i, n := range nodes {
+		wg.Add(1)
+		go func(i int, n *DHTNodeClient) {
+			defer wg.Done()
+			results[i], errs[i] = n.GetPeers(infoHash)
+		}(i, n)
+	}
+	wg.Wait()
+
+	var peers []torrent.TorrentPeer
+	failed := 0
+	for i := range nodes {
+		if errs[i] != nil {
+			failed++
+		}
+		peers = append(peers, results[i].Peers...)
+	}
+	if failed == len(nodes) {
+		return nil, errors.Join(errs...)
+	}
+	return peers, nil
+}
+
+func (d *DualStack) PeerFetcher(infoHash [20]byte) *PeerFetcher {
+	return &PeerFetcher{nodes: d.nodes(), infoHash: infoHash, port: torrent.ListenPort}
+}
+
+// Bootstrap adds the nodes at addrs to the DHT of their family
+func (d *DualStack) Bootstrap(addrs []string) error {
+	var errs []error
+	for _, n := range d.nodes() {
+		errs = append(errs, n.Bootstrap(addrs))
+	}
+	return errors.Join(errs...)
+}
+
+func (d *DualStack) Close() error {
+	var errs []error
+	for _, n := range d.nodes() {
+		errs = append(errs, n.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,94 @@
+package dht
+
+import (
+	"fmt"
+	"testing"
+	"tor/pkg/utp"
+)
+
+func listenLocal6(t *testing.T) *DHTNodeClient {
+	n, err := Listen("[::1]:0")
+	if err != nil {
+		t.Skipf("Can't listen on IPv6: %s", err)
+	}
+	t.Cleanup(func() { n.Close() })
+	return n
+}
+
+func TestDualStack(t *testing.T) {
+	nodes6 := make([]*DHTNodeClient, 3)
+	for i := range nodes6 {
+		nodes6[i] = listenLocal6(t)
+	}
+	introduce(nodes6)
+	nodes := localNetwork(t, 3)
+
+	if !nodes6[0].IPv6() || nodes[0].IPv6() {
+		t.Fatalf("Expected the nodes to be on the DHT of their address' family")
+	}
+
+	infoHash := [20]byte{7}
+	if _, err := nodes[1].Announce(infoHash, 7000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodes6[1].Announce(infoHash, 7001); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDualStack(nodes[0], nodes6[0])
+	peers, err := d.GetPeers(infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool)
+	for _, p := range peers {
+		found[p.String()] = true
+	}
+	if len(peers) != 2 || !found["127.0.0.1:7000"] || !found["[::1]:7001"] {
+		t.Errorf("Expected a peer from each DHT but got: %v", peers)
+	}
+
+	res := make(map[string]interface{})
+	nodes[0].addNodes(res, map[string]interface{}{}, infoHash)
+	if _, ok := res["nodes6"]; ok || len(res["nodes"].([]byte)) != 2*26 {
+		t.Errorf("Expected only our own family's nodes but got: %v", res)
+	}
+
+	want := []interface{}{[]byte("n4"), []byte("n6")}
+	res = make(map[string]interface{})
+	nodes[0].addNodes(res, map[string]interface{}{"want": want}, infoHash)
+	if len(res["nodes"].([]byte)) != 2*26 || len(res["nodes6"].([]byte)) != 2*38 {
+		t.Errorf("Expected the nodes of both families but got: %v", res)
+	}
+}
+
+func TestSharedDualStack(t *testing.T) {
+	s, err := utp.Listen("udp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	d := sharedDualStack(s.PacketConn(), GetRandNodeID(), GetRandNodeID())
+	defer d.Close()
+	port := d.IPv4.Addr().Port()
+	if d.IPv6.Addr().Port() != port {
+		t.Fatalf("Expected both nodes on the socket's port")
+	}
+
+	res, err := listenLocal(t).Ping(fmt.Sprintf("127.0.0.1:%v", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.DHTNodeId != d.IPv4.ID() {
+		t.Errorf("Expected the IPv4 node to answer but got %x", res.DHTNodeId)
+	}
+
+	res, err = listenLocal6(t).Ping(fmt.Sprintf("[::1]:%v", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.DHTNodeId != d.IPv6.ID() {
+		t.Errorf("Expected the IPv6 node to answer but got %x", res.DHTNodeId)
+	}
+}
@@ -0,0 +1,362 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+	"tor/pkg/bencode"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Limits on items from BEP 44
+const maxItemSize = 1000
+const maxSaltSize = 64
+
+// How long items put to us are kept, they have to be put again before then
+var ItemTimeout = 2 * time.Hour
+
+// Most items kept from puts, the ones stored longest ago make way for new ones
+var MaxStoredItems = 10000
+
+// How often puts clear out the items that have timed out
+const itemSweepInterval = time.Minute
+
+// Item is a value stored in the DHT (BEP 44). Immutable items are found by
+// the SHA-1 of their value, mutable ones by their public key and salt and
+// are signed so only the key's owner can update them
+type Item struct {
+	// Any bencodable value
+	V interface{}
+
+	// Mutable items only
+	K    ed25519.PublicKey
+	Salt []byte
+	Seq  int
+	Sig  []byte
+}
+
+// NewMutableItem signs v to be put under key's public key and salt
+func NewMutableItem(key ed25519.PrivateKey, v interface{}, salt []byte, seq int) (Item, error) {
+	item := Item{V: v, K: key.Public().(ed25519.PublicKey), Salt: salt, Seq: seq}
+	b, err := item.signedBytes()
+	if err != nil {
+		return item, err
+	}
+	item.Sig = ed25519.Sign(key, b)
+	return item, nil
+}
+
+func (i Item) Mutable() bool {
+	return i.K != nil
+}
+
+// Target is the key the item is stored under
+func (i Item) Target() ([20]byte, error) {
+	if i.Mutable() {
+		return MutableTarget(i.K, i.Salt), nil
+	}
+
+	v, err := bencode.Encode(i.V)
+	if err != nil {
+		return [20]byte{}, err
+	}
+	return sha1.Sum(v), nil
+}
+
+func MutableTarget(k ed25519.PublicKey, salt []byte) [20]byte {
+	return sha1.Sum(append(append([]byte{}, k...), salt...))
+}
+
+// signedBytes is what the signature of a mutable item covers
+func (i Item) signedBytes() ([]byte, error) {
+	v, err := bencode.Encode(i.V)
+	if err != nil {
+		return nil, err
+	}
+
+	var b []byte
+	if len(i.Salt) > 0 {
+		b = append(b, "4:salt"...)
+		b = append(b, bencode.EncodeString(i.Salt)...)
+	}
+	b = append(b, "3:seqi"+strconv.Itoa(i.Seq)+"e1:v"...)
+	return append(b, v...), nil
+}
+
+// check gives the KRPC error for an item that can't be stored
+func (i Item) check() *KRPCError {
+	v, err := bencode.Encode(i.V)
+	if err != nil {
+		return &KRPCError{errProtocol, "Bad value"}
+	}
+	if len(v) > maxItemSize {
+		return &KRPCError{errMessageTooBig, "Message too big"}
+	}
+
+	if !i.Mutable() {
+		return nil
+	}
+
+	if len(i.K) != ed25519.PublicKeySize || len(i.Sig) != ed25519.SignatureSize {
+		return &KRPCError{errProtocol, "Bad key or signature"}
+	}
+	if len(i.Salt) > maxSaltSize {
+		return &KRPCError{errSaltTooBig, "Salt too big"}
+	}
+	b, _ := i.signedBytes()
+	if !ed25519.Verify(i.K, b, i.Sig) {
+		return &KRPCError{errInvalidSignature, "Invalid signature"}
+	}
+	return nil
+}
+
+// valid checks an item found in a lookup is the one we're looking for
+func (i Item) valid(target [20]byte) bool {
+	t, err := i.Target()
+	return err == nil && t == target && i.check() == nil
+}
+
+// GetImmutable looks up the item with a value that hashes to target
+func (n *DHTNodeClient) GetImmutable(target [20]byte) (Item, error) {
+	return n.getItem(target, nil)
+}
+
+// GetMutable looks up the latest item put under a public key and salt
+func (n *DHTNodeClient) GetMutable(k ed25519.PublicKey, salt []byte) (Item, error) {
+	return n.getItem(MutableTarget(k, salt), salt)
+}
+
+func (n *DHTNodeClient) getItem(target [20]byte, salt []byte) (Item, error) {
+	res, err := n.get(target, salt)
+	if err != nil {
+		return Item{}, err
+	}
+	if res.Item == nil {
+		return Item{}, fmt.Errorf("No item found for %x", target)
+	}
+	return *res.Item, nil
+}
+
+// get is a lookup for the nodes storing target, the result has the best
+// valid item they had
+func (n *DHTNodeClient) get(target [20]byte, salt []byte) (LookupResult, error) {
+	return n.lookup(DHTNodeId(target), func(node DHTNode) (lookupResponse, error) {
+		res, err := n.SendQuery(GetQuery{n.ID(), target}, node.GetAddress())
+		if err != nil {
+			return lookupResponse{}, err
+		}
+
+		r, err := ParseGetResponse(res)
+		if err != nil {
+			return lookupResponse{}, err
+		}
+
+		if r.Item != nil {
+			r.Item.Salt = salt
+			if !r.Item.valid(target) {
+				log.Debugf("DHT node %s gave an invalid item for %x", node.GetAddress(), target)
+				r.Item = nil
+			}
+		}
+		return lookupResponse{DHTNodeId: r.DHTNodeId, Nodes: r.Nodes, Token: r.Token, Item: r.Item}, nil
+	})
+}
+
+// Put stores an item on the nodes closest to its target
+func (n *DHTNodeClient) Put(item Item) ([20]byte, error) {
+	return n.put(item, nil)
+}
+
+// PutCAS stores a mutable item only where the current one has sequence
+// number cas
+func (n *DHTNodeClient) PutCAS(item Item, cas int) ([20]byte, error) {
+	return n.put(item, &cas)
+}
+
+func (n *DHTNodeClient) put(item Item, cas *int) ([20]byte, error) {
+	target, err := item.Target()
+	if err != nil {
+		return target, err
+	}
+	if e := item.check(); e != nil {
+		return target, *e
+	}
+
+	res, err := n.get(target, item.Salt)
+	if err != nil {
+		return target, err
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(res.Nodes))
+	for i, node := range res.Nodes {
+		token, ok := res.Tokens[node.DHTNodeId]
+		if !ok {
+			errs[i] = fmt.Errorf("No token from %s", node.GetAddress())
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, node DHTNode, token []byte) {
+			defer wg.Done()
+			_, errs[i] = n.SendQuery(PutQuery{n.ID(), token, item, cas}, node.GetAddress())
+		}(i, node, token)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err == nil {
+			return target, nil
+		}
+	}
+	return target, fmt.Errorf("Couldn't put the item on any nodes: %w", errors.Join(errs...))
+}
+
+// handleGet answers a get query with the item if we have it
+func (n *DHTNodeClient) handleGet(a map[string]interface{}, from netip.AddrPort, res map[string]interface{}) interface{} {
+	target, _ := a["target"].([]byte)
+	if len(target) != 20 {
+		return KRPCError{errProtocol, "Missing target"}
+	}
+
+	res["token"] = n.token(from.Addr(), time.Now())
+	n.addNodes(res, a, DHTNodeId(target))
+
+	item, ok := n.items.get([20]byte(target), time.Now())
+	if !ok {
+		return res
+	}
+
+	res["seq"] = item.Seq
+	// They already have it if they ask for a newer one
+	if seq, ok := a["seq"].(int); ok && item.Mutable() && item.Seq <= seq {
+		return res
+	}
+	res["v"] = item.V
+	if item.Mutable() {
+		res["k"] = []byte(item.K)
+		res["sig"] = item.Sig
+	} else {
+		delete(res, "seq")
+	}
+	return res
+}
+
+// handlePut stores an item if it's valid and newer than the one we have
+func (n *DHTNodeClient) handlePut(a map[string]interface{}, from netip.AddrPort, res map[string]interface{}) interface{} {
+	token, _ := a["token"].([]byte)
+	if !n.validToken(token, from.Addr(), time.Now()) {
+		return KRPCError{errProtocol, "Bad token"}
+	}
+
+	v, ok := a["v"]
+	if !ok {
+		return KRPCError{errProtocol, "Missing v"}
+	}
+
+	item := Item{V: v}
+	if k, ok := a["k"].([]byte); ok {
+		item.K = k
+		item.Sig, _ = a["sig"].([]byte)
+		item.Salt, _ = a["salt"].([]byte)
+		item.Seq, _ = a["seq"].(int)
+	}
+	if e := item.check(); e != nil {
+		return *e
+	}
+
+	cas, hasCas := a["cas"].(int)
+	if e := n.items.put(item, hasCas, cas, time.Now()); e != nil {
+		return *e
+	}
+	return res
+}
+
+type storedItem struct {
+	Item
+	stored time.Time
+}
+
+// itemStore has the items put to us
+type itemStore struct {
+	mx    sync.Mutex
+	items map[[20]byte]storedItem
+	// When timed out items were last cleared out
+	swept time.Time
+}
+
+func newItemStore() *itemStore {
+	return &itemStore{items: make(map[[20]byte]storedItem)}
+}
+
+func (s *itemStore) get(target [20]byte, now time.Time) (Item, bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	stored, ok := s.items[target]
+	if ok && now.Sub(stored.stored) > ItemTimeout {
+		delete(s.items, target)
+		return Item{}, false
+	}
+	return stored.Item, ok
+}
+
+// put stores a checked item, a mutable item has to have a sequence number
+// at least that of the current one
+func (s *itemStore) put(item Item, hasCas bool, cas int, now time.Time) *KRPCError {
+	target, err := item.Target()
+	if err != nil {
+		return &KRPCError{errProtocol, "Bad value"}
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if current, ok := s.items[target]; ok && item.Mutable() && now.Sub(current.stored) <= ItemTimeout {
+		if hasCas && cas != current.Seq {
+			return &KRPCError{errCASMismatch, "CAS mismatch"}
+		}
+		if item.Seq < current.Seq {
+			return &KRPCError{errSeqTooLow, "Sequence number less than current"}
+		}
+		if item.Seq == current.Seq && !bytes.Equal(item.Sig, current.Sig) {
+			return &KRPCError{errSeqTooLow, "Sequence number not newer than current"}
+		}
+	}
+
+	if now.Sub(s.swept) > itemSweepInterval {
+		s.sweep(now)
+	}
+	if _, ok := s.items[target]; !ok && len(s.items) >= MaxStoredItems {
+		delete(s.items, s.oldest())
+	}
+	s.items[target] = storedItem{item, now}
+	return nil
+}
+
+func (s *itemStore) sweep(now time.Time) {
+	for target, stored := range s.items {
+		if now.Sub(stored.stored) > ItemTimeout {
+			delete(s.items, target)
+		}
+	}
+	s.swept = now
+}
+
+func (s *itemStore) oldest() [20]byte {
+	var oldest [20]byte
+	var oldestTime time.Time
+	for target, stored := range s.items {
+		if oldestTime.IsZero() || stored.stored.Before(oldestTime) {
+			oldest, oldestTime = target, stored.stored
+		}
+	}
+	return oldest
+}
@@ -0,0 +1,167 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Test vectors from BEP 44
+func TestItemVectors(t *testing.T) {
+	immutable := Item{V: []byte("Hello World!")}
+	target, err := immutable.Target()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(target[:]) != "e5f96f6f38320f0f33959cb4d3d656452117aadb" {
+		t.Errorf("Unexpected immutable target: %x", target)
+	}
+
+	k := ed25519.PublicKey(mustDecodeHex(t, "77ff84905a91936367c01360803104f92432fcd904a43511876df5cdf3e7e548"))
+	tests := []struct {
+		salt   string
+		signed string
+		sig    string
+		target string
+	}{
+		{"", "3:seqi1e1:v12:Hello World!", "305ac8aeb6c9c151fa120f120ea2cfb923564e11552d06a5d856091e5e853cff1260d3f39e4999684aa92eb73ffd136e6f4f3ecbfda0ce53a1608ecd7ae21f01", "4a533d47ec9c7d95b1ad75f576cffc641853b750"},
+		{"foobar", "4:salt6:foobar3:seqi1e1:v12:Hello World!", "6834284b6b24c3204eb2fea824d82f88883a3d95e8b4a21b8c0ded553d17d17ddf9a8a7104b1258f30bed3787e6cb896fca78c58f8e03b5f18f14951a87d9a08", "411eba73b6f087ca51a3795d9c8c938d365e32c1"},
+	}
+	for _, tt := range tests {
+		item := Item{V: []byte("Hello World!"), K: k, Salt: []byte(tt.salt), Seq: 1, Sig: mustDecodeHex(t, tt.sig)}
+
+		signed, err := item.signedBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(signed) != tt.signed {
+			t.Errorf("Expected to sign %s but got %s", tt.signed, signed)
+		}
+
+		if e := item.check(); e != nil {
+			t.Errorf("Expected a valid signature but got: %s", e)
+		}
+
+		target, _ := item.Target()
+		if hex.EncodeToString(target[:]) != tt.target {
+			t.Errorf("Expected target %s but got %x", tt.target, target)
+		}
+	}
+}
+
+func TestItemCheck(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+
+	if e := (Item{V: make([]byte, maxItemSize)}).check(); e == nil || e.Code != errMessageTooBig {
+		t.Errorf("Expected a too big error but got: %v", e)
+	}
+
+	item, err := NewMutableItem(key, []byte("v"), make([]byte, maxSaltSize+1), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := item.check(); e == nil || e.Code != errSaltTooBig {
+		t.Errorf("Expected a salt too big error but got: %v", e)
+	}
+
+	item, _ = NewMutableItem(key, []byte("v"), nil, 1)
+	item.Seq = 2
+	if e := item.check(); e == nil || e.Code != errInvalidSignature {
+		t.Errorf("Expected an invalid signature error but got: %v", e)
+	}
+}
+
+func TestPutAndGetItems(t *testing.T) {
+	nodes := localNetwork(t, 5)
+
+	target, err := nodes[0].Put(Item{V: []byte("immutable")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err := nodes[4].GetImmutable(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := item.V.([]byte); string(v) != "immutable" {
+		t.Errorf("Unexpected immutable item: %+v", item)
+	}
+
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	salt := []byte("build")
+	for seq := 1; seq <= 2; seq++ {
+		item, _ := NewMutableItem(key, map[string]interface{}{"seq": seq}, salt, seq)
+		if _, err := nodes[0].Put(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	item, err = nodes[3].GetMutable(pub, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Seq != 2 || !bytes.Equal(item.Salt, salt) {
+		t.Errorf("Expected the latest mutable item but got: %+v", item)
+	}
+
+	if _, err := nodes[1].GetMutable(pub, []byte("other")); err == nil {
+		t.Errorf("Items are stored under their salt")
+	}
+
+	old, _ := NewMutableItem(key, []byte("old"), salt, 1)
+	_, err = nodes[0].Put(old)
+	var krpcErr KRPCError
+	if !errors.As(err, &krpcErr) || krpcErr.Code != errSeqTooLow {
+		t.Errorf("Expected older items to be rejected but got: %v", err)
+	}
+
+	next, _ := NewMutableItem(key, []byte("next"), salt, 3)
+	if _, err := nodes[0].PutCAS(next, 1); !errors.As(err, &krpcErr) || krpcErr.Code != errCASMismatch {
+		t.Errorf("Expected a CAS mismatch but got: %v", err)
+	}
+	if _, err := nodes[0].PutCAS(next, 2); err != nil {
+		t.Errorf("Expected the CAS put to work but got: %v", err)
+	}
+}
+
+func TestItemStoreEvictsOldestAndExpired(t *testing.T) {
+	defer func(items int) { MaxStoredItems = items }(MaxStoredItems)
+	MaxStoredItems = 2
+
+	s := newItemStore()
+	now := time.Now()
+	targets := make([][20]byte, 3)
+	for i := range targets {
+		item := Item{V: []byte{byte(i)}}
+		targets[i], _ = item.Target()
+		if e := s.put(item, false, 0, now.Add(time.Duration(i)*time.Second)); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	if len(s.items) != 2 {
+		t.Fatalf("Expected the items to be capped but have %v", len(s.items))
+	}
+	if _, ok := s.get(targets[0], now.Add(3*time.Second)); ok {
+		t.Errorf("Expected the item stored longest ago to be evicted")
+	}
+
+	later := now.Add(ItemTimeout + 2*time.Second + itemSweepInterval)
+	if e := s.put(Item{V: []byte("new")}, false, 0, later); e != nil {
+		t.Fatal(e)
+	}
+	if len(s.items) != 1 {
+		t.Errorf("Expected the timed out items to be cleared out on put but have %v", len(s.items))
+	}
+}
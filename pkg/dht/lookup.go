@@ -0,0 +1,153 @@
+package dht
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"tor/pkg/torrent"
+)
+
+// Alpha is how many queries a lookup has in flight at once
+var Alpha = 3
+
+// LookupResult is what an iterative lookup converged on
+type LookupResult struct {
+	Target DHTNodeId
+	// The closest nodes that answered, closest first
+	Nodes []DHTNode
+	// The get_peers tokens of the nodes that gave one, needed to announce
+	Tokens map[DHTNodeId][]byte
+	Peers  []torrent.TorrentPeer
+	// The item with the highest sequence number from a get lookup
+	Item *Item
+}
+
+// lookupResponse is the part of a find_node or get_peers response a lookup
+// uses
+type lookupResponse struct {
+	DHTNodeId
+	Nodes []DHTNode
+	Token []byte
+	Peers []torrent.TorrentPeer
+	Item  *Item
+}
+
+type lookupQuery func(node DHTNode) (lookupResponse, error)
+
+type candidateState int
+
+const (
+	unqueried candidateState = iota
+	querying
+	answered
+	failed
+)
+
+type candidate struct {
+	DHTNodeDistance
+	state candidateState
+}
+
+// lookup queries the closest nodes it knows of for target, Alpha at a time,
+// until the MaxBucketSize closest nodes it has heard of have all answered or
+// failed
+func (n *DHTNodeClient) lookup(target DHTNodeId, query lookupQuery) (LookupResult, error) {
+	start := n.Closest(target, MaxBucketSize)
+	if len(start) == 0 {
+		return LookupResult{}, fmt.Errorf("No nodes in the routing table")
+	}
+
+	self := n.ID()
+	var candidates []*candidate
+	seen := make(map[DHTNodeId]bool)
+	addCandidates := func(nodes []DHTNode) {
+		for i := range nodes {
+			// Nodes of the other family are for our node on its DHT
+			if seen[nodes[i].DHTNodeId] || nodes[i].DHTNodeId == self || nodes[i].IPv6() != n.ipv6 {
+				continue
+			}
+			seen[nodes[i].DHTNodeId] = true
+			candidates = append(candidates, &candidate{DHTNodeDistance: target.Distance(&nodes[i])})
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].Less(&candidates[j].DHTNodeDistance)
+		})
+	}
+	addCandidates(start)
+
+	type reply struct {
+		c   *candidate
+		res lookupResponse
+		err error
+	}
+	replies := make(chan reply)
+	inFlight := 0
+
+	result := LookupResult{Target: target, Tokens: make(map[DHTNodeId][]byte)}
+	peers := make(map[netip.AddrPort]bool)
+	for {
+		considered := 0
+		for _, c := range candidates {
+			if considered == MaxBucketSize || inFlight == Alpha {
+				break
+			}
+			if c.state == failed {
+				continue
+			}
+			if c.state == unqueried {
+				c.state = querying
+				inFlight++
+				go func(c *candidate) {
+					res, err := query(c.DHTNode)
+					replies <- reply{c, res, err}
+				}(c)
+			}
+			considered++
+		}
+
+		if inFlight == 0 {
+			break
+		}
+
+		r := <-replies
+		inFlight--
+		if r.err == nil && r.res.DHTNodeId != r.c.DHTNodeId {
+			r.err = fmt.Errorf("Node %x answered with ID %x", r.c.DHTNodeId, r.res.DHTNodeId)
+		}
+		if r.err != nil {
+			r.c.state = failed
+			n.NodeFailed(r.c.DHTNodeId)
+			continue
+		}
+
+		r.c.state = answered
+		n.PutNode(r.c.DHTNode)
+		if r.res.Token != nil {
+			result.Tokens[r.c.DHTNodeId] = r.res.Token
+		}
+		for _, p := range r.res.Peers {
+			if !peers[p.AddrPort] {
+				peers[p.AddrPort] = true
+				result.Peers = append(result.Peers, p)
+			}
+		}
+		if r.res.Item != nil && (result.Item == nil || r.res.Item.Seq > result.Item.Seq) {
+			result.Item = r.res.Item
+		}
+		addCandidates(r.res.Nodes)
+	}
+
+	for _, c := range candidates {
+		if len(result.Nodes) == MaxBucketSize {
+			break
+		}
+		if c.state == answered {
+			result.Nodes = append(result.Nodes, c.DHTNode)
+		}
+	}
+
+	if len(result.Nodes) == 0 {
+		return result, fmt.Errorf("No DHT nodes answered the lookup")
+	}
+	return result, nil
+}
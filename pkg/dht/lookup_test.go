@@ -0,0 +1,169 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"sort"
+	"sync"
+	"testing"
+	"tor/pkg/torrent"
+)
+
+// fakeNetwork is a DHT where each node only knows a few nodes at each
+// distance from itself, like a routing table, so lookups have to get closer
+// a hop at a time
+type fakeNetwork struct {
+	rng   *rand.Rand
+	nodes []DHTNode
+	down  map[DHTNodeId]bool
+	known map[DHTNodeId][]DHTNode
+
+	mx      sync.Mutex
+	queried map[DHTNodeId]bool
+}
+
+// newFakeNetwork is seeded so the same network is made every time
+func newFakeNetwork(size int) *fakeNetwork {
+	net := &fakeNetwork{
+		rng:     rand.New(rand.NewSource(1)),
+		down:    make(map[DHTNodeId]bool),
+		known:   make(map[DHTNodeId][]DHTNode),
+		queried: make(map[DHTNodeId]bool),
+	}
+	for i := 0; i < size; i++ {
+		net.nodes = append(net.nodes, DHTNode{DHTNodeId: net.randomId(), DHTPeer: DHTPeer{"10.0.0.1", fmt.Sprint(i)}})
+	}
+
+	for _, n := range net.nodes {
+		buckets := make(map[int][]DHTNode)
+		for _, i := range net.rng.Perm(size) {
+			other := net.nodes[i]
+			if other.DHTNodeId == n.DHTNodeId {
+				continue
+			}
+			bucket := prefixLen(n.DHTNodeId, other.DHTNodeId)
+			if len(buckets[bucket]) < MaxBucketSize {
+				buckets[bucket] = append(buckets[bucket], other)
+				net.known[n.DHTNodeId] = append(net.known[n.DHTNodeId], other)
+			}
+		}
+	}
+	return net
+}
+
+func (net *fakeNetwork) randomId() DHTNodeId {
+	var id DHTNodeId
+	net.rng.Read(id[:])
+	return id
+}
+
+// closestOf is the MaxBucketSize nodes closest to target
+func closestOf(target DHTNodeId, nodes []DHTNode) []DHTNode {
+	var distances DHTNodeDistances
+	for i := range nodes {
+		distances = append(distances, target.Distance(&nodes[i]))
+	}
+	sort.Sort(distances)
+
+	var closest []DHTNode
+	for i := 0; i < len(distances) && i < MaxBucketSize; i++ {
+		closest = append(closest, distances[i].DHTNode)
+	}
+	return closest
+}
+
+// closest is the actual closest nodes that are up
+func (net *fakeNetwork) closest(target DHTNodeId) []DHTNode {
+	var up []DHTNode
+	for _, n := range net.nodes {
+		if !net.down[n.DHTNodeId] {
+			up = append(up, n)
+		}
+	}
+	return closestOf(target, up)
+}
+
+func (net *fakeNetwork) query(target DHTNodeId) lookupQuery {
+	return func(node DHTNode) (lookupResponse, error) {
+		net.mx.Lock()
+		net.queried[node.DHTNodeId] = true
+		net.mx.Unlock()
+
+		if net.down[node.DHTNodeId] {
+			return lookupResponse{}, errors.New("timeout")
+		}
+
+		// Nodes don't know which of the others are down
+		res := lookupResponse{
+			DHTNodeId: node.DHTNodeId,
+			Nodes:     closestOf(target, net.known[node.DHTNodeId]),
+			Token:     node.DHTNodeId[:4],
+		}
+		// The closest node has a peer
+		if node.DHTNodeId == net.closest(target)[0].DHTNodeId {
+			res.Peers = []torrent.TorrentPeer{torrent.NewTorrentPeer(netip.MustParseAddr("1.2.3.4"), 6881)}
+		}
+		return res, nil
+	}
+}
+
+func TestLookupConverges(t *testing.T) {
+	net := newFakeNetwork(300)
+	for i := 0; i < 30; i++ {
+		net.down[net.nodes[i*10].DHTNodeId] = true
+	}
+
+	client := &DHTNodeClient{NodeID: net.randomId()}
+	client.RoutingTable = NewRoutingTable(client.NodeID)
+	// Only knows a few nodes to start with
+	for _, n := range net.nodes[:5] {
+		client.PutNode(n)
+	}
+
+	target := net.randomId()
+	for _, n := range net.nodes[:5] {
+		if prefixLen(n.DHTNodeId, target) > 4 {
+			t.Fatalf("The first nodes should be far from the target")
+		}
+	}
+	res, err := client.lookup(target, net.query(target))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := net.closest(target)
+	if len(res.Nodes) != len(expected) {
+		t.Fatalf("Expected %v nodes but got %v", len(expected), len(res.Nodes))
+	}
+	for i := range expected {
+		if res.Nodes[i].DHTNodeId != expected[i].DHTNodeId {
+			t.Errorf("Node %v should be %x but got %x", i, expected[i].DHTNodeId, res.Nodes[i].DHTNodeId)
+		}
+		if _, ok := res.Tokens[expected[i].DHTNodeId]; !ok {
+			t.Errorf("Missing token for node %v", i)
+		}
+	}
+
+	if len(res.Peers) != 1 || res.Peers[0].String() != "1.2.3.4:6881" {
+		t.Errorf("Expected the peer from the closest node but got: %v", res.Peers)
+	}
+
+	if len(net.queried) >= len(net.nodes)/2 {
+		t.Errorf("The lookup should narrow in rather than query most nodes but queried %v", len(net.queried))
+	}
+
+	if client.Len() <= 5 {
+		t.Errorf("Nodes that answered should be added to the routing table")
+	}
+}
+
+func TestLookupWithoutNodes(t *testing.T) {
+	client := &DHTNodeClient{NodeID: GetRandNodeID()}
+	client.RoutingTable = NewRoutingTable(client.NodeID)
+
+	if _, err := client.lookup(DHTNodeId{}, newFakeNetwork(0).query(DHTNodeId{})); err == nil {
+		t.Errorf("Expected an error with an empty routing table")
+	}
+}
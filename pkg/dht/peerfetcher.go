@@ -0,0 +1,115 @@
+package dht
+
+import (
+	"sync"
+	"time"
+	"tor/pkg/torrent"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How often a torrent's peers are looked up and our port announced, a
+// session low on peers looks again after MinAnnounceInterval
+var AnnounceInterval = 15 * time.Minute
+var MinAnnounceInterval = time.Minute
+
+// Announce looks up a torrent's peers then announces port to the closest
+// nodes with the tokens they gave us
+func (n *DHTNodeClient) Announce(infoHash [20]byte, port int) (LookupResult, error) {
+	res, err := n.GetPeers(infoHash)
+	if err != nil {
+		return res, err
+	}
+
+	var wg sync.WaitGroup
+	for _, node := range res.Nodes {
+		token, ok := res.Tokens[node.DHTNodeId]
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+		go func(node DHTNode, token []byte) {
+			defer wg.Done()
+			q := AnnouncePeerQuery{DHTNodeId: n.ID(), InfoHash: infoHash, Port: uint16(port), Token: token}
+			if _, err := n.SendQuery(q, node.GetAddress()); err != nil {
+				log.Debugf("Couldn't announce to DHT node %s: %s", node.GetAddress(), err)
+			}
+		}(node, token)
+	}
+	wg.Wait()
+	return res, nil
+}
+
+// PeerFetcher finds a torrent's peers in the DHT and announces we have it,
+// on each family's DHT it has a node for
+type PeerFetcher struct {
+	nodes    []*DHTNodeClient
+	infoHash [20]byte
+	// Port we accept peer connections on
+	port int
+}
+
+func (n *DHTNodeClient) PeerFetcher(infoHash [20]byte) *PeerFetcher {
+	return &PeerFetcher{nodes: []*DHTNodeClient{n}, infoHash: infoHash, port: torrent.ListenPort}
+}
+
+// Decentralised means private torrents won't use the DHT
+func (f *PeerFetcher) Decentralised() {}
+
+func (f *PeerFetcher) GetPeers() []torrent.TorrentPeer {
+	var mx sync.Mutex
+	var wg sync.WaitGroup
+	var peers []torrent.TorrentPeer
+	for _, n := range f.nodes {
+		wg.Add(1)
+		go func(n *DHTNodeClient) {
+			defer wg.Done()
+			res, err := n.Announce(f.infoHash, f.port)
+			if err != nil {
+				log.Warnf("DHT lookup for %x failed: %s", f.infoHash, err)
+				return
+			}
+			mx.Lock()
+			peers = append(peers, res.Peers...)
+			mx.Unlock()
+		}(n)
+	}
+	wg.Wait()
+	return peers
+}
+
+// Run announces every AnnounceInterval, or sooner if the session needs
+// peers, and gives the peers found to the session
+func (f *PeerFetcher) Run(s torrent.PeerSession, stop <-chan struct{}) {
+	ticker := time.NewTicker(MinAnnounceInterval)
+	defer ticker.Stop()
+
+	results := make(chan []torrent.TorrentPeer, 1)
+	running := false
+	var lastAnnounce time.Time
+	for {
+		now := time.Now()
+		due := lastAnnounce.IsZero() || now.Sub(lastAnnounce) >= AnnounceInterval ||
+			(s.NeedsPeers() && now.Sub(lastAnnounce) >= MinAnnounceInterval)
+		if !running && due {
+			running = true
+			lastAnnounce = now
+			go func() {
+				results <- f.GetPeers()
+			}()
+		}
+
+		select {
+		case <-stop:
+			return
+		case peers := <-results:
+			running = false
+			if len(peers) > 0 {
+				log.Debugf("Found %v peers in the DHT", len(peers))
+				s.AddPeers(peers)
+			}
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package dht
+
+import (
+	"sync"
+	"testing"
+	"time"
+	"tor/pkg/torrent"
+)
+
+type fakePeerSession struct {
+	mx    sync.Mutex
+	peers []torrent.TorrentPeer
+}
+
+func (s *fakePeerSession) AnnounceStats() torrent.AnnounceStats { return torrent.AnnounceStats{} }
+func (s *fakePeerSession) NeedsPeers() bool                     { return true }
+
+func (s *fakePeerSession) AddPeers(peers []torrent.TorrentPeer) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.peers = append(s.peers, peers...)
+}
+
+// localNetwork starts nodes on localhost that all know each other
+func localNetwork(t *testing.T, size int) []*DHTNodeClient {
+	nodes := make([]*DHTNodeClient, size)
+	for i := range nodes {
+		nodes[i] = listenLocal(t)
+	}
+	introduce(nodes)
+	return nodes
+}
+
+// introduce puts the nodes in each other's routing tables
+func introduce(nodes []*DHTNodeClient) {
+	for _, n := range nodes {
+		for _, other := range nodes {
+			n.PutNode(DHTNode{other.NodeID, newDHTPeer(other.Addr())})
+		}
+	}
+}
+
+func TestPeerFetcherAnnounces(t *testing.T) {
+	nodes := localNetwork(t, 4)
+	infoHash := [20]byte{4, 5, 6}
+
+	seeder := nodes[0].PeerFetcher(infoHash)
+	seeder.port = 7000
+	if peers := seeder.GetPeers(); len(peers) != 0 {
+		t.Errorf("Nobody should have the torrent yet but got: %v", peers)
+	}
+
+	f := nodes[1].PeerFetcher(infoHash)
+	peers := f.GetPeers()
+	if len(peers) != 1 || peers[0].String() != "127.0.0.1:7000" {
+		t.Errorf("Expected the seeder but got: %v", peers)
+	}
+
+	session := &fakePeerSession{}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		nodes[2].PeerFetcher(infoHash).Run(session, stop)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		session.mx.Lock()
+		n := len(session.peers)
+		session.mx.Unlock()
+		if n > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	<-done
+
+	session.mx.Lock()
+	defer session.mx.Unlock()
+	// The seeder and the node that got peers before
+	if len(session.peers) != 2 {
+		t.Errorf("Expected the announced peers to be given to the session but got: %v", session.peers)
+	}
+}
@@ -3,11 +3,35 @@ package dht
 import (
 	"encoding/binary"
 	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
 	"tor/pkg/bencode"
+	"tor/pkg/torrent"
 )
 
 const PingQueryName = "ping"
 const GetPeersQueryName = "get_peers"
+const FindNodeQueryName = "find_node"
+const AnnouncePeerQueryName = "announce_peer"
+const GetQueryName = "get"
+const PutQueryName = "put"
+const SampleInfoHashesQueryName = "sample_infohashes"
+
+// KRPC error codes
+const (
+	errGeneric       = 201
+	errServer        = 202
+	errProtocol      = 203
+	errMethodUnknown = 204
+
+	errMessageTooBig    = 205
+	errInvalidSignature = 206
+	errSaltTooBig       = 207
+	errCASMismatch      = 301
+	errSeqTooLow        = 302
+)
 
 type DHTNodeId [20]byte
 
@@ -23,6 +47,18 @@ type DHTPeer struct {
 
 type DHTQuery interface {
 	Serialize() ([]byte, error)
+	queryName() string
+	args() map[string]interface{}
+}
+
+// KRPCError is an error message from a node
+type KRPCError struct {
+	Code    int
+	Message string
+}
+
+func (e KRPCError) Error() string {
+	return fmt.Sprintf("DHT error %v: %s", e.Code, e.Message)
 }
 
 type PingQuery struct {
@@ -43,21 +79,106 @@ type FindNodeQuery struct {
 	TargetNodeID DHTNodeId
 }
 
+type AnnouncePeerQuery struct {
+	DHTNodeId
+	InfoHash [20]byte
+	Port     uint16
+	Token    []byte
+	// The peer's port is the one the query came from, for peers behind NAT
+	ImpliedPort bool
+}
+
+type GetQuery struct {
+	DHTNodeId
+	Target [20]byte
+}
+
+type PutQuery struct {
+	DHTNodeId
+	Token []byte
+	Item
+	// Only put a mutable item if the current one has this sequence number
+	Cas *int
+}
+
+type SampleInfoHashesQuery struct {
+	DHTNodeId
+	Target DHTNodeId
+}
+
 type FindNodeResponse struct {
 	DHTNodeId
 	Nodes []DHTNode
 }
 
-func (q PingQuery) Serialize() ([]byte, error) {
-	return serializeQuery(map[string]interface{}{"id": q.DHTNodeId[:]}, PingQueryName)
+func (q PingQuery) Serialize() ([]byte, error)   { return serializeQuery(q, "aa") }
+func (q PingQuery) queryName() string            { return PingQueryName }
+func (q PingQuery) args() map[string]interface{} { return map[string]interface{}{"id": q.DHTNodeId[:]} }
+
+func (q GetPeersQuery) Serialize() ([]byte, error) { return serializeQuery(q, "aa") }
+func (q GetPeersQuery) queryName() string          { return GetPeersQueryName }
+func (q GetPeersQuery) args() map[string]interface{} {
+	return map[string]interface{}{"id": q.DHTNodeId[:], "info_hash": q.InfoHash[:]}
+}
+
+func (q FindNodeQuery) Serialize() ([]byte, error) { return serializeQuery(q, "aa") }
+func (q FindNodeQuery) queryName() string          { return FindNodeQueryName }
+func (q FindNodeQuery) args() map[string]interface{} {
+	return map[string]interface{}{"id": q.DHTNodeId[:], "target": q.TargetNodeID[:]}
+}
+
+func (q AnnouncePeerQuery) Serialize() ([]byte, error) { return serializeQuery(q, "aa") }
+func (q AnnouncePeerQuery) queryName() string          { return AnnouncePeerQueryName }
+func (q AnnouncePeerQuery) args() map[string]interface{} {
+	impliedPort := 0
+	if q.ImpliedPort {
+		impliedPort = 1
+	}
+	return map[string]interface{}{
+		"id":           q.DHTNodeId[:],
+		"info_hash":    q.InfoHash[:],
+		"port":         int(q.Port),
+		"token":        q.Token,
+		"implied_port": impliedPort,
+	}
+}
+
+func (q GetQuery) Serialize() ([]byte, error) { return serializeQuery(q, "aa") }
+func (q GetQuery) queryName() string          { return GetQueryName }
+func (q GetQuery) args() map[string]interface{} {
+	return map[string]interface{}{"id": q.DHTNodeId[:], "target": q.Target[:]}
+}
+
+func (q PutQuery) Serialize() ([]byte, error) { return serializeQuery(q, "aa") }
+func (q PutQuery) queryName() string          { return PutQueryName }
+func (q PutQuery) args() map[string]interface{} {
+	args := map[string]interface{}{"id": q.DHTNodeId[:], "token": q.Token, "v": q.V}
+	if q.Mutable() {
+		args["k"] = []byte(q.K)
+		args["seq"] = q.Seq
+		args["sig"] = q.Sig
+		if len(q.Salt) > 0 {
+			args["salt"] = q.Salt
+		}
+		if q.Cas != nil {
+			args["cas"] = *q.Cas
+		}
+	}
+	return args
 }
 
-func (q GetPeersQuery) Serialize() ([]byte, error) {
-	return serializeQuery(map[string]interface{}{"id": q.DHTNodeId[:], "info_hash": q.InfoHash[:]}, GetPeersQueryName)
+func (q SampleInfoHashesQuery) Serialize() ([]byte, error) { return serializeQuery(q, "aa") }
+func (q SampleInfoHashesQuery) queryName() string          { return SampleInfoHashesQueryName }
+func (q SampleInfoHashesQuery) args() map[string]interface{} {
+	return map[string]interface{}{"id": q.DHTNodeId[:], "target": q.Target[:]}
 }
 
-func (q FindNodeQuery) Serialize() ([]byte, error) {
-	return serializeQuery(map[string]interface{}{"id": q.DHTNodeId[:], "target": q.TargetNodeID[:]}, "find_node")
+type GetPeersResponse struct {
+	DHTNodeId
+	// Needed to announce to the node
+	Token []byte
+	Peers []torrent.TorrentPeer
+	Nodes []DHTNode
 }
 
 func getResponseDict(r interface{}) (map[string]interface{}, error) {
@@ -66,8 +187,8 @@ func getResponseDict(r interface{}) (map[string]interface{}, error) {
 		return nil, fmt.Errorf("Response is expected to be of map[string]interface type")
 	}
 
-	responseType := d["y"].([]byte)[0]
-	if responseType != 'r' && responseType != 'e' {
+	y, _ := d["y"].([]byte)
+	if len(y) == 0 || (y[0] != 'r' && y[0] != 'e') {
 		return nil, fmt.Errorf("Provided dict is not a response")
 	}
 
@@ -78,30 +199,146 @@ func getResponseDict(r interface{}) (map[string]interface{}, error) {
 	return resDict, nil
 }
 
-func ParseFindNodeResponse(r map[string]interface{}) (FindNodeResponse, error) {
+func ParseFindNodeResponse(r interface{}) (FindNodeResponse, error) {
 	ret := FindNodeResponse{}
 	resDict, err := getResponseDict(r)
 	if err != nil {
 		return ret, err
 	}
 
-	id := resDict["id"].([]byte)
+	id, _ := resDict["id"].([]byte)
 
 	if len(id) != 20 {
 		return ret, fmt.Errorf("Expected ID of size 20")
 	}
 
 	copy(ret.DHTNodeId[:], id)
+	ret.Nodes = parseNodes(resDict)
+	return ret, nil
+}
+
+func ParseGetPeersResponse(r interface{}) (GetPeersResponse, error) {
+	ret := GetPeersResponse{}
+	resDict, err := getResponseDict(r)
+	if err != nil {
+		return ret, err
+	}
 
-	nodes := resDict["nodes"].([]byte)
-	numNodes := len(nodes) / 26
+	id, _ := resDict["id"].([]byte)
+	if len(id) != 20 {
+		return ret, fmt.Errorf("Expected ID of size 20")
+	}
+	copy(ret.DHTNodeId[:], id)
 
-	for i := 0; i < numNodes; i++ {
-		ret.Nodes = append(ret.Nodes, parseNodeInfo([26]byte(nodes[i*26:])))
+	ret.Token, _ = resDict["token"].([]byte)
+	values, _ := resDict["values"].([]interface{})
+	for _, v := range values {
+		if b, ok := v.([]byte); ok && (len(b) == 6 || len(b) == 18) {
+			ret.Peers = append(ret.Peers, torrent.ParseCompactPeers(b, len(b) == 18)...)
+		}
 	}
+	ret.Nodes = parseNodes(resDict)
 	return ret, nil
 }
 
+type GetResponse struct {
+	DHTNodeId
+	Token []byte
+	Nodes []DHTNode
+	// The item if the node has it, the salt of a mutable item isn't included
+	Item *Item
+}
+
+func ParseGetResponse(r interface{}) (GetResponse, error) {
+	ret := GetResponse{}
+	resDict, err := getResponseDict(r)
+	if err != nil {
+		return ret, err
+	}
+
+	id, _ := resDict["id"].([]byte)
+	if len(id) != 20 {
+		return ret, fmt.Errorf("Expected ID of size 20")
+	}
+	copy(ret.DHTNodeId[:], id)
+
+	ret.Token, _ = resDict["token"].([]byte)
+	ret.Nodes = parseNodes(resDict)
+
+	if v, ok := resDict["v"]; ok {
+		item := &Item{V: v}
+		if k, ok := resDict["k"].([]byte); ok {
+			item.K = k
+			item.Sig, _ = resDict["sig"].([]byte)
+			item.Seq, _ = resDict["seq"].(int)
+		}
+		ret.Item = item
+	}
+	return ret, nil
+}
+
+type SampleInfoHashesResponse struct {
+	DHTNodeId
+	// How long until the node has a new sample
+	Interval time.Duration
+	// How many info hashes the node has
+	Num     int
+	Samples [][20]byte
+	Nodes   []DHTNode
+}
+
+func ParseSampleInfoHashesResponse(r interface{}) (SampleInfoHashesResponse, error) {
+	ret := SampleInfoHashesResponse{}
+	resDict, err := getResponseDict(r)
+	if err != nil {
+		return ret, err
+	}
+
+	id, _ := resDict["id"].([]byte)
+	if len(id) != 20 {
+		return ret, fmt.Errorf("Expected ID of size 20")
+	}
+	copy(ret.DHTNodeId[:], id)
+
+	interval, _ := resDict["interval"].(int)
+	ret.Interval = time.Duration(interval) * time.Second
+	ret.Num, _ = resDict["num"].(int)
+
+	samples, _ := resDict["samples"].([]byte)
+	if len(samples)%20 != 0 {
+		return ret, fmt.Errorf("Expected samples to be a multiple of 20 bytes")
+	}
+	for i := 0; i < len(samples); i += 20 {
+		ret.Samples = append(ret.Samples, [20]byte(samples[i:]))
+	}
+	ret.Nodes = parseNodes(resDict)
+	return ret, nil
+}
+
+// parseNodes parses the compact node info in a response's nodes and nodes6
+func parseNodes(resDict map[string]interface{}) []DHTNode {
+	nodes, _ := resDict["nodes"].([]byte)
+	nodes6, _ := resDict["nodes6"].([]byte)
+	numNodes, numNodes6 := len(nodes)/26, len(nodes6)/38
+
+	ret := make([]DHTNode, 0, numNodes+numNodes6)
+	for i := 0; i < numNodes; i++ {
+		ret = append(ret, parseNodeInfo([26]byte(nodes[i*26:])))
+	}
+	for i := 0; i < numNodes6; i++ {
+		ret = append(ret, parseNodeInfo6([38]byte(nodes6[i*38:])))
+	}
+	return ret
+}
+
+// nodesKey is where a response has the nodes of a family (BEP 32)
+func nodesKey(ipv6 bool) string {
+	if ipv6 {
+		return "nodes6"
+	}
+	return "nodes"
+}
+
 func ParsePingResponse(r interface{}) (PingResponse, error) {
 	ret := PingResponse{}
 	resDict, err := getResponseDict(r)
@@ -109,7 +346,7 @@ func ParsePingResponse(r interface{}) (PingResponse, error) {
 		return ret, err
 	}
 
-	id := resDict["id"].([]byte)
+	id, _ := resDict["id"].([]byte)
 
 	if len(id) != 20 {
 		return ret, fmt.Errorf("Expected ID of size 20")
@@ -119,15 +356,49 @@ func ParsePingResponse(r interface{}) (PingResponse, error) {
 	return ret, nil
 }
 
-func serializeQuery(args map[string]interface{}, queryName string) ([]byte, error) {
+func serializeQuery(q DHTQuery, transactionId string) ([]byte, error) {
 	return bencode.Encode(map[string]interface{}{
-		"t": "aa",
+		"t": transactionId,
 		"y": "q",
-		"q": queryName,
-		"a": args,
+		"q": q.queryName(),
+		"a": q.args(),
 	})
 }
 
+// serializeResponse makes a response to a query from addr, which is
+// included so the node can learn its external IP (BEP 42)
+func serializeResponse(transactionId []byte, r map[string]interface{}, addr netip.AddrPort) ([]byte, error) {
+	return bencode.Encode(map[string]interface{}{
+		"t":  transactionId,
+		"y":  "r",
+		"r":  r,
+		"ip": torrent.TorrentPeer{AddrPort: addr}.Compact(),
+	})
+}
+
+func serializeError(transactionId []byte, e KRPCError) ([]byte, error) {
+	return bencode.Encode(map[string]interface{}{
+		"t": transactionId,
+		"y": "e",
+		"e": []interface{}{e.Code, e.Message},
+	})
+}
+
+// parseError gets the error from an error message
+func parseError(msg map[string]interface{}) KRPCError {
+	e, _ := msg["e"].([]interface{})
+	ret := KRPCError{Code: errGeneric}
+	if len(e) == 2 {
+		if code, ok := e[0].(int); ok {
+			ret.Code = code
+		}
+		if m, ok := e[1].([]byte); ok {
+			ret.Message = string(m)
+		}
+	}
+	return ret
+}
+
 func parsePeerInfo(bs [6]byte) DHTPeer {
 	return DHTPeer{
 		Host: fmt.Sprintf("%v.%v.%v.%v", bs[0], bs[1], bs[2], bs[3]),
@@ -142,6 +413,60 @@ func parseNodeInfo(bs [26]byte) DHTNode {
 	}
 }
 
+func parseNodeInfo6(bs [38]byte) DHTNode {
+	return DHTNode{
+		DHTPeer:   newDHTPeer(netip.AddrPortFrom(netip.AddrFrom16([16]byte(bs[20:])), binary.BigEndian.Uint16(bs[36:]))),
+		DHTNodeId: [20]byte(bs[:20]),
+	}
+}
+
+func newDHTPeer(addr netip.AddrPort) DHTPeer {
+	return DHTPeer{
+		Host: addr.Addr().Unmap().String(),
+		Port: strconv.Itoa(int(addr.Port())),
+	}
+}
+
 func (p *DHTPeer) GetAddress() string {
-	return p.Host + ":" + p.Port
+	return net.JoinHostPort(p.Host, p.Port)
+}
+
+// AddrPort is the peer's address if it's an IP and port
+func (p *DHTPeer) AddrPort() (netip.AddrPort, error) {
+	return netip.ParseAddrPort(p.GetAddress())
+}
+
+// Compact is the 26 byte IPv4 or 38 byte IPv6 compact node info, false if the
+// node's address isn't an IP
+func (n DHTNode) Compact() ([]byte, bool) {
+	addr, err := n.AddrPort()
+	if err != nil {
+		return nil, false
+	}
+
+	ip, _ := addr.Addr().Unmap().MarshalBinary()
+	b := append(n.DHTNodeId[:], ip...)
+	return binary.BigEndian.AppendUint16(b, addr.Port()), true
+}
+
+// IPv6 is whether the node is on the IPv6 DHT
+func (n DHTNode) IPv6() bool {
+	addr, err := n.AddrPort()
+	return err == nil && addr.Addr().Unmap().Is6()
+}
+
+// compactNodes is the compact node info of the nodes in one family
+func compactNodes(nodes []DHTNode, ipv6 bool) []byte {
+	size := 26
+	if ipv6 {
+		size = 38
+	}
+
+	b := make([]byte, 0, size*len(nodes))
+	for _, n := range nodes {
+		if c, ok := n.Compact(); ok && len(c) == size {
+			b = append(b, c...)
+		}
+	}
+	return b
 }
@@ -1,7 +1,10 @@
 package dht
 
 import (
+	"net/netip"
 	"testing"
+	"time"
+	"tor/pkg/bencode"
 )
 
 func TestPingQuerySerialization(t *testing.T) {
@@ -74,3 +77,68 @@ func TestParsePeerInfo(t *testing.T) {
 		t.Errorf("Expected port: 21809 but got: %s", peerInfo.Port)
 	}
 }
+
+func TestParseGetPeersResponse(t *testing.T) {
+	res, err := bencode.Decode([]byte("d1:rd2:id20:abcdefghij01234567895:nodes26:mnopqrstuvwxyz123456ABCDU15:token3:tok6:valuesl6:ABCDU16:EFGHU2ee1:t2:aa1:y1:re"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := ParseGetPeersResponse(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(r.DHTNodeId[:]) != "abcdefghij0123456789" || string(r.Token) != "tok" {
+		t.Errorf("Unexpected id or token: %+v", r)
+	}
+
+	if len(r.Peers) != 2 || r.Peers[1].String() != "69.70.71.72:21810" {
+		t.Errorf("Unexpected peers: %v", r.Peers)
+	}
+
+	if len(r.Nodes) != 1 || r.Nodes[0].Host != "65.66.67.68" {
+		t.Errorf("Unexpected nodes: %v", r.Nodes)
+	}
+}
+
+func TestParseSampleInfoHashesResponse(t *testing.T) {
+	res, err := bencode.Decode([]byte("d1:rd2:id20:abcdefghij01234567898:intervali60e5:nodes26:mnopqrstuvwxyz123456ABCDU13:numi3e7:samples40:0123456789abcdefghijklmnopqrstuvwxyz0123e1:t2:aa1:y1:re"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := ParseSampleInfoHashesResponse(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Interval != time.Minute || r.Num != 3 {
+		t.Errorf("Unexpected interval or num: %+v", r)
+	}
+
+	if len(r.Samples) != 2 || string(r.Samples[1][:]) != "klmnopqrstuvwxyz0123" {
+		t.Errorf("Unexpected samples: %x", r.Samples)
+	}
+
+	if len(r.Nodes) != 1 || r.Nodes[0].Host != "65.66.67.68" {
+		t.Errorf("Unexpected nodes: %v", r.Nodes)
+	}
+}
+
+func TestCompactNodes6(t *testing.T) {
+	nodes := []DHTNode{
+		{DHTNodeId{1}, newDHTPeer(netip.MustParseAddrPort("[2001:db8::1]:6881"))},
+		{DHTNodeId{2}, newDHTPeer(netip.MustParseAddrPort("1.2.3.4:6881"))},
+	}
+
+	b := compactNodes(nodes, true)
+	if len(b) != 38 {
+		t.Fatalf("Expected only the IPv6 node but got %v bytes", len(b))
+	}
+
+	parsed := parseNodes(map[string]interface{}{"nodes": compactNodes(nodes, false), "nodes6": b})
+	if len(parsed) != 2 || parsed[0] != nodes[1] || parsed[1] != nodes[0] {
+		t.Errorf("Unexpected nodes: %v", parsed)
+	}
+}
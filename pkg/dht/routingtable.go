@@ -1,23 +1,81 @@
 package dht
 
 import (
-	"bytes"
-	"tor/pkg/torrent"
-
-	"github.com/tmthrgd/go-bitwise"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
 )
 
+// K, the most nodes in a bucket and the number of nodes lookups converge on
 const MaxBucketSize = 8
 
+const maxBuckets = 160
+
+// A node that hasn't been heard from in GoodNodeTimeout is questionable, one
+// that fails to respond MaxNodeFailures times in a row is bad
+var GoodNodeTimeout = 15 * time.Minute
+var MaxNodeFailures = 2
+
+// Buckets that haven't changed in BucketRefreshInterval are refreshed with a
+// lookup of a random ID in them
+var BucketRefreshInterval = 15 * time.Minute
+
+type NodeState int
+
+const (
+	NodeGood NodeState = iota
+	NodeQuestionable
+	NodeBad
+)
+
+func (s NodeState) String() string {
+	switch s {
+	case NodeGood:
+		return "good"
+	case NodeQuestionable:
+		return "questionable"
+	default:
+		return "bad"
+	}
+}
+
+type RoutingNode struct {
+	DHTNode
+	LastSeen time.Time
+	// Whether it has ever answered one of our queries
+	responded bool
+	failures  int
+	// Whether its ID is valid for its IP (BEP 42)
+	secure bool
+}
+
+func (n *RoutingNode) State(now time.Time) NodeState {
+	if n.failures >= MaxNodeFailures {
+		return NodeBad
+	}
+	if n.responded && now.Sub(n.LastSeen) < GoodNodeTimeout {
+		return NodeGood
+	}
+	return NodeQuestionable
+}
+
+// RoutingTable is a Kademlia routing table, bucket i holds the nodes whose
+// distance from us starts with i zero bits. Only the last bucket, the one our
+// own ID falls in, is split when it fills up
 type RoutingTable struct {
-	Node        DHTNodeId
-	buckets     map[[20]byte]RoutingBucket
-	mask        [20]byte
-	maskCounter int
+	Node DHTNodeId
+
+	mx      sync.Mutex
+	buckets []*RoutingBucket
 }
 
 type RoutingBucket struct {
-	Nodes map[DHTNodeId]DHTNode
+	// Least recently seen first
+	Nodes []*RoutingNode
+	// Nodes to use when one in the bucket goes bad, most recently seen last
+	replacements []*RoutingNode
+	lastChanged  time.Time
 }
 
 type DHTNodeDistance struct {
@@ -28,28 +86,20 @@ type DHTNodeDistance struct {
 type DHTNodeDistances []DHTNodeDistance
 
 func NewRoutingTable(homeNode DHTNodeId) *RoutingTable {
-
 	return &RoutingTable{
-		// Buckets: []RoutingBucket{{
-		// 	Nodes: make(map[DHTNodeId]DHTNode),
-		// }},
 		Node:    homeNode,
-		buckets: map[[20]byte]RoutingBucket{{}: NewRoutingBucket()},
+		buckets: []*RoutingBucket{NewRoutingBucket()},
 	}
 }
 
-func NewRoutingBucket() RoutingBucket {
-	return RoutingBucket{
-		Nodes: make(map[DHTNodeId]DHTNode),
-	}
+func NewRoutingBucket() *RoutingBucket {
+	return &RoutingBucket{lastChanged: time.Now()}
 }
 
 func (n1 *DHTNodeId) Distance(n2 *DHTNode) DHTNodeDistance {
-	a := [20]byte(*n1)
-	b := [20]byte(n2.DHTNodeId)
 	d := [20]byte{}
-	for i := 1; i < 20; i++ {
-		d[i] = a[i] ^ b[i]
+	for i := 0; i < 20; i++ {
+		d[i] = n1[i] ^ n2.DHTNodeId[i]
 	}
 	return DHTNodeDistance{
 		DHTNode:  *n2,
@@ -58,69 +108,328 @@ func (n1 *DHTNodeId) Distance(n2 *DHTNode) DHTNodeDistance {
 }
 
 func (n1 *DHTNodeDistance) Less(n2 *DHTNodeDistance) bool {
-	for i := 1; i < 20; i++ {
-		if n1.Distance[i] == n1.Distance[i] {
+	for i := 0; i < 20; i++ {
+		if n1.Distance[i] == n2.Distance[i] {
 			continue
 		}
-		return n1.Distance[i] < n1.Distance[i]
+		return n1.Distance[i] < n2.Distance[i]
 	}
 	return false
 }
 
-// TODO Reimplement to take into account all nodes
-func (b *RoutingBucket) FindClosestNode(n DHTNodeId) DHTNode {
-	var shortest *DHTNodeDistance
-	for _, n := range b.Nodes {
-		dist := n.Distance(&n)
-		if dist.Less(shortest) || shortest == nil {
-			shortest = &dist
+func (d DHTNodeDistances) Len() int           { return len(d) }
+func (d DHTNodeDistances) Less(i, j int) bool { return d[i].Less(&d[j]) }
+func (d DHTNodeDistances) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// prefixLen is the number of leading bits two IDs share
+func prefixLen(a, b DHTNodeId) int {
+	for i := 0; i < 20; i++ {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
 		}
 	}
+	return 160
+}
 
-	return shortest.DHTNode
+func (b *RoutingBucket) find(id DHTNodeId) int {
+	for i, n := range b.Nodes {
+		if n.DHTNodeId == id {
+			return i
+		}
+	}
+	return -1
 }
 
-func (b *RoutingBucket) AddNode(n DHTNode) {
-	if len(b.Nodes) < 8 {
-		b.Nodes[n.DHTNodeId] = n
+// AddNode adds a node if the bucket has room for it
+func (b *RoutingBucket) AddNode(n DHTNode) bool {
+	if b.find(n.DHTNodeId) >= 0 || len(b.Nodes) >= MaxBucketSize {
+		return false
 	}
+	b.Nodes = append(b.Nodes, &RoutingNode{DHTNode: n})
+	return true
+}
 
+func (b *RoutingBucket) remove(i int) *RoutingNode {
+	n := b.Nodes[i]
+	b.Nodes = append(b.Nodes[:i], b.Nodes[i+1:]...)
+	return n
 }
 
+func (b *RoutingBucket) addReplacement(n *RoutingNode) {
+	for i, r := range b.replacements {
+		if r.DHTNodeId == n.DHTNodeId {
+			b.replacements = append(b.replacements[:i], b.replacements[i+1:]...)
+			break
+		}
+	}
+	b.replacements = append(b.replacements, n)
+	if len(b.replacements) > MaxBucketSize {
+		b.replacements = b.replacements[1:]
+	}
+}
+
+// replaceBad swaps the bad nodes for the most recently seen replacements
+func (b *RoutingBucket) replaceBad(now time.Time) {
+	for i := 0; i < len(b.Nodes) && len(b.replacements) > 0; {
+		if b.Nodes[i].State(now) != NodeBad {
+			i++
+			continue
+		}
+		b.remove(i)
+		last := len(b.replacements) - 1
+		b.Nodes = append(b.Nodes, b.replacements[last])
+		b.replacements = b.replacements[:last]
+	}
+}
+
+func (t *RoutingTable) bucketIndex(id DHTNodeId) int {
+	i := prefixLen(t.Node, id)
+	if i >= len(t.buckets) {
+		i = len(t.buckets) - 1
+	}
+	return i
+}
+
+// PutNode adds or refreshes a node that answered one of our queries
 func (t *RoutingTable) PutNode(n DHTNode) {
-	var bucket RoutingBucket
-	var lastBucket = false
-	if len(t.buckets) == 0 {
-		bucket = t.buckets[t.mask]
-		lastBucket = true
-	} else {
-		var dst [20]byte
-		bitwise.XNOR(dst[:], n.DHTNodeId[:], t.Node[:])
-		bitwise.And(dst[:], dst[:], t.mask[:])
-		bucket = t.buckets[dst]
-		lastBucket = bytes.Equal(dst[:], t.mask[:])
-	}
-
-	if _, exists := bucket.Nodes[n.DHTNodeId]; exists {
-		// TODO update time
-	} else if len(bucket.Nodes) == 8 && lastBucket {
-		// Split bucket
-		t.SplitBucket()
-		t.PutNode(n)
-	} else {
-		bucket.Nodes[n.DHTNodeId] = n
-	}
-}
-
-func (b *RoutingTable) SplitBucket() {
-	newBucket := NewRoutingBucket()
-	newOldBucket := NewRoutingBucket()
-	oldBucket := b.buckets[b.mask]
-	b.buckets[b.mask] = newOldBucket
-	torrent.Bitfield(b.mask[:]).SetBitFieldPiece(b.maskCounter)
-	b.buckets[b.mask] = newBucket
-
-	for _, v := range oldBucket.Nodes {
-		b.PutNode(v)
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.putNode(n, true, time.Now())
+}
+
+// QueriedBy adds or refreshes a node that sent us a query, it stays
+// questionable until it answers one of ours
+func (t *RoutingTable) QueriedBy(n DHTNode) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.putNode(n, false, time.Now())
+}
+
+func (t *RoutingTable) putNode(n DHTNode, responded bool, now time.Time) {
+	if n.DHTNodeId == t.Node {
+		return
+	}
+
+	b := t.buckets[t.bucketIndex(n.DHTNodeId)]
+	b.lastChanged = now
+	if i := b.find(n.DHTNodeId); i >= 0 {
+		// Move to the back as the most recently seen
+		node := b.remove(i)
+		node.DHTPeer = n.DHTPeer
+		node.LastSeen = now
+		node.responded = node.responded || responded
+		node.failures = 0
+		node.secure = secureNode(n)
+		b.Nodes = append(b.Nodes, node)
+		return
+	}
+
+	t.insert(&RoutingNode{DHTNode: n, LastSeen: now, responded: responded, secure: secureNode(n)}, now)
+}
+
+// insert adds a node that isn't in the table, splitting the last bucket if
+// it needs to
+func (t *RoutingTable) insert(node *RoutingNode, now time.Time) {
+	if !node.secure && EnforceSecureNodeIDs {
+		return
+	}
+
+	for {
+		b := t.buckets[t.bucketIndex(node.DHTNodeId)]
+		if len(b.Nodes) < MaxBucketSize {
+			b.Nodes = append(b.Nodes, node)
+			return
+		}
+
+		if i := b.evictable(node, now); i >= 0 {
+			if old := b.remove(i); old.State(now) != NodeBad {
+				b.addReplacement(old)
+			}
+			b.Nodes = append(b.Nodes, node)
+			return
+		}
+
+		if b != t.buckets[len(t.buckets)-1] || len(t.buckets) == maxBuckets {
+			b.addReplacement(node)
+			return
+		}
+		t.split()
+	}
+}
+
+// evictable gives a node in a full bucket that can make way for node, bad
+// nodes first then ones with insecure IDs if node's is secure
+func (b *RoutingBucket) evictable(node *RoutingNode, now time.Time) int {
+	for i, old := range b.Nodes {
+		if old.State(now) == NodeBad {
+			return i
+		}
+	}
+
+	if node.secure {
+		for i, old := range b.Nodes {
+			if !old.secure {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// split divides the last bucket between itself and a new bucket for the
+// nodes sharing one more bit with us
+func (t *RoutingTable) split() {
+	last := t.buckets[len(t.buckets)-1]
+	t.buckets[len(t.buckets)-1] = NewRoutingBucket()
+	t.buckets = append(t.buckets, NewRoutingBucket())
+
+	for _, n := range last.Nodes {
+		b := t.buckets[t.bucketIndex(n.DHTNodeId)]
+		b.Nodes = append(b.Nodes, n)
+	}
+	for _, n := range last.replacements {
+		b := t.buckets[t.bucketIndex(n.DHTNodeId)]
+		b.replacements = append(b.replacements, n)
+	}
+}
+
+// SetNode changes our ID, the nodes are put in the buckets for the new one
+func (t *RoutingTable) SetNode(id DHTNodeId) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	var nodes []*RoutingNode
+	for _, b := range t.buckets {
+		nodes = append(nodes, b.Nodes...)
+	}
+	for _, b := range t.buckets {
+		nodes = append(nodes, b.replacements...)
+	}
+
+	t.Node = id
+	t.buckets = []*RoutingBucket{NewRoutingBucket()}
+	now := time.Now()
+	for _, n := range nodes {
+		if n.DHTNodeId != id {
+			t.insert(n, now)
+		}
+	}
+}
+
+// NodeFailed records a query the node didn't answer, once it's bad it's
+// swapped for a replacement if the bucket has one
+func (t *RoutingTable) NodeFailed(id DHTNodeId) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	b := t.buckets[t.bucketIndex(id)]
+	if i := b.find(id); i >= 0 {
+		b.Nodes[i].failures++
+		b.replaceBad(time.Now())
+	}
+}
+
+// Questionable gives the nodes that should be pinged to see if they're still
+// around
+func (t *RoutingTable) Questionable() []DHTNode {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	now := time.Now()
+	var nodes []DHTNode
+	for _, b := range t.buckets {
+		for _, n := range b.Nodes {
+			if n.State(now) == NodeQuestionable {
+				nodes = append(nodes, n.DHTNode)
+			}
+		}
+	}
+	return nodes
+}
+
+// Closest gives up to k of the nodes closest to target, bad nodes are left
+// out
+func (t *RoutingTable) Closest(target DHTNodeId, k int) []DHTNode {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	now := time.Now()
+	var distances DHTNodeDistances
+	for _, b := range t.buckets {
+		for _, n := range b.Nodes {
+			if n.State(now) != NodeBad {
+				distances = append(distances, target.Distance(&n.DHTNode))
+			}
+		}
+	}
+	sort.Sort(distances)
+
+	if len(distances) > k {
+		distances = distances[:k]
+	}
+	nodes := make([]DHTNode, len(distances))
+	for i, d := range distances {
+		nodes[i] = d.DHTNode
+	}
+	return nodes
+}
+
+// GoodNodes gives all the good nodes, closest buckets first
+func (t *RoutingTable) GoodNodes() []DHTNode {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	now := time.Now()
+	var nodes []DHTNode
+	for i := len(t.buckets) - 1; i >= 0; i-- {
+		for _, n := range t.buckets[i].Nodes {
+			if n.State(now) == NodeGood {
+				nodes = append(nodes, n.DHTNode)
+			}
+		}
+	}
+	return nodes
+}
+
+// refreshTargets gives a random ID in each bucket that needs refreshing
+func (t *RoutingTable) refreshTargets(now time.Time) []DHTNodeId {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	var targets []DHTNodeId
+	for i, b := range t.buckets {
+		if now.Sub(b.lastChanged) >= BucketRefreshInterval {
+			targets = append(targets, t.randomIdInBucket(i))
+		}
+	}
+	return targets
+}
+
+// randomIdInBucket gives an ID sharing the first i bits with ours, and
+// differing in the next unless it's the last bucket
+func (t *RoutingTable) randomIdInBucket(i int) DHTNodeId {
+	id := DHTNodeId(GetRandNodeID())
+	for bit := 0; bit <= i && bit < 160; bit++ {
+		mask := byte(0x80) >> (bit % 8)
+		ours := t.Node[bit/8] & mask
+		if bit == i {
+			if i == len(t.buckets)-1 {
+				break
+			}
+			ours ^= mask
+		}
+		id[bit/8] = id[bit/8]&^mask | ours
+	}
+	return id
+}
+
+func (t *RoutingTable) Len() int {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	n := 0
+	for _, b := range t.buckets {
+		n += len(b.Nodes)
 	}
+	return n
 }
@@ -1,6 +1,9 @@
 package dht
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestBucketAdd(t *testing.T) {
 	bucket := NewRoutingBucket()
@@ -20,7 +23,7 @@ func TestTableAddBasic(t *testing.T) {
 	if len(table.buckets) != 1 {
 		t.Errorf("Only expected one node in bucket but found: %v", len(table.buckets))
 	}
-	bucket := table.buckets[[20]byte{}]
+	bucket := table.buckets[0]
 	if len(bucket.Nodes) != 7 {
 		t.Errorf("Only expected one node in bucket but found: %v", len(table.buckets))
 	}
@@ -42,12 +45,99 @@ func TestTableSplitting(t *testing.T) {
 	if len(table.buckets) != 2 {
 		t.Errorf("Only expected one node in bucket but found: %v", len(table.buckets))
 	}
-	// bucket := table.buckets[[20]byte{}]
+	// bucket := table.buckets[0]
 	// if len(bucket.Nodes) != 7 {
 	// 	t.Errorf("Only expected one node in bucket but found: %v", len(table.buckets))
 	// }
 }
 
+func TestTableOnlySplitsAroundOwnId(t *testing.T) {
+	table := NewRoutingTable([20]byte{})
+	// Far from us so once the first split is done they only fill bucket 0
+	for i := 0; i < 20; i++ {
+		table.PutNode(DHTNode{DHTNodeId: [20]byte{128 + uint8(i)}})
+	}
+
+	if len(table.buckets) != 2 || table.Len() != MaxBucketSize {
+		t.Errorf("Expected two buckets with %v nodes but got %v buckets with %v nodes", MaxBucketSize, len(table.buckets), table.Len())
+	}
+	if len(table.buckets[0].replacements) != MaxBucketSize {
+		t.Errorf("Expected the extra nodes to be kept as replacements but got %v", len(table.buckets[0].replacements))
+	}
+
+	// Close to us so the last bucket splits until 8 and 9 (sharing 28 bits
+	// with us) are separated from the closer ones
+	for i := 0; i < 9; i++ {
+		table.PutNode(DHTNode{DHTNodeId: [20]byte{0, 0, 0, 1 + uint8(i)}})
+	}
+	if len(table.buckets) != 30 {
+		t.Errorf("Expected 30 buckets but got: %v", len(table.buckets))
+	}
+	if table.Len() != MaxBucketSize+9 {
+		t.Errorf("Expected %v nodes but got: %v", MaxBucketSize+9, table.Len())
+	}
+}
+
+func TestTableClosest(t *testing.T) {
+	table := NewRoutingTable(GetRandNodeID())
+	for i := 0; i < 100; i++ {
+		table.PutNode(genNode())
+	}
+
+	target := DHTNodeId(GetRandNodeID())
+	closest := table.Closest(target, MaxBucketSize)
+	if len(closest) != MaxBucketSize {
+		t.Fatalf("Expected %v nodes but got: %v", MaxBucketSize, len(closest))
+	}
+
+	for i := 1; i < len(closest); i++ {
+		a, b := target.Distance(&closest[i-1]), target.Distance(&closest[i])
+		if b.Less(&a) {
+			t.Errorf("Nodes aren't sorted by distance")
+		}
+	}
+
+	// Byte 0 counts
+	a := DHTNodeId{1}
+	d := a.Distance(&DHTNode{DHTNodeId: [20]byte{3}})
+	if d.Distance != [20]byte{2} {
+		t.Errorf("Unexpected distance: %x", d.Distance)
+	}
+}
+
+func TestNodeStates(t *testing.T) {
+	table := NewRoutingTable([20]byte{})
+	now := time.Now()
+	for i := 0; i < MaxBucketSize; i++ {
+		table.putNode(DHTNode{DHTNodeId: [20]byte{128 + uint8(i)}}, true, now)
+	}
+	queried := DHTNode{DHTNodeId: [20]byte{200}}
+	table.putNode(queried, false, now)
+
+	n := table.buckets[0].Nodes[0]
+	if n.State(now) != NodeGood {
+		t.Errorf("Expected a node that responded to be good but it's %s", n.State(now))
+	}
+	if n.State(now.Add(GoodNodeTimeout)) != NodeQuestionable {
+		t.Errorf("Expected an old node to be questionable")
+	}
+	if len(table.Questionable()) != 0 {
+		t.Errorf("Only nodes that answered us should be in the bucket")
+	}
+
+	for i := 0; i < MaxNodeFailures; i++ {
+		table.NodeFailed(n.DHTNodeId)
+	}
+
+	b := table.buckets[0]
+	if b.find(n.DHTNodeId) >= 0 || b.find(queried.DHTNodeId) < 0 {
+		t.Errorf("Expected the bad node to be swapped for the replacement")
+	}
+	if len(table.Questionable()) != 1 {
+		t.Errorf("Expected the replacement to be questionable")
+	}
+}
+
 func genNode() DHTNode {
 	return DHTNode{
 		DHTNodeId: GetRandNodeID(),
@@ -0,0 +1,196 @@
+package dht
+
+import (
+	"container/heap"
+	"math/rand"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How long the same sample of info hashes is given to sample_infohashes
+// queries, so crawlers can't get all of them by asking again (BEP 51)
+var SampleInterval = 6 * time.Hour
+
+// Most info hashes in a sample, so it fits in a packet with the nodes
+const maxSamples = 20
+
+// How often the crawler sends a query, nodes are asked again after the
+// interval they give but no sooner than CrawlRevisitInterval
+var CrawlQueryInterval = 10 * time.Millisecond
+var CrawlRevisitInterval = 10 * time.Minute
+
+// Most nodes the crawler keeps to query
+const maxCrawlNodes = 100000
+
+// handleSampleInfoHashes answers a sample_infohashes query with a sample of
+// the torrents announced to us
+func (n *DHTNodeClient) handleSampleInfoHashes(a map[string]interface{}, res map[string]interface{}) interface{} {
+	target, _ := a["target"].([]byte)
+	if len(target) != 20 {
+		return KRPCError{errProtocol, "Missing target"}
+	}
+
+	now := time.Now()
+	samples, num, next := n.peers.sample(now)
+	b := make([]byte, 0, 20*len(samples))
+	for _, s := range samples {
+		b = append(b, s[:]...)
+	}
+
+	res["interval"] = int(next.Sub(now) / time.Second)
+	res["num"] = num
+	res["samples"] = b
+	n.addNodes(res, a, DHTNodeId(target))
+	return res
+}
+
+// sample gives the current sample of info hashes, how many there are and when
+// the next sample will be taken
+func (s *peerStore) sample(now time.Time) ([][20]byte, int, time.Time) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for infoHash, peers := range s.torrents {
+		for p, announced := range peers {
+			if now.Sub(announced) > PeerTimeout {
+				delete(peers, p)
+			}
+		}
+		if len(peers) == 0 {
+			s.remove(infoHash)
+		}
+	}
+
+	if s.sampled.IsZero() || now.Sub(s.sampled) >= SampleInterval {
+		samples := make([][20]byte, 0, len(s.torrents))
+		for infoHash := range s.torrents {
+			samples = append(samples, infoHash)
+		}
+		rand.Shuffle(len(samples), func(i, j int) {
+			samples[i], samples[j] = samples[j], samples[i]
+		})
+		if len(samples) > maxSamples {
+			samples = samples[:maxSamples]
+		}
+		s.samples = samples
+		s.sampled = now
+	}
+	return s.samples, len(s.torrents), s.sampled.Add(SampleInterval)
+}
+
+// SampleInfoHashes asks a node for a sample of the info hashes it has and the
+// nodes it knows closest to target
+func (n *DHTNodeClient) SampleInfoHashes(address string, target DHTNodeId) (SampleInfoHashesResponse, error) {
+	res, err := n.SendQuery(SampleInfoHashesQuery{n.ID(), target}, address)
+	if err != nil {
+		return SampleInfoHashesResponse{}, err
+	}
+	return ParseSampleInfoHashesResponse(res)
+}
+
+// Crawl walks the DHT asking nodes for samples of their info hashes, each one
+// found is given once. The nodes in the responses are crawled too, with
+// random targets to spread over the keyspace. The channel is closed once stop
+// is
+func (n *DHTNodeClient) Crawl(stop <-chan struct{}) <-chan [20]byte {
+	infoHashes := make(chan [20]byte)
+	go func() {
+		defer close(infoHashes)
+		ticker := time.NewTicker(CrawlQueryInterval)
+		defer ticker.Stop()
+
+		type result struct {
+			node DHTNode
+			res  SampleInfoHashesResponse
+			err  error
+		}
+		results := make(chan result)
+
+		q := crawlQueue{}
+		known := make(map[DHTNodeId]bool)
+		add := func(node DHTNode, next time.Time) {
+			if len(q) < maxCrawlNodes && node.DHTNodeId != n.ID() {
+				heap.Push(&q, &crawlNode{node, next})
+			}
+		}
+		for _, node := range n.GoodNodes() {
+			known[node.DHTNodeId] = true
+			add(node, time.Now())
+		}
+
+		found := make(map[[20]byte]bool)
+		for {
+			select {
+			case <-stop:
+				return
+
+			case <-ticker.C:
+				if len(q) == 0 || q[0].next.After(time.Now()) {
+					continue
+				}
+				node := heap.Pop(&q).(*crawlNode).DHTNode
+				go func() {
+					res, err := n.SampleInfoHashes(node.GetAddress(), GetRandNodeID())
+					select {
+					case results <- result{node, res, err}:
+					case <-stop:
+					}
+				}()
+
+			case r := <-results:
+				if r.err != nil {
+					// Nodes that don't support BEP 51 or didn't answer aren't asked again
+					log.Debugf("Couldn't sample DHT node %s: %s", r.node.GetAddress(), r.err)
+					continue
+				}
+
+				now := time.Now()
+				revisit := r.res.Interval
+				if revisit < CrawlRevisitInterval {
+					revisit = CrawlRevisitInterval
+				}
+				add(r.node, now.Add(revisit))
+				for _, node := range r.res.Nodes {
+					if !known[node.DHTNodeId] {
+						known[node.DHTNodeId] = true
+						add(node, now)
+					}
+				}
+
+				for _, infoHash := range r.res.Samples {
+					if found[infoHash] {
+						continue
+					}
+					found[infoHash] = true
+					select {
+					case infoHashes <- infoHash:
+					case <-stop:
+						return
+					}
+				}
+			}
+		}
+	}()
+	return infoHashes
+}
+
+type crawlNode struct {
+	DHTNode
+	next time.Time
+}
+
+// crawlQueue is a heap of the nodes to crawl, the one due first at the top
+type crawlQueue []*crawlNode
+
+func (q crawlQueue) Len() int            { return len(q) }
+func (q crawlQueue) Less(i, j int) bool  { return q[i].next.Before(q[j].next) }
+func (q crawlQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *crawlQueue) Push(x interface{}) { *q = append(*q, x.(*crawlNode)) }
+
+func (q *crawlQueue) Pop() interface{} {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
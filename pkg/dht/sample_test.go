@@ -0,0 +1,76 @@
+package dht
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+	"tor/pkg/torrent"
+)
+
+func TestSampleInfoHashes(t *testing.T) {
+	server := listenLocal(t)
+	client := listenLocal(t)
+
+	peer := torrent.NewTorrentPeer(netip.MustParseAddr("10.0.0.1"), 6881)
+	for i := 0; i < 30; i++ {
+		server.peers.add([20]byte{byte(i)}, peer, time.Now())
+	}
+
+	res, err := client.SampleInfoHashes(server.Addr().String(), client.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Num != 30 || len(res.Samples) != maxSamples {
+		t.Errorf("Expected %v of 30 info hashes but got %v of %v", maxSamples, len(res.Samples), res.Num)
+	}
+	if res.Interval <= SampleInterval-time.Minute || res.Interval > SampleInterval {
+		t.Errorf("Unexpected interval: %s", res.Interval)
+	}
+
+	again, err := client.SampleInfoHashes(server.Addr().String(), client.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range res.Samples {
+		if res.Samples[i] != again.Samples[i] {
+			t.Errorf("Expected the same sample until the interval passes")
+			break
+		}
+	}
+}
+
+func TestCrawl(t *testing.T) {
+	oldInterval := CrawlQueryInterval
+	CrawlQueryInterval = time.Millisecond
+	defer func() { CrawlQueryInterval = oldInterval }()
+
+	nodes := localNetwork(t, 4)
+	peer := torrent.NewTorrentPeer(netip.MustParseAddr("10.0.0.1"), 6881)
+	expected := make(map[[20]byte]bool)
+	for i, n := range nodes[1:] {
+		for j := 0; j < 3; j++ {
+			infoHash := [20]byte{byte(i), byte(j)}
+			n.peers.add(infoHash, peer, time.Now())
+			expected[infoHash] = true
+		}
+	}
+
+	stop := make(chan struct{})
+	infoHashes := nodes[0].Crawl(stop)
+	timeout := time.After(5 * time.Second)
+	for len(expected) > 0 {
+		select {
+		case infoHash := <-infoHashes:
+			if !expected[infoHash] {
+				t.Fatalf("Unexpected info hash %x", infoHash)
+			}
+			delete(expected, infoHash)
+		case <-timeout:
+			t.Fatalf("Didn't find %v info hashes", len(expected))
+		}
+	}
+
+	close(stop)
+	for range infoHashes {
+	}
+}
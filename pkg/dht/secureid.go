@@ -0,0 +1,100 @@
+package dht
+
+import (
+	"hash/crc32"
+	"net/netip"
+	"tor/pkg/torrent"
+	"tor/pkg/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Nodes with IDs that don't match their IP (BEP 42) only get into the routing
+// table when there's no room for compliant ones, with EnforceSecureNodeIDs
+// they're left out altogether
+var EnforceSecureNodeIDs = false
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var ipv4Mask = []byte{0x03, 0x0f, 0x3f, 0xff}
+var ipv6Mask = []byte{0x01, 0x03, 0x07, 0x0f, 0x1f, 0x3f, 0x7f, 0xff}
+
+// secureIdPrefix is the CRC32-C of the masked IP with r in the top bits, the
+// first 21 bits of a secure ID come from it
+func secureIdPrefix(ip netip.Addr, r byte) uint32 {
+	ip = ip.Unmap()
+	mask := ipv4Mask
+	var b []byte
+	if ip.Is4() {
+		a := ip.As4()
+		b = a[:]
+	} else {
+		a := ip.As16()
+		b = a[:8]
+		mask = ipv6Mask
+	}
+
+	masked := make([]byte, len(mask))
+	for i := range mask {
+		masked[i] = b[i] & mask[i]
+	}
+	masked[0] |= r << 5
+	return crc32.Checksum(masked, castagnoli)
+}
+
+// SecureNodeID makes a random node ID that's valid for ip
+func SecureNodeID(ip netip.Addr) [20]byte {
+	id := GetRandNodeID()
+	crc := secureIdPrefix(ip, id[19]&7)
+	id[0] = byte(crc >> 24)
+	id[1] = byte(crc >> 16)
+	id[2] = byte(crc>>8)&0xf8 | id[2]&7
+	return id
+}
+
+// ValidNodeID checks id was made for ip, local addresses can use any ID
+func ValidNodeID(id DHTNodeId, ip netip.Addr) bool {
+	if !util.IsGlobalAddr(ip.Unmap()) {
+		return true
+	}
+
+	crc := secureIdPrefix(ip, id[19]&7)
+	return id[0] == byte(crc>>24) && id[1] == byte(crc>>16) && id[2]&0xf8 == byte(crc>>8)&0xf8
+}
+
+// secureNode is true if the node's ID is valid for its address, nodes we
+// only know by host name get the benefit of the doubt
+func secureNode(n DHTNode) bool {
+	addr, err := n.AddrPort()
+	return err != nil || ValidNodeID(n.DHTNodeId, addr.Addr())
+}
+
+// voteExternalIP counts the address a node says it saw us at
+func (n *DHTNodeClient) voteExternalIP(msg map[string]interface{}, from netip.AddrPort) {
+	b, _ := msg["ip"].([]byte)
+	if len(b) != 6 && len(b) != 18 {
+		return
+	}
+
+	peers := torrent.ParseCompactPeers(b, len(b) == 18)
+	if len(peers) == 1 {
+		n.externalIP.Vote(from.String(), peers[0].Addr())
+	}
+}
+
+// useSecureId switches to a BEP 42 ID once we know our external IP, the
+// routing table is rearranged around the new ID
+func (n *DHTNodeClient) useSecureId() bool {
+	ip, ok := n.externalIP.GetFamily(n.ipv6)
+	if !ok || ValidNodeID(n.ID(), ip) {
+		return false
+	}
+
+	id := SecureNodeID(ip)
+	log.Infof("Changing DHT node ID to %x for external IP %s", id, ip)
+	n.mx.Lock()
+	n.NodeID = id
+	n.mx.Unlock()
+	n.RoutingTable.SetNode(id)
+	return true
+}
@@ -0,0 +1,110 @@
+package dht
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"testing"
+	"tor/pkg/util"
+)
+
+// Test vectors from BEP 42
+var secureIdTests = []struct {
+	ip     string
+	r      byte
+	prefix string
+}{
+	{"124.31.75.21", 1, "5fbfb"},
+	{"21.75.31.124", 86, "5a3ce"},
+	{"65.23.51.170", 22, "a5d43"},
+	{"84.124.73.14", 65, "1b032"},
+	{"43.213.53.83", 90, "e56f6"},
+}
+
+func TestSecureNodeID(t *testing.T) {
+	for _, tt := range secureIdTests {
+		ip := netip.MustParseAddr(tt.ip)
+		crc := secureIdPrefix(ip, tt.r&7)
+		if prefix := fmt.Sprintf("%06x", crc>>8)[:5]; prefix != tt.prefix {
+			t.Errorf("Expected prefix %s for %s but got %s", tt.prefix, tt.ip, prefix)
+		}
+
+		id := SecureNodeID(ip)
+		if !ValidNodeID(id, ip) {
+			t.Errorf("Generated ID %x isn't valid for %s", id, tt.ip)
+		}
+	}
+
+	id, _ := hex.DecodeString("5fbfbff10c5d6a4ec8a88e4c6ab4c28b95eefe01")
+	if !ValidNodeID(DHTNodeId(id), netip.MustParseAddr("124.31.75.21")) {
+		t.Errorf("The BEP 42 example ID should be valid")
+	}
+	if ValidNodeID(DHTNodeId(id), netip.MustParseAddr("124.31.75.22")) {
+		t.Errorf("The ID shouldn't be valid for another IP")
+	}
+	if !ValidNodeID(DHTNodeId(id), netip.MustParseAddr("192.168.1.2")) {
+		t.Errorf("Local addresses can use any ID")
+	}
+}
+
+func TestInsecureNodesAreDeprioritised(t *testing.T) {
+	table := NewRoutingTable([20]byte{})
+	// Fill the far bucket with nodes whose IDs don't match their IPs
+	for i := 0; i < MaxBucketSize+1; i++ {
+		table.PutNode(DHTNode{DHTNodeId: [20]byte{128, uint8(i)}, DHTPeer: DHTPeer{"8.8.8.8", fmt.Sprint(i + 1)}})
+	}
+	if len(table.buckets) != 2 || len(table.buckets[0].Nodes) != MaxBucketSize {
+		t.Fatalf("Expected a full far bucket")
+	}
+
+	// A secure ID in the far bucket
+	ip := netip.MustParseAddr("65.23.51.170")
+	id := SecureNodeID(ip)
+	for id[0] < 0x80 {
+		id = SecureNodeID(ip)
+	}
+	table.PutNode(DHTNode{DHTNodeId: id, DHTPeer: DHTPeer{ip.String(), "6881"}})
+
+	if table.buckets[0].find(id) < 0 {
+		t.Errorf("A secure node should replace an insecure one")
+	}
+	if len(table.buckets[0].replacements) != 2 {
+		t.Errorf("The insecure node should be kept as a replacement")
+	}
+
+	EnforceSecureNodeIDs = true
+	defer func() { EnforceSecureNodeIDs = false }()
+	table.PutNode(DHTNode{DHTNodeId: [20]byte{0, 0, 1}, DHTPeer: DHTPeer{"8.8.8.8", "7000"}})
+	if table.Len() != MaxBucketSize {
+		t.Errorf("Insecure nodes shouldn't be added when secure IDs are enforced")
+	}
+}
+
+func TestNodeUsesSecureId(t *testing.T) {
+	a, b := listenLocal(t), listenLocal(t)
+	a.externalIP = util.NewExternalIPVoter()
+
+	res, err := a.SendQuery(PingQuery{a.ID()}, b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip, _ := res["ip"].([]byte); string(ip) != string(torrentPeer(a.Addr().String()).Compact()) {
+		t.Errorf("Expected the response to say where the query came from but got: %x", ip)
+	}
+
+	a.PutNode(DHTNode{b.ID(), newDHTPeer(b.Addr())})
+	if a.useSecureId() {
+		t.Errorf("The ID shouldn't change without knowing our external IP")
+	}
+
+	ip := netip.MustParseAddr("124.31.75.21")
+	for i := 0; i < 3; i++ {
+		a.externalIP.Vote(fmt.Sprint(i), ip)
+	}
+	if !a.useSecureId() || !ValidNodeID(a.ID(), ip) {
+		t.Errorf("Expected a secure ID for our external IP")
+	}
+	if a.RoutingTable.Node != a.ID() || a.Len() != 1 {
+		t.Errorf("The routing table should be rearranged for the new ID")
+	}
+}
@@ -0,0 +1,227 @@
+package dht
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"net/netip"
+	"sync"
+	"time"
+	"tor/pkg/torrent"
+)
+
+// Tokens are good for the window they're made in and the next one, so
+// between 5 and 10 minutes like BEP 5 suggests
+var TokenWindow = 5 * time.Minute
+
+// How long a peer announced to us is kept
+var PeerTimeout = 30 * time.Minute
+
+// Most peers in a get_peers response, so it fits in a packet
+const maxValues = 50
+
+// Most torrents and peers per torrent kept from announces, the ones announced
+// longest ago make way for new ones
+var MaxStoredTorrents = 10000
+var MaxStoredPeers = 1000
+
+// handleQuery gives the response to a query or a KRPCError
+func (n *DHTNodeClient) handleQuery(msg map[string]interface{}, from netip.AddrPort) interface{} {
+	q, _ := msg["q"].([]byte)
+	a, _ := msg["a"].(map[string]interface{})
+
+	id, _ := a["id"].([]byte)
+	if len(id) != 20 {
+		return KRPCError{errProtocol, "Missing id"}
+	}
+	n.QueriedBy(DHTNode{DHTNodeId(id), newDHTPeer(from)})
+
+	self := n.ID()
+	res := map[string]interface{}{"id": self[:]}
+	switch string(q) {
+	case PingQueryName:
+		return res
+
+	case FindNodeQueryName:
+		target, _ := a["target"].([]byte)
+		if len(target) != 20 {
+			return KRPCError{errProtocol, "Missing target"}
+		}
+		n.addNodes(res, a, DHTNodeId(target))
+		return res
+
+	case GetPeersQueryName:
+		infoHash, _ := a["info_hash"].([]byte)
+		if len(infoHash) != 20 {
+			return KRPCError{errProtocol, "Missing info_hash"}
+		}
+
+		res["token"] = n.token(from.Addr(), time.Now())
+		if peers := n.peers.get([20]byte(infoHash), maxValues, time.Now()); len(peers) > 0 {
+			values := make([]interface{}, len(peers))
+			for i, p := range peers {
+				values[i] = p.Compact()
+			}
+			res["values"] = values
+		}
+		n.addNodes(res, a, DHTNodeId(infoHash))
+		return res
+
+	case AnnouncePeerQueryName:
+		infoHash, _ := a["info_hash"].([]byte)
+		token, _ := a["token"].([]byte)
+		port, _ := a["port"].(int)
+		impliedPort, _ := a["implied_port"].(int)
+		if len(infoHash) != 20 {
+			return KRPCError{errProtocol, "Missing info_hash"}
+		}
+		if !n.validToken(token, from.Addr(), time.Now()) {
+			return KRPCError{errProtocol, "Bad token"}
+		}
+
+		if impliedPort != 0 {
+			port = int(from.Port())
+		}
+		if port <= 0 || port > 65535 {
+			return KRPCError{errProtocol, "Bad port"}
+		}
+
+		n.peers.add([20]byte(infoHash), torrent.NewTorrentPeer(from.Addr(), uint16(port)), time.Now())
+		return res
+
+	case GetQueryName:
+		return n.handleGet(a, from, res)
+
+	case PutQueryName:
+		return n.handlePut(a, from, res)
+
+	case SampleInfoHashesQueryName:
+		return n.handleSampleInfoHashes(a, res)
+	}
+	return KRPCError{errMethodUnknown, "Method Unknown"}
+}
+
+// addNodes gives the closest nodes to target in the families the query wants,
+// only our own if it doesn't say (BEP 32)
+func (n *DHTNodeClient) addNodes(res map[string]interface{}, a map[string]interface{}, target DHTNodeId) {
+	want4, want6 := !n.ipv6, n.ipv6
+	if want, ok := a["want"].([]interface{}); ok {
+		want4, want6 = false, false
+		for _, w := range want {
+			b, _ := w.([]byte)
+			want4 = want4 || string(b) == "n4"
+			want6 = want6 || string(b) == "n6"
+		}
+	}
+
+	for _, node := range []*DHTNodeClient{n, n.otherFamily()} {
+		if node != nil && ((node.ipv6 && want6) || (!node.ipv6 && want4)) {
+			res[nodesKey(node.ipv6)] = compactNodes(node.Closest(target, MaxBucketSize), node.ipv6)
+		}
+	}
+}
+
+func (n *DHTNodeClient) token(addr netip.Addr, now time.Time) []byte {
+	return n.tokenForWindow(addr, now.Unix()/int64(TokenWindow/time.Second))
+}
+
+func (n *DHTNodeClient) validToken(token []byte, addr netip.Addr, now time.Time) bool {
+	window := now.Unix() / int64(TokenWindow/time.Second)
+	return hmac.Equal(token, n.tokenForWindow(addr, window)) || hmac.Equal(token, n.tokenForWindow(addr, window-1))
+}
+
+func (n *DHTNodeClient) tokenForWindow(addr netip.Addr, window int64) []byte {
+	mac := hmac.New(sha1.New, n.secret[:])
+	b, _ := addr.MarshalBinary()
+	mac.Write(b)
+	binary.Write(mac, binary.BigEndian, window)
+	return mac.Sum(nil)[:8]
+}
+
+// peerStore has the peers announced to us
+type peerStore struct {
+	mx       sync.Mutex
+	torrents map[[20]byte]map[netip.AddrPort]time.Time
+	// When each torrent was last announced
+	updated map[[20]byte]time.Time
+
+	// The info hashes given to sample_infohashes queries until resampled
+	samples [][20]byte
+	sampled time.Time
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{
+		torrents: make(map[[20]byte]map[netip.AddrPort]time.Time),
+		updated:  make(map[[20]byte]time.Time),
+	}
+}
+
+func (s *peerStore) add(infoHash [20]byte, p torrent.TorrentPeer, now time.Time) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	peers := s.torrents[infoHash]
+	if peers == nil {
+		if len(s.torrents) >= MaxStoredTorrents {
+			s.remove(s.oldestTorrent())
+		}
+		peers = make(map[netip.AddrPort]time.Time)
+		s.torrents[infoHash] = peers
+	}
+
+	if _, ok := peers[p.AddrPort]; !ok && len(peers) >= MaxStoredPeers {
+		delete(peers, oldestPeer(peers))
+	}
+	peers[p.AddrPort] = now
+	s.updated[infoHash] = now
+}
+
+func (s *peerStore) remove(infoHash [20]byte) {
+	delete(s.torrents, infoHash)
+	delete(s.updated, infoHash)
+}
+
+func (s *peerStore) oldestTorrent() [20]byte {
+	var oldest [20]byte
+	var oldestTime time.Time
+	for infoHash, updated := range s.updated {
+		if oldestTime.IsZero() || updated.Before(oldestTime) {
+			oldest, oldestTime = infoHash, updated
+		}
+	}
+	return oldest
+}
+
+func oldestPeer(peers map[netip.AddrPort]time.Time) netip.AddrPort {
+	var oldest netip.AddrPort
+	var oldestTime time.Time
+	for p, announced := range peers {
+		if oldestTime.IsZero() || announced.Before(oldestTime) {
+			oldest, oldestTime = p, announced
+		}
+	}
+	return oldest
+}
+
+// get gives up to max peers for a torrent, dropping the ones that have
+// timed out
+func (s *peerStore) get(infoHash [20]byte, max int, now time.Time) []torrent.TorrentPeer {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	var peers []torrent.TorrentPeer
+	for p, announced := range s.torrents[infoHash] {
+		if now.Sub(announced) > PeerTimeout {
+			delete(s.torrents[infoHash], p)
+			continue
+		}
+		if len(peers) < max {
+			peers = append(peers, torrent.TorrentPeer{AddrPort: p})
+		}
+	}
+	if len(s.torrents[infoHash]) == 0 {
+		s.remove(infoHash)
+	}
+	return peers
+}
@@ -0,0 +1,188 @@
+package dht
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+	"tor/pkg/torrent"
+)
+
+func listenLocal(t *testing.T) *DHTNodeClient {
+	n, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { n.Close() })
+	return n
+}
+
+// wrappedConn hides that it's a *net.UDPConn
+type wrappedConn struct {
+	net.PacketConn
+}
+
+func TestNodeOnPacketConn(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := newNode(wrappedConn{conn}, false, GetRandNodeID())
+	go n.serve()
+	defer n.Close()
+
+	if n.Addr().String() != conn.LocalAddr().String() {
+		t.Errorf("Expected the node on %s but got %s", conn.LocalAddr(), n.Addr())
+	}
+
+	pr, err := listenLocal(t).Ping(n.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr.DHTNodeId != n.NodeID {
+		t.Errorf("Expected the node's ID but got %x", pr.DHTNodeId)
+	}
+}
+
+func TestNodesAnswerQueries(t *testing.T) {
+	a, b := listenLocal(t), listenLocal(t)
+	bAddr := b.Addr().String()
+
+	pr, err := a.Ping(bAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr.DHTNodeId != b.NodeID {
+		t.Errorf("Expected b's ID but got %x", pr.DHTNodeId)
+	}
+
+	if len(b.Closest(a.NodeID, 1)) != 1 {
+		t.Errorf("b should have added a to its routing table")
+	}
+
+	a.PutNode(DHTNode{b.NodeID, newDHTPeer(b.Addr())})
+	res, err := a.FindNode(a.NodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Nodes) != 1 || res.Nodes[0].DHTNodeId != b.NodeID {
+		t.Errorf("Expected the lookup to find b but got: %v", res.Nodes)
+	}
+
+	_, err = a.SendQuery(unknownQuery{PingQuery{a.NodeID}}, bAddr)
+	var krpcErr KRPCError
+	if !errors.As(err, &krpcErr) || krpcErr.Code != errMethodUnknown {
+		t.Errorf("Expected a method unknown error but got: %v", err)
+	}
+}
+
+type unknownQuery struct {
+	PingQuery
+}
+
+func (q unknownQuery) queryName() string { return "vote" }
+
+func TestAnnouncePeer(t *testing.T) {
+	a, b := listenLocal(t), listenLocal(t)
+	a.PutNode(DHTNode{b.NodeID, newDHTPeer(b.Addr())})
+
+	infoHash := [20]byte{1, 2, 3}
+	res, err := a.GetPeers(infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := res.Tokens[b.NodeID]
+	if len(token) == 0 || len(res.Peers) != 0 {
+		t.Fatalf("Expected a token and no peers but got: %+v", res)
+	}
+
+	if _, err := a.SendQuery(AnnouncePeerQuery{a.NodeID, infoHash, 6881, []byte("bad"), false}, b.Addr().String()); err == nil {
+		t.Errorf("A bad token should be rejected")
+	}
+
+	_, err = a.SendQuery(AnnouncePeerQuery{a.NodeID, infoHash, 6881, token, false}, b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.SendQuery(AnnouncePeerQuery{a.NodeID, infoHash, 0, token, true}, b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = a.GetPeers(infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := map[string]bool{}
+	for _, p := range res.Peers {
+		found[p.String()] = true
+	}
+	if len(res.Peers) != 2 || !found["127.0.0.1:6881"] || !found[a.Addr().String()] {
+		t.Errorf("Expected the announced peers but got: %v", res.Peers)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	n := &DHTNodeClient{secret: [20]byte{1}}
+	addr := netip.MustParseAddr("10.0.0.1")
+	now := time.Now()
+
+	token := n.token(addr, now)
+	if !n.validToken(token, addr, now.Add(TokenWindow)) {
+		t.Errorf("A token should be good for the next window")
+	}
+	if n.validToken(token, addr, now.Add(2*TokenWindow)) {
+		t.Errorf("A token shouldn't be good after two windows")
+	}
+	if n.validToken(token, netip.MustParseAddr("10.0.0.2"), now) {
+		t.Errorf("A token should only be good for the address it was given to")
+	}
+}
+
+func TestPeerStoreTimesOut(t *testing.T) {
+	s := newPeerStore()
+	now := time.Now()
+	s.add([20]byte{1}, torrentPeer("1.2.3.4:1"), now)
+	s.add([20]byte{1}, torrentPeer("1.2.3.4:2"), now.Add(PeerTimeout))
+
+	if peers := s.get([20]byte{1}, maxValues, now.Add(PeerTimeout+time.Second)); len(peers) != 1 || peers[0].String() != "1.2.3.4:2" {
+		t.Errorf("Expected the old peer to time out but got: %v", peers)
+	}
+}
+
+func TestPeerStoreEvictsOldest(t *testing.T) {
+	defer func(torrents, peers int) {
+		MaxStoredTorrents, MaxStoredPeers = torrents, peers
+	}(MaxStoredTorrents, MaxStoredPeers)
+	MaxStoredTorrents, MaxStoredPeers = 2, 2
+
+	s := newPeerStore()
+	now := time.Now()
+	s.add([20]byte{1}, torrentPeer("1.2.3.4:1"), now)
+	s.add([20]byte{1}, torrentPeer("1.2.3.4:2"), now.Add(time.Second))
+	s.add([20]byte{1}, torrentPeer("1.2.3.4:1"), now.Add(2*time.Second))
+	s.add([20]byte{1}, torrentPeer("1.2.3.4:3"), now.Add(3*time.Second))
+
+	peers := s.get([20]byte{1}, maxValues, now.Add(3*time.Second))
+	if len(peers) != 2 {
+		t.Fatalf("Expected the torrent's peers to be capped but got: %v", peers)
+	}
+	for _, p := range peers {
+		if p.String() == "1.2.3.4:2" {
+			t.Errorf("Expected the peer announced longest ago to be evicted but got: %v", peers)
+		}
+	}
+
+	s.add([20]byte{2}, torrentPeer("1.2.3.4:1"), now.Add(4*time.Second))
+	s.add([20]byte{1}, torrentPeer("1.2.3.4:1"), now.Add(5*time.Second))
+	s.add([20]byte{3}, torrentPeer("1.2.3.4:1"), now.Add(6*time.Second))
+	if len(s.torrents) != 2 || s.torrents[[20]byte{2}] != nil {
+		t.Errorf("Expected the torrent announced longest ago to be evicted but have: %v", s.updated)
+	}
+}
+
+func torrentPeer(addr string) torrent.TorrentPeer {
+	return torrent.TorrentPeer{AddrPort: netip.MustParseAddrPort(addr)}
+}
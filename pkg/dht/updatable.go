@@ -0,0 +1,86 @@
+package dht
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How often a followed torrent is looked up for a newer version, the item is
+// put again each time so it doesn't expire while we follow it
+var UpdateCheckInterval = 10 * time.Minute
+
+// TorrentUpdate is a version of an updatable torrent (BEP 46)
+type TorrentUpdate struct {
+	InfoHash [20]byte
+	Seq      int
+}
+
+// NewTorrentItem makes the mutable item that publishes infoHash as version seq
+// of the torrent under key's public key and salt
+func NewTorrentItem(key ed25519.PrivateKey, infoHash [20]byte, salt []byte, seq int) (Item, error) {
+	return NewMutableItem(key, map[string]interface{}{"ih": infoHash[:]}, salt, seq)
+}
+
+// ResolveTorrent looks up the current info hash of an updatable torrent
+func (n *DHTNodeClient) ResolveTorrent(k ed25519.PublicKey, salt []byte) (TorrentUpdate, error) {
+	item, err := n.GetMutable(k, salt)
+	if err != nil {
+		return TorrentUpdate{}, err
+	}
+	return parseTorrentItem(item)
+}
+
+func parseTorrentItem(item Item) (TorrentUpdate, error) {
+	v, _ := item.V.(map[string]interface{})
+	ih, _ := v["ih"].([]byte)
+	if len(ih) != 20 {
+		return TorrentUpdate{}, fmt.Errorf("Item for %x isn't a torrent", item.K)
+	}
+	return TorrentUpdate{[20]byte(ih), item.Seq}, nil
+}
+
+// FollowTorrent gives the current version of an updatable torrent and then
+// each newer one that's published. Only the latest version is kept if they
+// aren't read in time, the channel is closed once stop is
+func (n *DHTNodeClient) FollowTorrent(k ed25519.PublicKey, salt []byte, stop <-chan struct{}) <-chan TorrentUpdate {
+	updates := make(chan TorrentUpdate, 1)
+	go func() {
+		defer close(updates)
+		ticker := time.NewTicker(UpdateCheckInterval)
+		defer ticker.Stop()
+
+		var latest *Item
+		for {
+			if item, err := n.GetMutable(k, salt); err != nil {
+				log.Debugf("Couldn't look up updatable torrent %x: %s", k, err)
+			} else if latest == nil || item.Seq > latest.Seq {
+				if update, err := parseTorrentItem(item); err != nil {
+					log.Warn(err)
+				} else {
+					latest = &item
+					select {
+					case <-updates:
+					default:
+					}
+					updates <- update
+				}
+			}
+
+			if latest != nil {
+				if _, err := n.Put(*latest); err != nil {
+					log.Debugf("Couldn't put updatable torrent %x again: %s", k, err)
+				}
+			}
+
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return updates
+}
@@ -0,0 +1,57 @@
+package dht
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func TestFollowTorrent(t *testing.T) {
+	oldInterval := UpdateCheckInterval
+	UpdateCheckInterval = 10 * time.Millisecond
+	defer func() { UpdateCheckInterval = oldInterval }()
+
+	nodes := localNetwork(t, 4)
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	salt := []byte("nightly")
+
+	publish := func(infoHash [20]byte, seq int) {
+		item, err := NewTorrentItem(key, infoHash, salt, seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := nodes[0].Put(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	publish([20]byte{1}, 1)
+	update, err := nodes[1].ResolveTorrent(pub, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update.InfoHash != [20]byte{1} || update.Seq != 1 {
+		t.Errorf("Unexpected torrent: %+v", update)
+	}
+
+	stop := make(chan struct{})
+	updates := nodes[2].FollowTorrent(pub, salt, stop)
+	if update := <-updates; update.InfoHash != [20]byte{1} {
+		t.Errorf("Expected the current torrent first but got: %+v", update)
+	}
+
+	publish([20]byte{2}, 2)
+	select {
+	case update := <-updates:
+		if update.InfoHash != [20]byte{2} || update.Seq != 2 {
+			t.Errorf("Expected the new torrent but got: %+v", update)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("The new torrent wasn't found")
+	}
+
+	close(stop)
+	for range updates {
+	}
+}
@@ -0,0 +1,297 @@
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"tor/pkg/torrent"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ipv4Group = "239.192.152.143:6771"
+	ipv6Group = "[ff15::efc0:988f]:6771"
+)
+
+// How often each torrent is announced, BEP 14 asks for no more than once a
+// minute
+var AnnounceInterval = 5 * time.Minute
+
+type groupConn struct {
+	conn  *net.UDPConn
+	group *net.UDPAddr
+}
+
+// Service listens for LSD announces on the IPv4 and IPv6 groups and hands
+// the peers to the PeerFetchers for their torrents
+type Service struct {
+	// Port we accept peer connections on
+	port int
+	// Sent with our announces so we can ignore them when they loop back
+	cookie string
+	conns  []groupConn
+	// Sends an announce, replaced in tests
+	send func(infoHashes [][20]byte) error
+
+	mx       sync.Mutex
+	fetchers map[[20]byte]map[*PeerFetcher]bool
+}
+
+func newService(port int) *Service {
+	b := make([]byte, 8)
+	rand.Read(b)
+	s := &Service{
+		port:     port,
+		cookie:   hex.EncodeToString(b),
+		fetchers: make(map[[20]byte]map[*PeerFetcher]bool),
+	}
+	s.send = s.sendAnnounce
+	return s
+}
+
+// Listen joins whichever of the LSD groups it can, port is where we accept
+// peer connections
+func Listen(port int) (*Service, error) {
+	s := newService(port)
+
+	var errs []error
+	for _, g := range []struct{ network, addr string }{{"udp4", ipv4Group}, {"udp6", ipv6Group}} {
+		group, err := net.ResolveUDPAddr(g.network, g.addr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		conn, err := net.ListenMulticastUDP(g.network, nil, group)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		s.conns = append(s.conns, groupConn{conn, group})
+		go s.serve(conn)
+	}
+
+	if len(s.conns) == 0 {
+		return nil, fmt.Errorf("Couldn't join any LSD groups: %w", errors.Join(errs...))
+	}
+	return s, nil
+}
+
+func (s *Service) Close() {
+	for _, c := range s.conns {
+		c.conn.Close()
+	}
+}
+
+func (s *Service) serve(conn *net.UDPConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Warnf("LSD listener stopped: %s", err)
+			}
+			return
+		}
+		s.handle(buf[:n], from.Addr())
+	}
+}
+
+// handle gives the peer in an announce to the fetchers for its torrents
+func (s *Service) handle(b []byte, from netip.Addr) {
+	msg, err := parseAnnounce(b)
+	if err != nil {
+		log.Debugf("Bad LSD announce from %s: %s", from, err)
+		return
+	}
+
+	if msg.cookie == s.cookie {
+		return
+	}
+
+	peer := torrent.NewTorrentPeer(from, msg.port)
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for _, ih := range msg.infoHashes {
+		for f := range s.fetchers[ih] {
+			f.addPeer(peer)
+		}
+	}
+}
+
+func (s *Service) sendAnnounce(infoHashes [][20]byte) error {
+	var errs []error
+	for _, c := range s.conns {
+		_, err := c.conn.WriteToUDP(announceMessage(c.group.String(), s.port, s.cookie, infoHashes), c.group)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Service) register(f *PeerFetcher) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.fetchers[f.infoHash] == nil {
+		s.fetchers[f.infoHash] = make(map[*PeerFetcher]bool)
+	}
+	s.fetchers[f.infoHash][f] = true
+}
+
+func (s *Service) unregister(f *PeerFetcher) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	delete(s.fetchers[f.infoHash], f)
+	if len(s.fetchers[f.infoHash]) == 0 {
+		delete(s.fetchers, f.infoHash)
+	}
+}
+
+type announce struct {
+	port       uint16
+	cookie     string
+	infoHashes [][20]byte
+}
+
+func announceMessage(host string, port int, cookie string, infoHashes [][20]byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %v\r\n", host, port)
+	for _, ih := range infoHashes {
+		fmt.Fprintf(&b, "Infohash: %x\r\n", ih)
+	}
+	fmt.Fprintf(&b, "cookie: %s\r\n\r\n\r\n", cookie)
+	return b.Bytes()
+}
+
+func parseAnnounce(b []byte) (announce, error) {
+	r := bufio.NewReader(bytes.NewReader(b))
+	line, err := r.ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != "BT-SEARCH * HTTP/1.1" {
+		return announce{}, errors.New("Not a BT-SEARCH")
+	}
+
+	var msg announce
+	for {
+		line, err := r.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if ok {
+			value = strings.TrimSpace(value)
+			switch http.CanonicalHeaderKey(strings.TrimSpace(key)) {
+			case "Port":
+				port, err := strconv.ParseUint(value, 10, 16)
+				if err != nil || port == 0 {
+					return announce{}, fmt.Errorf("Bad port: %s", value)
+				}
+				msg.port = uint16(port)
+			case "Infohash":
+				h, err := hex.DecodeString(value)
+				if err != nil || len(h) != 20 {
+					return announce{}, fmt.Errorf("Bad info hash: %s", value)
+				}
+				var ih [20]byte
+				copy(ih[:], h)
+				msg.infoHashes = append(msg.infoHashes, ih)
+			case "Cookie":
+				msg.cookie = value
+			}
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	if msg.port == 0 || len(msg.infoHashes) == 0 {
+		return announce{}, errors.New("Missing port or info hash")
+	}
+	return msg, nil
+}
+
+// PeerFetcher announces a torrent on the local network and collects the
+// peers that announce it too
+type PeerFetcher struct {
+	s        *Service
+	infoHash [20]byte
+
+	mx      sync.Mutex
+	peers   map[netip.AddrPort]bool
+	session torrent.PeerSession
+}
+
+// PeerFetcher only hears announces for infoHash while it's running
+func (s *Service) PeerFetcher(infoHash [20]byte) *PeerFetcher {
+	return &PeerFetcher{s: s, infoHash: infoHash, peers: make(map[netip.AddrPort]bool)}
+}
+
+// Decentralised means private torrents won't use LSD
+func (f *PeerFetcher) Decentralised() {}
+
+// GetPeers gives the peers found so far after announcing
+func (f *PeerFetcher) GetPeers() []torrent.TorrentPeer {
+	if err := f.s.send([][20]byte{f.infoHash}); err != nil {
+		log.Debugf("LSD announce failed: %s", err)
+	}
+
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	peers := make([]torrent.TorrentPeer, 0, len(f.peers))
+	for p := range f.peers {
+		peers = append(peers, torrent.TorrentPeer{AddrPort: p})
+	}
+	return peers
+}
+
+// Run announces every AnnounceInterval and gives peers to the session as
+// they're found
+func (f *PeerFetcher) Run(s torrent.PeerSession, stop <-chan struct{}) {
+	f.mx.Lock()
+	f.session = s
+	f.mx.Unlock()
+	f.s.register(f)
+	defer f.s.unregister(f)
+
+	ticker := time.NewTicker(AnnounceInterval)
+	defer ticker.Stop()
+	for {
+		if err := f.s.send([][20]byte{f.infoHash}); err != nil {
+			log.Debugf("LSD announce failed: %s", err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (f *PeerFetcher) addPeer(p torrent.TorrentPeer) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if f.peers[p.AddrPort] {
+		return
+	}
+	f.peers[p.AddrPort] = true
+
+	if f.session != nil {
+		log.Debugf("Found LAN peer %s", p)
+		go f.session.AddPeers([]torrent.TorrentPeer{p})
+	}
+}
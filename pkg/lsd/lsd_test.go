@@ -0,0 +1,115 @@
+package lsd
+
+import (
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+	"tor/pkg/torrent"
+)
+
+type fakePeerSession struct {
+	mx    sync.Mutex
+	peers []torrent.TorrentPeer
+}
+
+func (s *fakePeerSession) AnnounceStats() torrent.AnnounceStats { return torrent.AnnounceStats{} }
+func (s *fakePeerSession) NeedsPeers() bool                     { return true }
+
+func (s *fakePeerSession) AddPeers(peers []torrent.TorrentPeer) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.peers = append(s.peers, peers...)
+}
+
+func TestAnnounceMessage(t *testing.T) {
+	infoHashes := [][20]byte{{1}, {2}}
+	b := announceMessage(ipv4Group, 6881, "abc", infoHashes)
+
+	msg, err := parseAnnounce(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.port != 6881 || msg.cookie != "abc" || len(msg.infoHashes) != 2 || msg.infoHashes[1] != infoHashes[1] {
+		t.Errorf("unexpected announce: %+v", msg)
+	}
+
+	if _, err := parseAnnounce([]byte("M-SEARCH * HTTP/1.1\r\n\r\n")); err == nil {
+		t.Errorf("other multicast messages should be rejected")
+	}
+}
+
+func TestServiceGivesPeersToSessions(t *testing.T) {
+	s := newService(6881)
+	var mx sync.Mutex
+	announced := 0
+	s.send = func(infoHashes [][20]byte) error {
+		mx.Lock()
+		defer mx.Unlock()
+		announced++
+		return nil
+	}
+
+	session := &fakePeerSession{}
+	f := s.PeerFetcher([20]byte{1})
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		f.Run(session, stop)
+		close(done)
+	}()
+
+	// Announces are only heard once the fetcher is running
+	for {
+		s.mx.Lock()
+		running := len(s.fetchers[[20]byte{1}]) > 0
+		s.mx.Unlock()
+		if running {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	from := netip.MustParseAddr("192.168.1.20")
+	s.handle(announceMessage(ipv4Group, 6882, "theirs", [][20]byte{{1}}), from)
+	// Our own announces loop back and other torrents aren't ours
+	s.handle(announceMessage(ipv4Group, 6881, s.cookie, [][20]byte{{1}}), netip.MustParseAddr("192.168.1.10"))
+	s.handle(announceMessage(ipv4Group, 6883, "theirs", [][20]byte{{2}}), from)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		session.mx.Lock()
+		n := len(session.peers)
+		session.mx.Unlock()
+		if n > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	session.mx.Lock()
+	if len(session.peers) != 1 || session.peers[0].String() != "192.168.1.20:6882" {
+		t.Errorf("expected just the LAN peer but got: %v", session.peers)
+	}
+	session.mx.Unlock()
+
+	close(stop)
+	<-done
+
+	s.mx.Lock()
+	if len(s.fetchers) != 0 {
+		t.Errorf("the fetcher should stop hearing announces once stopped")
+	}
+	s.mx.Unlock()
+
+	mx.Lock()
+	if announced == 0 {
+		t.Errorf("the torrent should have been announced")
+	}
+	mx.Unlock()
+
+	if len(f.GetPeers()) != 1 {
+		t.Errorf("GetPeers should give the peers found so far")
+	}
+}
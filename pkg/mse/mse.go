@@ -0,0 +1,439 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Policy decides whether peer connections use Message Stream Encryption
+type Policy int
+
+const (
+	// Disabled only uses plaintext connections
+	Disabled Policy = iota
+	// Preferred tries to encrypt but falls back to plaintext
+	Preferred
+	// Required refuses plaintext connections
+	Required
+)
+
+func (p Policy) String() string {
+	switch p {
+	case Disabled:
+		return "disabled"
+	case Preferred:
+		return "preferred"
+	case Required:
+		return "required"
+	}
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
+// CryptoMethod is one of the crypto_provide/crypto_select bits
+type CryptoMethod uint32
+
+const (
+	Plaintext CryptoMethod = 0x01
+	RC4       CryptoMethod = 0x02
+)
+
+const maxPadLength = 512
+
+// How long the whole handshake is allowed to take
+var HandshakeTimeout = 10 * time.Second
+
+var ErrPlaintextNotAllowed = errors.New("Plaintext connections aren't allowed by the encryption policy")
+var ErrEncryptionNotAllowed = errors.New("Encrypted connections aren't allowed by the encryption policy")
+
+var (
+	dhPrime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	dhGenerator = big.NewInt(2)
+	vc          = [8]byte{}
+)
+
+// Conn is a peer connection after the MSE handshake. Depending on what was
+// negotiated it is either RC4 encrypted or passes data through unchanged.
+type Conn struct {
+	net.Conn
+	r       *bufio.Reader
+	method  CryptoMethod
+	initial []byte
+
+	readMx  sync.Mutex
+	dec     *rc4.Cipher
+	writeMx sync.Mutex
+	enc     *rc4.Cipher
+}
+
+// Method is the crypto method that was negotiated
+func (c *Conn) Method() CryptoMethod {
+	return c.method
+}
+
+func (c *Conn) Encrypted() bool {
+	return c.method == RC4
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readMx.Lock()
+	defer c.readMx.Unlock()
+
+	// Initial payload from the handshake is already decrypted
+	if len(c.initial) > 0 {
+		n := copy(b, c.initial)
+		c.initial = c.initial[n:]
+		return n, nil
+	}
+
+	n, err := c.r.Read(b)
+	if c.dec != nil && n > 0 {
+		c.dec.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+
+	c.writeMx.Lock()
+	defer c.writeMx.Unlock()
+
+	encrypted := make([]byte, len(b))
+	c.enc.XORKeyStream(encrypted, b)
+	return c.Conn.Write(encrypted)
+}
+
+// Initiate performs the handshake as the connecting side. skey is the info
+// hash of the torrent we're connecting for.
+func Initiate(conn net.Conn, skey [20]byte, policy Policy) (*Conn, error) {
+	if policy == Disabled {
+		return nil, ErrEncryptionNotAllowed
+	}
+
+	provide := RC4
+	if policy == Preferred {
+		provide |= Plaintext
+	}
+
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+
+	// 1 A->B: Diffie Hellman Ya, PadA
+	privateKey, publicKey, err := genKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write(append(publicKey, randomPad()...))
+	if err != nil {
+		return nil, err
+	}
+
+	// 2 B->A: Diffie Hellman Yb, PadB
+	yb := make([]byte, 96)
+	_, err = io.ReadFull(r, yb)
+	if err != nil {
+		return nil, err
+	}
+	s := sharedSecret(privateKey, yb)
+
+	enc, err := newCipher(hash([]byte("keyA"), s, skey[:]))
+	if err != nil {
+		return nil, err
+	}
+	dec, err := newCipher(hash([]byte("keyB"), s, skey[:]))
+	if err != nil {
+		return nil, err
+	}
+
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	msg := hash([]byte("req1"), s)
+	msg = append(msg, xor(hash([]byte("req2"), skey[:]), hash([]byte("req3"), s))...)
+
+	plain := make([]byte, 0, 16)
+	plain = append(plain, vc[:]...)
+	plain = binary.BigEndian.AppendUint32(plain, uint32(provide))
+	plain = binary.BigEndian.AppendUint16(plain, 0) // len(PadC)
+	plain = binary.BigEndian.AppendUint16(plain, 0) // len(IA)
+	encrypted := make([]byte, len(plain))
+	enc.XORKeyStream(encrypted, plain)
+
+	_, err = conn.Write(append(msg, encrypted...))
+	if err != nil {
+		return nil, err
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	// PadB is in front of the encrypted VC so look for it
+	encryptedVC := make([]byte, len(vc))
+	dec.XORKeyStream(encryptedVC, vc[:])
+	err = syncTo(r, encryptedVC, maxPadLength)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 6)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(buf, buf)
+
+	selected := CryptoMethod(binary.BigEndian.Uint32(buf))
+	if selected != Plaintext && selected != RC4 || selected&provide == 0 {
+		return nil, fmt.Errorf("Peer selected a crypto method we didn't provide: %v", selected)
+	}
+
+	err = skipPad(r, dec, int(binary.BigEndian.Uint16(buf[4:])))
+	if err != nil {
+		return nil, err
+	}
+
+	return newConn(conn, r, selected, enc, dec, nil), nil
+}
+
+// Accept performs the receiving side of the handshake. skeys are the info
+// hashes we'll accept connections for. Plaintext BitTorrent handshakes are
+// detected and passed through when the policy allows it.
+func Accept(conn net.Conn, skeys [][20]byte, policy Policy) (*Conn, error) {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+
+	// A plaintext connection starts with the BitTorrent handshake
+	start, err := r.Peek(20)
+	if err != nil {
+		return nil, err
+	}
+	if start[0] == 19 && string(start[1:20]) == "BitTorrent protocol" {
+		if policy == Required {
+			return nil, ErrPlaintextNotAllowed
+		}
+		return newConn(conn, r, Plaintext, nil, nil, nil), nil
+	}
+
+	if policy == Disabled {
+		return nil, ErrEncryptionNotAllowed
+	}
+
+	// 1 A->B: Diffie Hellman Ya, PadA
+	ya := make([]byte, 96)
+	_, err = io.ReadFull(r, ya)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2 B->A: Diffie Hellman Yb, PadB
+	privateKey, publicKey, err := genKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write(append(publicKey, randomPad()...))
+	if err != nil {
+		return nil, err
+	}
+	s := sharedSecret(privateKey, ya)
+
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	err = syncTo(r, hash([]byte("req1"), s), maxPadLength)
+	if err != nil {
+		return nil, err
+	}
+
+	skeyHash := make([]byte, sha1.Size)
+	_, err = io.ReadFull(r, skeyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	req3 := hash([]byte("req3"), s)
+	var skey []byte
+	for i := range skeys {
+		if bytes.Equal(xor(hash([]byte("req2"), skeys[i][:]), req3), skeyHash) {
+			skey = skeys[i][:]
+			break
+		}
+	}
+	if skey == nil {
+		return nil, fmt.Errorf("Peer asked for a torrent we don't have")
+	}
+
+	dec, err := newCipher(hash([]byte("keyA"), s, skey))
+	if err != nil {
+		return nil, err
+	}
+	enc, err := newCipher(hash([]byte("keyB"), s, skey))
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 14)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(buf, buf)
+
+	if !bytes.Equal(buf[:8], vc[:]) {
+		return nil, fmt.Errorf("Unexpected verification constant")
+	}
+
+	provided := CryptoMethod(binary.BigEndian.Uint32(buf[8:]))
+	err = skipPad(r, dec, int(binary.BigEndian.Uint16(buf[12:])))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.ReadFull(r, buf[:2])
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(buf[:2], buf[:2])
+
+	initial := make([]byte, binary.BigEndian.Uint16(buf))
+	_, err = io.ReadFull(r, initial)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(initial, initial)
+
+	var selected CryptoMethod
+	switch {
+	case provided&RC4 != 0:
+		selected = RC4
+	case provided&Plaintext != 0 && policy != Required:
+		selected = Plaintext
+	default:
+		return nil, fmt.Errorf("No acceptable crypto method provided: %v", provided)
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	plain := make([]byte, 0, 14)
+	plain = append(plain, vc[:]...)
+	plain = binary.BigEndian.AppendUint32(plain, uint32(selected))
+	plain = binary.BigEndian.AppendUint16(plain, 0) // len(padD)
+	enc.XORKeyStream(plain, plain)
+
+	_, err = conn.Write(plain)
+	if err != nil {
+		return nil, err
+	}
+
+	return newConn(conn, r, selected, enc, dec, initial), nil
+}
+
+func newConn(conn net.Conn, r *bufio.Reader, method CryptoMethod, enc, dec *rc4.Cipher, initial []byte) *Conn {
+	c := &Conn{
+		Conn:    conn,
+		r:       r,
+		method:  method,
+		initial: initial,
+	}
+	if method == RC4 {
+		c.enc = enc
+		c.dec = dec
+	}
+	return c
+}
+
+func genKeys() (*big.Int, []byte, error) {
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	privateKey := new(big.Int).SetBytes(b)
+	publicKey := new(big.Int).Exp(dhGenerator, privateKey, dhPrime)
+	return privateKey, publicKey.FillBytes(make([]byte, 96)), nil
+}
+
+func sharedSecret(privateKey *big.Int, remotePublicKey []byte) []byte {
+	y := new(big.Int).SetBytes(remotePublicKey)
+	return new(big.Int).Exp(y, privateKey, dhPrime).FillBytes(make([]byte, 96))
+}
+
+func newCipher(key []byte) (*rc4.Cipher, error) {
+	c, err := rc4.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// The first 1024 bytes of the keystream are discarded
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c, nil
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func xor(a, b []byte) []byte {
+	ret := make([]byte, len(a))
+	for i := range a {
+		ret[i] = a[i] ^ b[i]
+	}
+	return ret
+}
+
+func randomPad() []byte {
+	pad := make([]byte, mrand.Intn(maxPadLength+1))
+	rand.Read(pad)
+	return pad
+}
+
+// syncTo consumes bytes from r up to and including pattern, which must be
+// found within maxSkip bytes
+func syncTo(r *bufio.Reader, pattern []byte, maxSkip int) error {
+	window := make([]byte, 0, maxSkip+len(pattern))
+	for len(window) < cap(window) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Couldn't find synchronisation point in handshake")
+}
+
+func skipPad(r *bufio.Reader, dec *rc4.Cipher, length int) error {
+	if length > maxPadLength {
+		return fmt.Errorf("Padding length %v is too long", length)
+	}
+
+	pad := make([]byte, length)
+	_, err := io.ReadFull(r, pad)
+	if err != nil {
+		return err
+	}
+	dec.XORKeyStream(pad, pad)
+	return nil
+}
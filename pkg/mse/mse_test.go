@@ -0,0 +1,160 @@
+package mse
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+type acceptResult struct {
+	conn *Conn
+	err  error
+}
+
+func setupConns(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, ok := <-accepted
+	if !ok {
+		t.Fatal("Couldn't accept test connection")
+	}
+	return client, server
+}
+
+func handshake(t *testing.T, skey [20]byte, skeys [][20]byte, initiatorPolicy, receiverPolicy Policy) (*Conn, *Conn, error, error) {
+	client, server := setupConns(t)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	results := make(chan acceptResult)
+	go func() {
+		conn, err := Accept(server, skeys, receiverPolicy)
+		if err != nil {
+			// Let the initiator fail rather than wait for its timeout
+			server.Close()
+		}
+		results <- acceptResult{conn, err}
+	}()
+
+	initiated, initErr := Initiate(client, skey, initiatorPolicy)
+	if initErr != nil {
+		client.Close()
+	}
+	res := <-results
+	return initiated, res.conn, initErr, res.err
+}
+
+func exchange(t *testing.T, a, b net.Conn) {
+	msg := []byte("hello from the other side")
+	go a.Write(msg)
+
+	buf := make([]byte, len(msg))
+	_, err := io.ReadFull(b, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Errorf("expected to read %s but got: %s", msg, buf)
+	}
+}
+
+func TestHandshakeRC4(t *testing.T) {
+	skey := [20]byte{1, 2, 3}
+	other := [20]byte{4, 5, 6}
+	initiated, accepted, initErr, acceptErr := handshake(t, skey, [][20]byte{other, skey}, Required, Preferred)
+	if initErr != nil || acceptErr != nil {
+		t.Fatalf("handshake failed: %v %v", initErr, acceptErr)
+	}
+
+	if !initiated.Encrypted() || !accepted.Encrypted() {
+		t.Errorf("expected both sides to have selected RC4")
+	}
+
+	exchange(t, initiated, accepted)
+	exchange(t, accepted, initiated)
+}
+
+func TestHandshakePreferred(t *testing.T) {
+	skey := [20]byte{1, 2, 3}
+	initiated, accepted, initErr, acceptErr := handshake(t, skey, [][20]byte{skey}, Preferred, Preferred)
+	if initErr != nil || acceptErr != nil {
+		t.Fatalf("handshake failed: %v %v", initErr, acceptErr)
+	}
+
+	// Preferred picks RC4 when it's on offer
+	if initiated.Method() != RC4 || accepted.Method() != RC4 {
+		t.Errorf("expected RC4 to be selected but got: %v %v", initiated.Method(), accepted.Method())
+	}
+	exchange(t, initiated, accepted)
+}
+
+func TestHandshakeUnknownInfoHash(t *testing.T) {
+	_, _, initErr, acceptErr := handshake(t, [20]byte{1}, [][20]byte{{2}}, Required, Required)
+	if acceptErr == nil || initErr == nil {
+		t.Errorf("handshake for an unknown info hash should fail")
+	}
+}
+
+func TestAcceptPlaintext(t *testing.T) {
+	client, server := setupConns(t)
+	defer client.Close()
+	defer server.Close()
+
+	handshakeMsg := append([]byte{19}, []byte("BitTorrent protocol")...)
+	handshakeMsg = append(handshakeMsg, make([]byte, 48)...)
+	go client.Write(handshakeMsg)
+
+	conn, err := Accept(server, nil, Preferred)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conn.Encrypted() {
+		t.Errorf("plaintext connection shouldn't be encrypted")
+	}
+
+	buf := make([]byte, len(handshakeMsg))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf, handshakeMsg) {
+		t.Errorf("expected the plaintext handshake to be passed through")
+	}
+}
+
+func TestAcceptPlaintextRequired(t *testing.T) {
+	client, server := setupConns(t)
+	defer client.Close()
+	defer server.Close()
+
+	handshakeMsg := append([]byte{19}, []byte("BitTorrent protocol")...)
+	go client.Write(handshakeMsg)
+
+	_, err := Accept(server, nil, Required)
+	if err != ErrPlaintextNotAllowed {
+		t.Errorf("expected plaintext to be refused but got: %v", err)
+	}
+}
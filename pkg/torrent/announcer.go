@@ -0,0 +1,216 @@
+package torrent
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Used when the tracker doesn't give us an interval
+var DefaultAnnounceInterval = 30 * time.Minute
+
+// Never announce more often than this, even when short of peers
+var MinAnnounceInterval = time.Minute
+
+// First retry delay for a failing tracker, it doubles on each failure up to
+// MaxAnnounceBackoff
+var AnnounceRetryDelay = 15 * time.Second
+var MaxAnnounceBackoff = 30 * time.Minute
+
+// How long shutting down waits for trackers to hear we've stopped
+var StoppedAnnounceTimeout = 5 * time.Second
+
+// How often announcers check whether the session needs peers or finished
+var announcerPollInterval = 5 * time.Second
+
+// PeerSession is what a SessionPeerFetcher needs from the torrent session
+type PeerSession interface {
+	AnnounceStats() AnnounceStats
+	// AddPeers hands newly found peers to the session
+	AddPeers(peers []TorrentPeer)
+	// NeedsPeers is true when the session is running low on peers
+	NeedsPeers() bool
+}
+
+// SessionPeerFetcher keeps finding peers for a session until stop is closed
+type SessionPeerFetcher interface {
+	Run(s PeerSession, stop <-chan struct{})
+}
+
+type announceResult struct {
+	req AnnounceRequest
+	res AnnounceResponse
+	err error
+}
+
+// trackerAnnouncer keeps announcing to one tracker for a session while it's
+// the tracker in use for its tier, with its own intervals and backoff
+type trackerAnnouncer struct {
+	tier       int
+	trackerUrl string
+	fetcher    *TrackersPeerFetcher
+	session    PeerSession
+
+	interval     time.Duration
+	minInterval  time.Duration
+	lastAnnounce time.Time
+	nextAnnounce time.Time
+	retryAt      time.Time
+	failures     int
+	// The tracker knows we've started and whether we've completed
+	started   bool
+	completed bool
+}
+
+func newTrackerAnnouncer(tier int, trackerUrl string, fetcher *TrackersPeerFetcher, session PeerSession) *trackerAnnouncer {
+	return &trackerAnnouncer{
+		tier:        tier,
+		trackerUrl:  trackerUrl,
+		fetcher:     fetcher,
+		session:     session,
+		interval:    DefaultAnnounceInterval,
+		minInterval: MinAnnounceInterval,
+	}
+}
+
+func (a *trackerAnnouncer) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(announcerPollInterval)
+	defer ticker.Stop()
+
+	// Announces happen in the background so stopping isn't held up by a
+	// tracker that's slow to answer
+	var results chan announceResult
+	for {
+		if results == nil {
+			event := a.nextEvent()
+			if a.due(event, time.Now()) {
+				results = a.announceAsync(event)
+			}
+		}
+
+		select {
+		case <-stop:
+			a.stop()
+			return
+		case r := <-results:
+			results = nil
+			a.handleResult(r, time.Now())
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *trackerAnnouncer) nextEvent() uint32 {
+	if !a.started {
+		return EventStarted
+	}
+
+	if !a.completed && a.session.AnnounceStats().Left == 0 {
+		return EventCompleted
+	}
+	return EventNone
+}
+
+func (a *trackerAnnouncer) due(event uint32, now time.Time) bool {
+	if now.Before(a.retryAt) || !a.fetcher.inUse(a.trackerUrl, now) {
+		return false
+	}
+
+	if event != EventNone || !now.Before(a.nextAnnounce) {
+		return true
+	}
+
+	return a.session.NeedsPeers() && !now.Before(a.lastAnnounce.Add(a.minInterval))
+}
+
+func (a *trackerAnnouncer) announceAsync(event uint32) chan announceResult {
+	results := make(chan announceResult, 1)
+	r := a.fetcher.newAnnounceRequest(a.session.AnnounceStats(), event)
+	go func() {
+		res, err := a.announce(r)
+		results <- announceResult{r, res, err}
+	}()
+	return results
+}
+
+func (a *trackerAnnouncer) announce(r AnnounceRequest) (AnnounceResponse, error) {
+	res, err := a.fetcher.announceTo(a.trackerUrl, r)
+	if err == nil {
+		a.fetcher.promote(a.tier, a.trackerUrl)
+	}
+	return res, err
+}
+
+func (a *trackerAnnouncer) handleResult(r announceResult, now time.Time) {
+	if r.err != nil {
+		a.failures++
+		backoff := AnnounceRetryDelay << (a.failures - 1)
+		if backoff > MaxAnnounceBackoff || backoff <= 0 {
+			backoff = MaxAnnounceBackoff
+		}
+		a.retryAt = now.Add(backoff)
+		a.nextAnnounce = a.retryAt
+		// The next tracker in the tier takes over until then
+		a.fetcher.setRetryAt(a.trackerUrl, a.retryAt)
+		log.Warnf("Announce failed, retrying in %v: %s", backoff, r.err)
+		return
+	}
+
+	a.failures = 0
+	a.retryAt = time.Time{}
+	a.fetcher.setRetryAt(a.trackerUrl, a.retryAt)
+	a.started = true
+	a.completed = a.completed || r.req.Left == 0
+
+	a.minInterval = MinAnnounceInterval
+	if d := time.Duration(r.res.minInterval) * time.Second; d > a.minInterval {
+		a.minInterval = d
+	}
+
+	a.interval = DefaultAnnounceInterval
+	if r.res.interval > 0 {
+		a.interval = time.Duration(r.res.interval) * time.Second
+	}
+	if a.interval < a.minInterval {
+		a.interval = a.minInterval
+	}
+
+	a.lastAnnounce = now
+	a.nextAnnounce = now.Add(a.interval)
+
+	if r.res.Warning != "" {
+		log.Warnf("Warning from tracker %s: %s", a.trackerUrl, r.res.Warning)
+	}
+
+	log.Debugf("Announced to %s, got %v peers, next announce in %v", a.trackerUrl, len(r.res.Peers), a.interval)
+	if len(r.res.Peers) > 0 {
+		a.session.AddPeers(r.res.Peers)
+	}
+}
+
+// stop tells the tracker we've finished if it has heard from us
+func (a *trackerAnnouncer) stop() {
+	if !a.started {
+		return
+	}
+
+	stats := a.session.AnnounceStats()
+	completed := a.completed
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if !completed && stats.Left == 0 {
+			a.announce(a.fetcher.newAnnounceRequest(stats, EventCompleted))
+		}
+		_, err := a.announce(a.fetcher.newAnnounceRequest(stats, EventStopped))
+		if err != nil {
+			log.Debugf("Stopped announce to %s failed: %s", a.trackerUrl, err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(StoppedAnnounceTimeout):
+		log.Debugf("Gave up waiting for %s to hear we stopped", a.trackerUrl)
+	}
+}
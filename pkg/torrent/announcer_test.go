@@ -0,0 +1,316 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeTracker struct {
+	mx       sync.Mutex
+	requests []AnnounceRequest
+	err      error
+	res      AnnounceResponse
+}
+
+func (t *fakeTracker) Announce(r AnnounceRequest) (AnnounceResponse, error) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.requests = append(t.requests, r)
+	return t.res, t.err
+}
+
+func (t *fakeTracker) Scrape(infoHashes ...[20]byte) ([]ScrapeResponse, error) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if t.err != nil {
+		return nil, t.err
+	}
+
+	res := make([]ScrapeResponse, len(infoHashes))
+	for i, ih := range infoHashes {
+		res[i] = ScrapeResponse{InfoHash: ih, Seeders: t.res.seeders, Leechers: t.res.leechers}
+	}
+	return res, nil
+}
+
+func (t *fakeTracker) events() []uint32 {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	events := make([]uint32, len(t.requests))
+	for i, r := range t.requests {
+		events[i] = r.Event
+	}
+	return events
+}
+
+type fakePeerSession struct {
+	mx         sync.Mutex
+	left       uint64
+	needsPeers bool
+	peers      []TorrentPeer
+}
+
+func (s *fakePeerSession) AnnounceStats() AnnounceStats {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return AnnounceStats{Left: s.left}
+}
+
+func (s *fakePeerSession) AddPeers(peers []TorrentPeer) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.peers = append(s.peers, peers...)
+}
+
+func (s *fakePeerSession) NeedsPeers() bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.needsPeers
+}
+
+func newTestAnnouncer(tracker Tracker, session PeerSession) *trackerAnnouncer {
+	fetcher := NewTrackersPeerFetcher([20]byte{1}, []string{"udp://tracker.example.com:6969"})
+	fetcher.trackers["udp://tracker.example.com:6969"] = tracker
+	fetcher.health = NewTrackerHealthChecker()
+	return newTrackerAnnouncer(0, "udp://tracker.example.com:6969", fetcher, session)
+}
+
+func TestAnnouncerHonoursIntervals(t *testing.T) {
+	session := &fakePeerSession{left: 10}
+	a := newTestAnnouncer(&fakeTracker{}, session)
+	now := time.Now()
+
+	if a.nextEvent() != EventStarted || !a.due(EventStarted, now) {
+		t.Fatalf("the first announce should be started and due straight away")
+	}
+
+	res := AnnounceResponse{interval: 1800, minInterval: 120}
+	a.handleResult(announceResult{req: AnnounceRequest{Left: 10}, res: res}, now)
+
+	if a.nextEvent() != EventNone {
+		t.Errorf("no event should be sent after started")
+	}
+
+	if a.due(EventNone, now.Add(119*time.Second)) {
+		t.Errorf("shouldn't announce before the interval")
+	}
+
+	session.needsPeers = true
+	if a.due(EventNone, now.Add(119*time.Second)) || !a.due(EventNone, now.Add(120*time.Second)) {
+		t.Errorf("running low on peers should announce once the min interval has passed")
+	}
+
+	session.needsPeers = false
+	if !a.due(EventNone, now.Add(1800*time.Second)) {
+		t.Errorf("should announce after the interval")
+	}
+
+	session.left = 0
+	if a.nextEvent() != EventCompleted || !a.due(EventCompleted, now) {
+		t.Errorf("finishing should announce completed straight away")
+	}
+}
+
+func TestAnnouncerBacksOff(t *testing.T) {
+	a := newTestAnnouncer(&fakeTracker{}, &fakePeerSession{left: 10})
+	now := time.Now()
+	failed := announceResult{err: errors.New("no")}
+
+	a.handleResult(failed, now)
+	if a.due(EventStarted, now.Add(AnnounceRetryDelay-time.Second)) || !a.due(EventStarted, now.Add(AnnounceRetryDelay)) {
+		t.Errorf("should retry after the retry delay")
+	}
+
+	a.handleResult(failed, now)
+	if a.due(EventStarted, now.Add(2*AnnounceRetryDelay-time.Second)) {
+		t.Errorf("the retry delay should double")
+	}
+
+	for i := 0; i < 20; i++ {
+		a.handleResult(failed, now)
+	}
+	if !a.due(EventStarted, now.Add(MaxAnnounceBackoff)) {
+		t.Errorf("backoff should be capped")
+	}
+}
+
+func TestTrackersPeerFetcherRun(t *testing.T) {
+	defer func(poll time.Duration) { announcerPollInterval = poll }(announcerPollInterval)
+	announcerPollInterval = 5 * time.Millisecond
+
+	peer := NewTorrentPeer(netip.MustParseAddr("10.0.0.1"), 6881)
+	tracker := &fakeTracker{res: AnnounceResponse{interval: 1800, Peers: []TorrentPeer{peer}}}
+	session := &fakePeerSession{left: 10}
+
+	a := newTestAnnouncer(tracker, session)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		a.fetcher.Run(session, stop)
+		close(done)
+	}()
+
+	waitFor := func(what string, cond func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s, events: %v", what, tracker.events())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	waitFor("peers", func() bool {
+		session.mx.Lock()
+		defer session.mx.Unlock()
+		return len(session.peers) == 1
+	})
+
+	session.mx.Lock()
+	session.left = 0
+	session.mx.Unlock()
+	waitFor("completed", func() bool { return len(tracker.events()) == 2 })
+
+	close(stop)
+	<-done
+
+	expected := []uint32{EventStarted, EventCompleted, EventStopped}
+	events := tracker.events()
+	if len(events) != len(expected) {
+		t.Fatalf("expected events %v but got: %v", expected, events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Errorf("expected events %v but got: %v", expected, events)
+		}
+	}
+}
+
+func newTieredTestFetcher(trackers [][]*fakeTracker) *TrackersPeerFetcher {
+	var tiers [][]string
+	urls := make(map[string]Tracker)
+	for i, tier := range trackers {
+		var tierUrls []string
+		for j, tracker := range tier {
+			u := fmt.Sprintf("udp://tracker%v-%v.example.com:6969", i, j)
+			tierUrls = append(tierUrls, u)
+			urls[u] = tracker
+		}
+		tiers = append(tiers, tierUrls)
+	}
+
+	fetcher := NewTieredTrackersPeerFetcher([20]byte{1}, tiers)
+	// In the given order rather than shuffled
+	fetcher.tiers = tiers
+	fetcher.health = NewTrackerHealthChecker()
+	for u, tracker := range urls {
+		fetcher.trackers[u] = tracker
+	}
+	return fetcher
+}
+
+func TestTrackersPeerFetcherTiers(t *testing.T) {
+	defer func(poll, min time.Duration) {
+		announcerPollInterval, MinAnnounceInterval = poll, min
+	}(announcerPollInterval, MinAnnounceInterval)
+	announcerPollInterval, MinAnnounceInterval = 5*time.Millisecond, 0
+
+	failing := &fakeTracker{err: errors.New("no")}
+	working := &fakeTracker{res: AnnounceResponse{interval: 1}}
+	backup := &fakeTracker{res: AnnounceResponse{interval: 1800}}
+	fetcher := newTieredTestFetcher([][]*fakeTracker{{failing, working}, {backup}})
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		fetcher.Run(&fakePeerSession{left: 10}, stop)
+		close(done)
+	}()
+
+	waitFor := func(what string, cond func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// The next tracker in the tier takes over while the first backs off
+	waitFor("the working tracker", func() bool { return len(working.events()) == 1 })
+	if len(failing.events()) != 1 || len(backup.events()) != 0 {
+		t.Errorf("the first tier should be used when one of its trackers works")
+	}
+
+	fetcher.mx.Lock()
+	promoted := fetcher.tiers[0][0]
+	fetcher.mx.Unlock()
+	if promoted != "udp://tracker0-1.example.com:6969" {
+		t.Errorf("the working tracker should be promoted but %s is first", promoted)
+	}
+
+	// The next tier is only used once every tracker in the first is failing
+	working.mx.Lock()
+	working.err = errors.New("no")
+	working.mx.Unlock()
+
+	waitFor("the next tier", func() bool { return len(backup.events()) == 1 })
+	if events := backup.events(); events[0] != EventStarted {
+		t.Errorf("expected started to the next tier but got: %v", events)
+	}
+	if events := failing.events(); len(events) != 1 {
+		t.Errorf("the failing tracker should wait out its backoff but got: %v", events)
+	}
+
+	close(stop)
+	<-done
+	if events := backup.events(); len(events) != 2 || events[1] != EventStopped {
+		t.Errorf("the next tier should hear we stopped but got: %v", events)
+	}
+}
+
+func TestAnnounceToAllTiers(t *testing.T) {
+	defer func(poll time.Duration, all bool) {
+		announcerPollInterval, AnnounceToAllTiers = poll, all
+	}(announcerPollInterval, AnnounceToAllTiers)
+	announcerPollInterval, AnnounceToAllTiers = 5*time.Millisecond, true
+
+	first := &fakeTracker{res: AnnounceResponse{interval: 1800}}
+	second := &fakeTracker{res: AnnounceResponse{interval: 1800}}
+	fetcher := newTieredTestFetcher([][]*fakeTracker{{first}, {second}})
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		fetcher.Run(&fakePeerSession{left: 10}, stop)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(first.events()) == 0 || len(second.events()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("every tier should be announced to")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(stop)
+	<-done
+}
+
+func TestTrackersPeerFetcherScrape(t *testing.T) {
+	failing := &fakeTracker{err: errors.New("no")}
+	working := &fakeTracker{res: AnnounceResponse{seeders: 3, leechers: 4}}
+	fetcher := newTieredTestFetcher([][]*fakeTracker{{failing}, {working}})
+
+	res, err := fetcher.Scrape()
+	handleTestErr(err, t)
+	if res.InfoHash != fetcher.infoHash || res.Seeders != 3 || res.Leechers != 4 {
+		t.Errorf("expected the working tracker's scrape but got: %+v", res)
+	}
+}
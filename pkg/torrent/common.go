@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
-	"strings"
 	"tor/pkg/bencode"
 	"tor/pkg/util"
 )
@@ -22,6 +21,8 @@ type TorrentInfo struct {
 	Pieces []byte
 	// List of files if multi-file
 	Files []TorrentFile
+	// Peers may only come from the torrent's trackers (BEP 27)
+	Private bool
 }
 
 type TorrentFile struct {
@@ -34,11 +35,14 @@ type TorrentFile struct {
 type Torrent struct {
 	// Tracker URL
 	Announce string
-	// List of alternate tracker URLS
-	AnnounceList []string
+	// Tiers of alternate tracker URLs (BEP 12)
+	AnnounceList [][]string
 	// Information about the file
-	Info    TorrentInfo
-	UrlList string
+	Info TorrentInfo
+	// Web seed URLs (BEP 19)
+	UrlList []string
+	// DHT nodes to bootstrap from as host:port, for trackerless torrents
+	Nodes []string
 }
 
 func NewTorrentInfoFromBencodedDict(infoDict map[string]interface{}) *TorrentInfo {
@@ -54,6 +58,10 @@ func NewTorrentInfoFromBencodedDict(infoDict map[string]interface{}) *TorrentInf
 		ti.Name = n
 	}
 
+	if private, ok := infoDict["private"].(int); ok && private == 1 {
+		ti.Private = true
+	}
+
 	// Length
 
 	if _, ok := infoDict["length"]; ok {
@@ -89,35 +97,69 @@ func (t *Torrent) GetTrackerAddress() string {
 }
 
 func (t *Torrent) GetTrackerAddresses() []string {
-	urls := make([]string, len(t.AnnounceList))
+	urls := make([]string, 0, len(t.AnnounceList))
 
-	for i, url := range t.AnnounceList {
-		urls[i] = parseTrackerAddressFromUrl(url)
+	for _, tier := range t.AnnounceList {
+		for _, url := range tier {
+			urls = append(urls, parseTrackerAddressFromUrl(url))
+		}
 	}
 	return urls
 }
 
-func (t *Torrent) GetAllTrackerAddresses() []string {
-	urls := make([]string, len(t.AnnounceList)+1)
+// GetTrackerTiers is the announce list, or just the announce URL if there
+// isn't one as BEP 12 says to ignore announce when there's an announce list
+func (t *Torrent) GetTrackerTiers() [][]string {
+	tiers := make([][]string, 0, len(t.AnnounceList))
+	for _, tier := range t.AnnounceList {
+		if len(tier) > 0 {
+			tiers = append(tiers, append([]string{}, tier...))
+		}
+	}
+
+	if len(tiers) == 0 && t.Announce != "" {
+		tiers = append(tiers, []string{t.Announce})
+	}
+	return tiers
+}
+
+// GetTrackerUrls is the announce URL followed by the announce list without
+// duplicates
+func (t *Torrent) GetTrackerUrls() []string {
+	seen := make(map[string]bool)
+	urls := []string{}
+	add := func(u string) {
+		if u != "" && !seen[u] {
+			seen[u] = true
+			urls = append(urls, u)
+		}
+	}
 
-	urls[0] = t.GetTrackerAddress()
-	for i, url := range t.AnnounceList {
-		urls[i+1] = parseTrackerAddressFromUrl(url)
+	add(t.Announce)
+	for _, tier := range t.AnnounceList {
+		for _, u := range tier {
+			add(u)
+		}
 	}
 	return urls
 }
 
+func (t *Torrent) GetAllTrackerAddresses() []string {
+	return append([]string{t.GetTrackerAddress()}, t.GetTrackerAddresses()...)
+}
+
+// GetLiveTrackerAddress is the address of the healthiest tracker that
+// answers a probe
 func (t *Torrent) GetLiveTrackerAddress() string {
-	addrs := t.GetAllTrackerAddresses()
-	return util.GetLiveTrackerAddress(addrs)
+	live := LiveTrackerUrls(t.GetTrackerUrls())
+	if len(live) == 0 {
+		return ""
+	}
+	return parseTrackerAddressFromUrl(live[0])
 }
 
 func parseTrackerAddressFromUrl(url string) string {
-	s, _ := strings.CutPrefix(url, "udp://")
-	p := strings.Split(s, ":")
-	p2 := strings.Split(p[1], "/")
-
-	return p[0] + ":" + p2[0]
+	return util.ParseTrackerAddressFromUrl(url)
 }
 
 func GenPeerId() [20]byte {
@@ -178,6 +220,10 @@ func (ti *TorrentInfo) ToBencodedString() ([]byte, error) {
 		bencodeMap["length"] = ti.Length
 	}
 
+	if ti.Private {
+		bencodeMap["private"] = 1
+	}
+
 	if len(ti.Files) > 0 {
 		files := make([]interface{}, 0)
 		for _, f := range ti.Files {
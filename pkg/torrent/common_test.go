@@ -2,7 +2,10 @@ package torrent
 
 import (
 	"bytes"
+	"os"
+	"path/filepath"
 	"testing"
+	"tor/pkg/bencode"
 )
 
 func TestInt32ToIpString(t *testing.T) {
@@ -61,6 +64,28 @@ func TestNewTorrentInfoFromBencodedDict(t *testing.T) {
 	}
 }
 
+func TestPrivateTorrentInfo(t *testing.T) {
+	dict := map[string]interface{}{
+		"name":         []byte("private"),
+		"length":       10,
+		"piece length": 10,
+		"pieces":       make([]byte, 20),
+		"private":      1,
+	}
+	ti := NewTorrentInfoFromBencodedDict(dict)
+	if !ti.Private {
+		t.Fatalf("private flag should be parsed")
+	}
+
+	encoded, err := bencode.Encode(dict)
+	handleTestErr(err, t)
+	reencoded, err := ti.ToBencodedString()
+	handleTestErr(err, t)
+	if !bytes.Equal(encoded, reencoded) {
+		t.Errorf("private flag should be kept so the info hash doesn't change, got: %s", reencoded)
+	}
+}
+
 func TestIsSingleFile(t *testing.T) {
 	singleTi := TorrentInfo{
 		Length: 100,
@@ -78,3 +103,45 @@ func TestIsSingleFile(t *testing.T) {
 		t.Errorf("should return false")
 	}
 }
+
+func TestParseTorrentFileTiers(t *testing.T) {
+	b, err := bencode.Encode(map[string]interface{}{
+		"announce": []byte("udp://a.example.com:6969"),
+		"announce-list": []interface{}{
+			[]interface{}{[]byte("udp://a.example.com:6969"), []byte("udp://b.example.com:6969")},
+			[]interface{}{[]byte("http://c.example.com/announce")},
+		},
+		"info":     map[string]interface{}{"name": []byte("test"), "length": 10, "piece length": 10, "pieces": make([]byte, 20)},
+		"url-list": []byte("http://seed.example.com/test"),
+		"nodes":    []interface{}{[]interface{}{[]byte("127.0.0.1"), 6881}, []interface{}{[]byte("dht.example.com"), 6882}},
+	})
+	handleTestErr(err, t)
+
+	fileName := filepath.Join(t.TempDir(), "tiers.torrent")
+	handleTestErr(os.WriteFile(fileName, b, 0644), t)
+
+	tf, err := ParseTorrentFile(fileName)
+	handleTestErr(err, t)
+
+	tiers := tf.GetTrackerTiers()
+	if len(tiers) != 2 || len(tiers[0]) != 2 || tiers[0][1] != "udp://b.example.com:6969" || tiers[1][0] != "http://c.example.com/announce" {
+		t.Errorf("unexpected tiers: %v", tiers)
+	}
+
+	if len(tf.UrlList) != 1 || tf.UrlList[0] != "http://seed.example.com/test" {
+		t.Errorf("expected the web seed but got: %v", tf.UrlList)
+	}
+
+	if len(tf.Nodes) != 2 || tf.Nodes[1] != "dht.example.com:6882" {
+		t.Errorf("expected the DHT nodes but got: %v", tf.Nodes)
+	}
+
+	if urls := tf.GetTrackerUrls(); len(urls) != 3 {
+		t.Errorf("expected 3 tracker urls without duplicates but got: %v", urls)
+	}
+
+	tf.AnnounceList = nil
+	if tiers := tf.GetTrackerTiers(); len(tiers) != 1 || tiers[0][0] != tf.Announce {
+		t.Errorf("announce should be the only tier without an announce list but got: %v", tiers)
+	}
+}
@@ -3,6 +3,7 @@ package torrent
 import (
 	"encoding/binary"
 	"fmt"
+	"net/netip"
 	"tor/pkg/bencode"
 )
 
@@ -12,6 +13,18 @@ type BitTorrentMesssage interface {
 type ExtensionHandshakeMessage struct {
 	M            map[string]interface{}
 	MetadataSize int
+	// Client name and version
+	V string
+	// Local TCP listen port
+	P int
+	// The address the sender sees the receiver connecting from
+	YourIp netip.Addr
+	// The sender's own addresses if it knows them
+	Ipv4 netip.Addr
+	Ipv6 netip.Addr
+	// Number of outstanding requests the sender will queue without dropping
+	Reqq       int
+	UploadOnly bool
 }
 
 type ExtensionMessage struct {
@@ -28,6 +41,30 @@ type MetadataExtensionMessage struct {
 
 func (m *ExtensionHandshakeMessage) Serialize() []byte {
 	topDict := map[string]interface{}{"m": m.M}
+	if m.MetadataSize > 0 {
+		topDict["metadata_size"] = m.MetadataSize
+	}
+	if m.V != "" {
+		topDict["v"] = m.V
+	}
+	if m.P > 0 {
+		topDict["p"] = m.P
+	}
+	if m.YourIp.IsValid() {
+		topDict["yourip"] = m.YourIp.Unmap().AsSlice()
+	}
+	if m.Ipv4.Is4() {
+		topDict["ipv4"] = m.Ipv4.AsSlice()
+	}
+	if m.Ipv6.Is6() {
+		topDict["ipv6"] = m.Ipv6.AsSlice()
+	}
+	if m.Reqq > 0 {
+		topDict["reqq"] = m.Reqq
+	}
+	if m.UploadOnly {
+		topDict["upload_only"] = 1
+	}
 	encodedDict := bencode.EncodeDict(topDict)
 
 	length := len(encodedDict) + 2
@@ -61,11 +98,13 @@ func DeserializeExtensionHandshakeMessage(msg []byte) (*ExtensionHandshakeMessag
 		return nil, fmt.Errorf("Expected a map in the decoded bencode message")
 	}
 
-	supportedExtensions := dict["m"].(map[string]interface{})
-
-	ret := ExtensionHandshakeMessage{make(map[string]interface{}), 0}
-	for ext, id := range supportedExtensions {
-		ret.M[ext] = id.(int)
+	ret := ExtensionHandshakeMessage{M: make(map[string]interface{})}
+	if supportedExtensions, ok := dict["m"].(map[string]interface{}); ok {
+		for ext, id := range supportedExtensions {
+			if id, ok := id.(int); ok {
+				ret.M[ext] = id
+			}
+		}
 	}
 
 	if metadataSizeI, has := dict["metadata_size"]; has {
@@ -73,6 +112,36 @@ func DeserializeExtensionHandshakeMessage(msg []byte) (*ExtensionHandshakeMessag
 			ret.MetadataSize = metadataSize
 		}
 	}
+
+	if v, ok := dict["v"].([]byte); ok {
+		ret.V = string(v)
+	}
+
+	if p, ok := dict["p"].(int); ok && p > 0 && p <= 65535 {
+		ret.P = p
+	}
+
+	if yourIp, ok := dict["yourip"].([]byte); ok {
+		if addr, ok := netip.AddrFromSlice(yourIp); ok {
+			ret.YourIp = addr.Unmap()
+		}
+	}
+
+	if ipv4, ok := dict["ipv4"].([]byte); ok && len(ipv4) == 4 {
+		ret.Ipv4 = netip.AddrFrom4([4]byte(ipv4))
+	}
+
+	if ipv6, ok := dict["ipv6"].([]byte); ok && len(ipv6) == 16 {
+		ret.Ipv6 = netip.AddrFrom16([16]byte(ipv6))
+	}
+
+	if reqq, ok := dict["reqq"].(int); ok && reqq > 0 {
+		ret.Reqq = reqq
+	}
+
+	if uploadOnly, ok := dict["upload_only"].(int); ok {
+		ret.UploadOnly = uploadOnly != 0
+	}
 	return &ret, nil
 }
 
@@ -0,0 +1,71 @@
+package torrent
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestExtensionHandshakeRoundTrip(t *testing.T) {
+	m := ExtensionHandshakeMessage{
+		M:            map[string]interface{}{"ut_metadata": 3},
+		MetadataSize: 1234,
+		V:            ClientVersion,
+		P:            6881,
+		YourIp:       netip.MustParseAddr("203.0.113.7"),
+		Ipv4:         netip.MustParseAddr("198.51.100.1"),
+		Ipv6:         netip.MustParseAddr("2001:db8::1"),
+		Reqq:         250,
+		UploadOnly:   true,
+	}
+
+	// Skip the length prefix, message id and extended message id
+	parsed, err := DeserializeExtensionHandshakeMessage(m.Serialize()[6:])
+	handleTestErr(err, t)
+
+	if parsed.M["ut_metadata"] != 3 {
+		t.Errorf("expected ut_metadata to have id 3 but got: %v", parsed.M["ut_metadata"])
+	}
+
+	if parsed.MetadataSize != m.MetadataSize || parsed.V != m.V || parsed.P != m.P || parsed.Reqq != m.Reqq || parsed.UploadOnly != m.UploadOnly {
+		t.Errorf("expected parsed handshake to be %+v but got: %+v", m, parsed)
+	}
+
+	if parsed.YourIp != m.YourIp || parsed.Ipv4 != m.Ipv4 || parsed.Ipv6 != m.Ipv6 {
+		t.Errorf("expected addresses %s %s %s but got: %s %s %s", m.YourIp, m.Ipv4, m.Ipv6, parsed.YourIp, parsed.Ipv4, parsed.Ipv6)
+	}
+}
+
+func TestExtensionHandshakeMinimal(t *testing.T) {
+	parsed, err := DeserializeExtensionHandshakeMessage([]byte("d1:v3:abc6:yourip16:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01e"))
+	handleTestErr(err, t)
+
+	if len(parsed.M) != 0 {
+		t.Errorf("expected no extensions but got: %v", parsed.M)
+	}
+
+	if parsed.V != "abc" {
+		t.Errorf("expected client to be abc but got: %s", parsed.V)
+	}
+
+	if parsed.YourIp != netip.MustParseAddr("2001:db8::1") {
+		t.Errorf("expected yourip to be 2001:db8::1 but got: %s", parsed.YourIp)
+	}
+}
+
+func TestMaxQueuedRequestsBoundedByReqq(t *testing.T) {
+	pc := NewPeerConnection(PeerInfo{}, GenPeerId(), GenPeerId(), 0, NewThreadSafeBitfield([]byte{}))
+
+	if pc.maxQueuedRequests() != MaxQueuedRequests {
+		t.Errorf("expected default of %v queued requests but got: %v", MaxQueuedRequests, pc.maxQueuedRequests())
+	}
+
+	pc.PeerReqq = 4
+	if pc.maxQueuedRequests() != 4 {
+		t.Errorf("expected reqq to limit queued requests to 4 but got: %v", pc.maxQueuedRequests())
+	}
+
+	pc.PeerReqq = 500
+	if pc.maxQueuedRequests() != MaxQueuedRequests {
+		t.Errorf("expected a large reqq to not raise queued requests but got: %v", pc.maxQueuedRequests())
+	}
+}
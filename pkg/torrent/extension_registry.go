@@ -0,0 +1,183 @@
+package torrent
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ExtensionHandler handles extension protocol (BEP 10) messages received for
+// an extension. The payload excludes the extended message id byte.
+type ExtensionHandler interface {
+	HandleExtensionMessage(pc *PeerConnection, payload []byte) error
+}
+
+// ExtensionHandshakeHandler can optionally be implemented by an ExtensionHandler
+// to be told when a peer's extension handshake has been received
+type ExtensionHandshakeHandler interface {
+	HandleExtensionHandshake(pc *PeerConnection, msg *ExtensionHandshakeMessage) error
+}
+
+// ExtensionHandlerFunc allows an ordinary function to be used as an ExtensionHandler
+type ExtensionHandlerFunc func(pc *PeerConnection, payload []byte) error
+
+func (f ExtensionHandlerFunc) HandleExtensionMessage(pc *PeerConnection, payload []byte) error {
+	return f(pc, payload)
+}
+
+type RegisteredExtension struct {
+	// Name advertised in the handshake "m" dictionary e.g. ut_metadata
+	Name string
+	// The id peers use when sending us messages for this extension
+	LocalId uint8
+	Handler ExtensionHandler
+}
+
+// ExtensionRegistry keeps the extensions we advertise to peers and the local
+// message ids they are dispatched by
+type ExtensionRegistry struct {
+	mx     sync.RWMutex
+	byName map[string]*RegisteredExtension
+	byId   map[uint8]*RegisteredExtension
+}
+
+// DefaultExtensionRegistry is used by peer connections unless they are given
+// their own registry
+var DefaultExtensionRegistry = NewExtensionRegistry()
+
+func init() {
+	err := DefaultExtensionRegistry.RegisterWithId(UtMetadataExtensionName, UtMetadataLocalId, ExtensionHandlerFunc(handleMetadataExtensionMessage))
+	if err != nil {
+		panic(err)
+	}
+}
+
+func NewExtensionRegistry() *ExtensionRegistry {
+	return &ExtensionRegistry{
+		byName: make(map[string]*RegisteredExtension),
+		byId:   make(map[uint8]*RegisteredExtension),
+	}
+}
+
+// Register adds an extension using the lowest free local message id
+func (r *ExtensionRegistry) Register(name string, handler ExtensionHandler) (uint8, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	// 0 is reserved for the extension handshake
+	for id := 1; id <= 255; id++ {
+		if _, taken := r.byId[uint8(id)]; !taken {
+			return uint8(id), r.register(name, uint8(id), handler)
+		}
+	}
+	return 0, fmt.Errorf("No free extension message ids left for: %s", name)
+}
+
+// RegisterWithId adds an extension with a specific local message id
+func (r *ExtensionRegistry) RegisterWithId(name string, id uint8, handler ExtensionHandler) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.register(name, id, handler)
+}
+
+func (r *ExtensionRegistry) register(name string, id uint8, handler ExtensionHandler) error {
+	if name == "" {
+		return fmt.Errorf("Extension name can't be empty")
+	}
+
+	if id == 0 {
+		return fmt.Errorf("Extension message id 0 is reserved for the handshake")
+	}
+
+	if handler == nil {
+		return fmt.Errorf("Extension %s needs a handler", name)
+	}
+
+	if _, exists := r.byName[name]; exists {
+		return fmt.Errorf("Extension %s is already registered", name)
+	}
+
+	if existing, taken := r.byId[id]; taken {
+		return fmt.Errorf("Extension message id %v is already used by %s", id, existing.Name)
+	}
+
+	ext := &RegisteredExtension{
+		Name:    name,
+		LocalId: id,
+		Handler: handler,
+	}
+	r.byName[name] = ext
+	r.byId[id] = ext
+	return nil
+}
+
+func (r *ExtensionRegistry) Unregister(name string) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if ext, exists := r.byName[name]; exists {
+		delete(r.byName, name)
+		delete(r.byId, ext.LocalId)
+	}
+}
+
+func (r *ExtensionRegistry) Lookup(id uint8) (RegisteredExtension, bool) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	ext, ok := r.byId[id]
+	if !ok {
+		return RegisteredExtension{}, false
+	}
+	return *ext, true
+}
+
+func (r *ExtensionRegistry) LookupName(name string) (RegisteredExtension, bool) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	ext, ok := r.byName[name]
+	if !ok {
+		return RegisteredExtension{}, false
+	}
+	return *ext, true
+}
+
+// Extensions returns the registered extensions ordered by local id
+func (r *ExtensionRegistry) Extensions() []RegisteredExtension {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	exts := make([]RegisteredExtension, 0, len(r.byId))
+	for _, ext := range r.byId {
+		exts = append(exts, *ext)
+	}
+	sort.Slice(exts, func(i, j int) bool { return exts[i].LocalId < exts[j].LocalId })
+	return exts
+}
+
+// HandshakeM builds the "m" dictionary sent in our extension handshake
+func (r *ExtensionRegistry) HandshakeM() map[string]interface{} {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	m := make(map[string]interface{}, len(r.byName))
+	for name, ext := range r.byName {
+		m[name] = int(ext.LocalId)
+	}
+	return m
+}
+
+// Clone returns a copy of the registry that can be changed independently
+func (r *ExtensionRegistry) Clone() *ExtensionRegistry {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	clone := NewExtensionRegistry()
+	for name, ext := range r.byName {
+		e := *ext
+		clone.byName[name] = &e
+		clone.byId[e.LocalId] = &e
+	}
+	return clone
+}
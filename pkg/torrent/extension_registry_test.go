@@ -0,0 +1,100 @@
+package torrent
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExtensionRegistryRegister(t *testing.T) {
+	r := NewExtensionRegistry()
+	noop := ExtensionHandlerFunc(func(pc *PeerConnection, payload []byte) error { return nil })
+
+	id, err := r.Register("ext_a", noop)
+	handleTestErr(err, t)
+	if id != 1 {
+		t.Errorf("expected first free id to be 1 but got: %v", id)
+	}
+
+	err = r.RegisterWithId("ext_b", 3, noop)
+	handleTestErr(err, t)
+
+	id, err = r.Register("ext_c", noop)
+	handleTestErr(err, t)
+	if id != 2 {
+		t.Errorf("expected next free id to be 2 but got: %v", id)
+	}
+
+	if err := r.RegisterWithId("ext_d", 3, noop); err == nil {
+		t.Errorf("shouldn't be able to register two extensions with the same id")
+	}
+
+	if _, err := r.Register("ext_a", noop); err == nil {
+		t.Errorf("shouldn't be able to register the same name twice")
+	}
+
+	if err := r.RegisterWithId("ext_e", 0, noop); err == nil {
+		t.Errorf("shouldn't be able to use the handshake id")
+	}
+
+	m := r.HandshakeM()
+	expected := map[string]int{"ext_a": 1, "ext_b": 3, "ext_c": 2}
+	if len(m) != len(expected) {
+		t.Errorf("expected %v extensions in handshake but got: %v", len(expected), len(m))
+	}
+	for name, id := range expected {
+		if m[name] != id {
+			t.Errorf("expected %s to have id %v but got: %v", name, id, m[name])
+		}
+	}
+
+	r.Unregister("ext_b")
+	if _, ok := r.Lookup(3); ok {
+		t.Errorf("ext_b should have been unregistered")
+	}
+}
+
+func TestExtensionRegistryClone(t *testing.T) {
+	r := NewExtensionRegistry()
+	noop := ExtensionHandlerFunc(func(pc *PeerConnection, payload []byte) error { return nil })
+	r.Register("ext_a", noop)
+
+	clone := r.Clone()
+	clone.Unregister("ext_a")
+
+	if _, ok := r.LookupName("ext_a"); !ok {
+		t.Errorf("changing a clone shouldn't change the original registry")
+	}
+}
+
+func TestExtensionMessageDispatch(t *testing.T) {
+	var received []byte
+	r := DefaultExtensionRegistry.Clone()
+	id, err := r.Register("my_ext", ExtensionHandlerFunc(func(pc *PeerConnection, payload []byte) error {
+		received = payload
+		return nil
+	}))
+	handleTestErr(err, t)
+
+	pc := NewPeerConnection(PeerInfo{}, GenPeerId(), GenPeerId(), 0, NewThreadSafeBitfield([]byte{}))
+	pc.Extensions = r
+
+	// The peer tells us it uses id 7 for my_ext
+	handshake := ExtensionHandshakeMessage{M: map[string]interface{}{"my_ext": 7, "ut_metadata": 0}}
+	handleTestErr(pc.HandleMessage(handshake.Serialize()), t)
+
+	if pc.SupportedExtensions["my_ext"] != 7 {
+		t.Errorf("expected peer id for my_ext to be 7 but got: %v", pc.SupportedExtensions["my_ext"])
+	}
+
+	if _, ok := pc.SupportedExtensions["ut_metadata"]; ok {
+		t.Errorf("an id of 0 should mark the extension as unsupported")
+	}
+
+	// Messages to us use our local id
+	msg := []byte{0, 0, 0, 5, 20, id, 'a', 'b', 'c'}
+	handleTestErr(pc.HandleMessage(msg), t)
+
+	if !bytes.Equal(received, []byte("abc")) {
+		t.Errorf("expected handler to receive abc but got: %s", received)
+	}
+}
@@ -1,8 +1,10 @@
 package torrent
 
 import (
+	"encoding/binary"
 	"fmt"
 	"math"
+	"tor/pkg/util"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -13,6 +15,12 @@ type BitTorrentExtensions struct {
 
 	MetadataSize int
 
+	// Fields from the peer's extension handshake
+	PeerClient     string
+	PeerListenPort int
+	PeerReqq       int
+	PeerUploadOnly bool
+
 	MetadataRequestState
 }
 
@@ -24,28 +32,103 @@ type MetadataRequestState struct {
 
 const MetadataPieceSize = 16384
 
-func (be *BitTorrentExtensions) handleExtension(payload []byte) {
-	if be.SupportedExtensions == nil {
-		be.SupportedExtensions = make(map[string]int)
+const UtMetadataExtensionName = "ut_metadata"
+const UtMetadataLocalId = 3
+
+func (pc *PeerConnection) extensionRegistry() *ExtensionRegistry {
+	if pc.Extensions == nil {
+		return DefaultExtensionRegistry
 	}
+	return pc.Extensions
+}
+
+func (pc *PeerConnection) handleExtension(payload []byte) {
+	if len(payload) == 0 {
+		log.Warn("Got an empty extension message")
+		return
+	}
+
+	if pc.SupportedExtensions == nil {
+		pc.SupportedExtensions = make(map[string]int)
+	}
+
 	if payload[0] == 0 {
-		msg, err := DeserializeExtensionHandshakeMessage(payload[1:])
-		if err != nil {
-			log.Error(err)
-			return
+		pc.handleExtensionHandshake(payload[1:])
+		return
+	}
+
+	ext, ok := pc.extensionRegistry().Lookup(payload[0])
+	if !ok {
+		log.Warnf("Got message for unknown extension id: %v", payload[0])
+		return
+	}
+
+	err := ext.Handler.HandleExtensionMessage(pc, payload[1:])
+	if err != nil {
+		log.Warnf("Error handling %s extension message: %s", ext.Name, err)
+	}
+}
+
+func (pc *PeerConnection) handleExtensionHandshake(payload []byte) {
+	msg, err := DeserializeExtensionHandshakeMessage(payload)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	log.Debugf("Got an extension handshake message: %+v", msg)
+
+	for ext, msgId := range msg.M {
+		id, ok := msgId.(int)
+		if !ok {
+			continue
 		}
-		log.Debugf("Got an extension handshake message: %+v", msg)
+		// An id of 0 means the peer has disabled the extension
+		if id == 0 {
+			delete(pc.SupportedExtensions, ext)
+			continue
+		}
+		pc.SupportedExtensions[ext] = id
+	}
+	pc.MetadataSize = msg.MetadataSize
+	pc.PeerClient = msg.V
+	pc.PeerListenPort = msg.P
+	pc.PeerReqq = msg.Reqq
+	pc.PeerUploadOnly = msg.UploadOnly
+
+	if msg.YourIp.IsValid() {
+		util.ExternalIP.Vote(pc.PeerInfo.Addr().String(), msg.YourIp)
+	}
 
-		for ext, msgId := range msg.M {
-			be.SupportedExtensions[ext] = msgId.(int)
+	for _, ext := range pc.extensionRegistry().Extensions() {
+		if h, ok := ext.Handler.(ExtensionHandshakeHandler); ok {
+			err := h.HandleExtensionHandshake(pc, msg)
+			if err != nil {
+				log.Warnf("Error handling extension handshake for %s: %s", ext.Name, err)
+			}
 		}
-		be.MetadataSize = msg.MetadataSize
-		return
 	}
-	// metadataId, metadataSpported := be.SupportedExtensions["ut_metadata"]
-	if payload[0] == 3 {
-		be.handleMetadataExtension(payload[1:])
+}
+
+// SendExtensionMessage sends a message for the named extension using the id
+// the peer advertised for it in its handshake
+func (pc *PeerConnection) SendExtensionMessage(name string, payload []byte) error {
+	id, supported := pc.SupportedExtensions[name]
+	if !pc.SupportsExtensions || !supported {
+		return fmt.Errorf("Peer doesn't support the %s extension", name)
 	}
+
+	length := len(payload) + 2
+	buf := make([]byte, 0, length+4)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(length))
+	buf = append(buf, 20)
+	buf = append(buf, byte(id))
+	buf = append(buf, payload...)
+	return pc.send(buf)
+}
+
+func handleMetadataExtensionMessage(pc *PeerConnection, payload []byte) error {
+	pc.handleMetadataExtension(payload)
+	return nil
 }
 
 func (m *BitTorrentExtensions) handleMetadataExtension(payload []byte) {
@@ -67,7 +150,7 @@ func (m *BitTorrentExtensions) handleMetadataExtension(payload []byte) {
 }
 
 func (pc *PeerConnection) getMetadata() ([]byte, error) {
-	metadataMessageId, metadataSupported := pc.SupportedExtensions["ut_metadata"]
+	metadataMessageId, metadataSupported := pc.SupportedExtensions[UtMetadataExtensionName]
 	if !pc.SupportsExtensions || !metadataSupported {
 		return nil, fmt.Errorf("I don't support metdata downloading")
 	}
@@ -1,7 +1,9 @@
 package torrent
 
 import (
+	"net"
 	"os"
+	"strconv"
 	"tor/pkg/bencode"
 )
 
@@ -24,26 +26,57 @@ func ParseTorrentFile(fileName string) (Torrent, error) {
 
 	info := fileDict["info"].(map[string]interface{})
 
+	announce, _ := fileDict["announce"].([]byte)
 	tf := Torrent{
-		Announce: string(fileDict["announce"].([]byte)),
+		Announce: string(announce),
 		Info:     *NewTorrentInfoFromBencodedDict(info),
 	}
 
 	// Optionals
 	// Announce list
-	if _, ok := fileDict["announce-list"]; ok {
+	if announcel, ok := fileDict["announce-list"].([]interface{}); ok {
+		for _, tierI := range announcel {
+			tierL, _ := tierI.([]interface{})
+			tier := make([]string, 0, len(tierL))
+			for _, a := range tierL {
+				if a, ok := a.([]byte); ok {
+					tier = append(tier, string(a))
+				}
+			}
 
-		announcel := fileDict["announce-list"].([]interface{})
-		for _, announce := range announcel {
-			a := announce.([]interface{})[0]
-			tf.AnnounceList = append(tf.AnnounceList, string(a.([]byte)))
+			if len(tier) > 0 {
+				tf.AnnounceList = append(tf.AnnounceList, tier)
+			}
 		}
 	}
 
-	// Url list
-	// if _, ok := fileDict["url-list"]; ok {
-	// 	tf.UrlList = string(fileDict["url-list"].([]byte))
-	// }
+	// Url list, either one URL or a list of them
+	switch urlList := fileDict["url-list"].(type) {
+	case []byte:
+		if len(urlList) > 0 {
+			tf.UrlList = append(tf.UrlList, string(urlList))
+		}
+	case []interface{}:
+		for _, u := range urlList {
+			if u, ok := u.([]byte); ok && len(u) > 0 {
+				tf.UrlList = append(tf.UrlList, string(u))
+			}
+		}
+	}
+
+	// DHT nodes, a list of [host, port] pairs
+	nodes, _ := fileDict["nodes"].([]interface{})
+	for _, n := range nodes {
+		pair, _ := n.([]interface{})
+		if len(pair) != 2 {
+			continue
+		}
+		host, _ := pair[0].([]byte)
+		port, ok := pair[1].(int)
+		if len(host) > 0 && ok {
+			tf.Nodes = append(tf.Nodes, net.JoinHostPort(string(host), strconv.Itoa(port)))
+		}
+	}
 
 	return tf, nil
 }
@@ -0,0 +1,264 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+	"tor/pkg/bencode"
+)
+
+// Biggest tracker response we'll read
+const maxHTTPTrackerResponse = 1 << 20
+
+var httpTrackerClient = &http.Client{Timeout: 15 * time.Second}
+
+// HTTPTracker announces to an http:// or https:// tracker
+type HTTPTracker struct {
+	announceUrl string
+
+	mx sync.Mutex
+	// Sent back to the tracker if it gave us one
+	trackerId string
+}
+
+func NewHTTPTracker(announceUrl string) *HTTPTracker {
+	return &HTTPTracker{announceUrl: announceUrl}
+}
+
+func (t *HTTPTracker) Announce(r AnnounceRequest) (AnnounceResponse, error) {
+	if r.PeerId == [20]byte{} {
+		r.PeerId = GenPeerId()
+	}
+
+	res, err := httpTrackerClient.Get(t.announceQuery(r))
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxHTTPTrackerResponse))
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+
+	ar, err := parseHTTPAnnounceResponse(body)
+	if err != nil {
+		if res.StatusCode != http.StatusOK {
+			return AnnounceResponse{}, fmt.Errorf("Tracker returned %s", res.Status)
+		}
+		return AnnounceResponse{}, err
+	}
+
+	if ar.trackerId != "" {
+		t.mx.Lock()
+		t.trackerId = ar.trackerId
+		t.mx.Unlock()
+	}
+	return ar, nil
+}
+
+// Scrape only works if the announce URL's last path segment starts with
+// announce, it's swapped for scrape
+func (t *HTTPTracker) Scrape(infoHashes ...[20]byte) ([]ScrapeResponse, error) {
+	scrapeUrl, err := t.scrapeUrl(infoHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := httpTrackerClient.Get(scrapeUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxHTTPTrackerResponse))
+	if err != nil {
+		return nil, err
+	}
+
+	sr, err := parseHTTPScrapeResponse(body, infoHashes)
+	if err != nil && res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Tracker returned %s", res.Status)
+	}
+	return sr, err
+}
+
+func (t *HTTPTracker) scrapeUrl(infoHashes [][20]byte) (string, error) {
+	base, query, _ := strings.Cut(t.announceUrl, "?")
+	slash := strings.LastIndex(base, "/")
+	if slash < 0 || !strings.HasPrefix(base[slash+1:], "announce") {
+		return "", fmt.Errorf("Tracker %s doesn't support scrape", t.announceUrl)
+	}
+	base = base[:slash+1] + "scrape" + strings.TrimPrefix(base[slash+1:], "announce")
+
+	q := make([]string, 0, len(infoHashes)+1)
+	if query != "" {
+		q = append(q, query)
+	}
+	for _, ih := range infoHashes {
+		q = append(q, "info_hash="+escapeBinary(ih[:]))
+	}
+	return base + "?" + strings.Join(q, "&"), nil
+}
+
+func (t *HTTPTracker) announceQuery(r AnnounceRequest) string {
+	q := []string{
+		"info_hash=" + escapeBinary(r.InfoHash[:]),
+		"peer_id=" + escapeBinary(r.PeerId[:]),
+		fmt.Sprintf("port=%v", r.Port),
+		fmt.Sprintf("uploaded=%v", r.Uploaded),
+		fmt.Sprintf("downloaded=%v", r.Downloaded),
+		fmt.Sprintf("left=%v", r.Left),
+		"compact=1",
+		fmt.Sprintf("key=%08x", r.Key),
+	}
+
+	if event, ok := eventToString[r.Event]; ok {
+		q = append(q, "event="+event)
+	}
+
+	if r.NumWant >= 0 {
+		q = append(q, fmt.Sprintf("numwant=%v", r.NumWant))
+	}
+
+	t.mx.Lock()
+	if t.trackerId != "" {
+		q = append(q, "trackerid="+escapeBinary([]byte(t.trackerId)))
+	}
+	t.mx.Unlock()
+
+	// Private trackers often put a passkey in the query already
+	sep := "?"
+	if strings.Contains(t.announceUrl, "?") {
+		sep = "&"
+	}
+	return t.announceUrl + sep + strings.Join(q, "&")
+}
+
+// escapeBinary percent encodes everything but the unreserved characters.
+// url.QueryEscape turns spaces into + which not all trackers understand
+// for binary values like info_hash.
+func escapeBinary(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0 {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+func parseHTTPAnnounceResponse(body []byte) (AnnounceResponse, error) {
+	decoded, err := bencode.Decode(body)
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return AnnounceResponse{}, fmt.Errorf("Expected a dictionary from the tracker")
+	}
+
+	if reason, ok := dict["failure reason"].([]byte); ok {
+		return AnnounceResponse{}, fmt.Errorf("Tracker failure: %s", reason)
+	}
+
+	ar := AnnounceResponse{action: 1}
+	if warning, ok := dict["warning message"].([]byte); ok {
+		ar.Warning = string(warning)
+	}
+	if interval, ok := dict["interval"].(int); ok && interval > 0 {
+		ar.interval = uint32(interval)
+	}
+	if minInterval, ok := dict["min interval"].(int); ok && minInterval > 0 {
+		ar.minInterval = uint32(minInterval)
+	}
+	if complete, ok := dict["complete"].(int); ok && complete > 0 {
+		ar.seeders = uint32(complete)
+	}
+	if incomplete, ok := dict["incomplete"].(int); ok && incomplete > 0 {
+		ar.leechers = uint32(incomplete)
+	}
+	if trackerId, ok := dict["tracker id"].([]byte); ok {
+		ar.trackerId = string(trackerId)
+	}
+
+	switch peers := dict["peers"].(type) {
+	case []byte:
+		ar.Peers = ParseCompactPeers(peers, false)
+	case []interface{}:
+		ar.Peers = parseDictPeers(peers)
+	}
+
+	if peers6, ok := dict["peers6"].([]byte); ok {
+		ar.Peers = append(ar.Peers, ParseCompactPeers(peers6, true)...)
+	}
+
+	return ar, nil
+}
+
+func parseHTTPScrapeResponse(body []byte, infoHashes [][20]byte) ([]ScrapeResponse, error) {
+	decoded, err := bencode.Decode(body)
+	if err != nil {
+		return nil, err
+	}
+
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected a dictionary from the tracker")
+	}
+
+	if reason, ok := dict["failure reason"].([]byte); ok {
+		return nil, fmt.Errorf("Tracker failure: %s", reason)
+	}
+
+	files, _ := dict["files"].(map[string]interface{})
+	res := make([]ScrapeResponse, 0, len(infoHashes))
+	for _, ih := range infoHashes {
+		// Torrents the tracker doesn't know are left out
+		file, ok := files[string(ih[:])].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		sr := ScrapeResponse{InfoHash: ih}
+		if complete, ok := file["complete"].(int); ok && complete > 0 {
+			sr.Seeders = uint32(complete)
+		}
+		if downloaded, ok := file["downloaded"].(int); ok && downloaded > 0 {
+			sr.Completed = uint32(downloaded)
+		}
+		if incomplete, ok := file["incomplete"].(int); ok && incomplete > 0 {
+			sr.Leechers = uint32(incomplete)
+		}
+		res = append(res, sr)
+	}
+	return res, nil
+}
+
+// parseDictPeers parses the original non compact peer list, a list of
+// dictionaries with "ip" and "port"
+func parseDictPeers(list []interface{}) []TorrentPeer {
+	peers := make([]TorrentPeer, 0, len(list))
+	for _, p := range list {
+		d, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		ip, _ := d["ip"].([]byte)
+		port, _ := d["port"].(int)
+		addr, err := netip.ParseAddr(string(ip))
+		if err != nil || port <= 0 || port > 65535 {
+			continue
+		}
+		peers = append(peers, NewTorrentPeer(addr, uint16(port)))
+	}
+	return peers
+}
@@ -0,0 +1,168 @@
+package torrent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+	"tor/pkg/bencode"
+)
+
+func newTestHTTPTracker(t *testing.T, handler func(q url.Values) map[string]interface{}) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := bencode.Encode(handler(r.URL.Query()))
+		if err != nil {
+			t.Error(err)
+		}
+		w.Write(b)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestHTTPTrackerAnnounce(t *testing.T) {
+	infoHash := [20]byte{0, ' ', '+', 0xff}
+	peer := NewTorrentPeer(netip.MustParseAddr("10.0.0.1"), 6881)
+	peer6 := NewTorrentPeer(netip.MustParseAddr("2001:db8::1"), 6882)
+
+	var query url.Values
+	s := newTestHTTPTracker(t, func(q url.Values) map[string]interface{} {
+		query = q
+		return map[string]interface{}{
+			"interval":        1800,
+			"min interval":    60,
+			"complete":        3,
+			"incomplete":      4,
+			"tracker id":      []byte("abc"),
+			"warning message": []byte("be nice"),
+			"peers":           peer.Compact(),
+			"peers6":          peer6.Compact(),
+		}
+	})
+
+	tracker := NewHTTPTracker(s.URL + "/announce")
+	r := AnnounceRequest{InfoHash: infoHash, Left: 100, Port: 6881, Event: EventStarted, NumWant: 20}
+	res, err := tracker.Announce(r)
+	handleTestErr(err, t)
+
+	if query.Get("info_hash") != string(infoHash[:]) {
+		t.Errorf("info_hash wasn't encoded properly, got: %x", query.Get("info_hash"))
+	}
+
+	expected := map[string]string{"port": "6881", "left": "100", "event": "started", "compact": "1", "numwant": "20"}
+	for k, v := range expected {
+		if query.Get(k) != v {
+			t.Errorf("expected %s=%s but got: %s", k, v, query.Get(k))
+		}
+	}
+
+	if len(res.Peers) != 2 || res.Peers[0] != peer || res.Peers[1] != peer6 {
+		t.Errorf("expected peers %v and %v but got: %v", peer, peer6, res.Peers)
+	}
+
+	if res.interval != 1800 || res.minInterval != 60 || res.seeders != 3 || res.leechers != 4 {
+		t.Errorf("unexpected announce response: %+v", res)
+	}
+
+	if res.Warning != "be nice" {
+		t.Errorf("expected the warning message but got: %s", res.Warning)
+	}
+
+	// The tracker id should be sent back on the next announce
+	_, err = tracker.Announce(r)
+	handleTestErr(err, t)
+	if query.Get("trackerid") != "abc" {
+		t.Errorf("expected trackerid=abc but got: %s", query.Get("trackerid"))
+	}
+}
+
+func TestHTTPTrackerDictPeers(t *testing.T) {
+	s := newTestHTTPTracker(t, func(q url.Values) map[string]interface{} {
+		return map[string]interface{}{
+			"interval": 1800,
+			"peers": []interface{}{
+				map[string]interface{}{"peer id": []byte("01234567890123456789"), "ip": []byte("10.0.0.2"), "port": 51413},
+				map[string]interface{}{"ip": []byte("2001:db8::2"), "port": 6881},
+				map[string]interface{}{"ip": []byte("not an ip"), "port": 6881},
+			},
+		}
+	})
+
+	res, err := NewHTTPTracker(s.URL).Announce(AnnounceRequest{NumWant: -1})
+	handleTestErr(err, t)
+
+	if len(res.Peers) != 2 || res.Peers[0].String() != "10.0.0.2:51413" || res.Peers[1].String() != "[2001:db8::2]:6881" {
+		t.Errorf("unexpected dictionary peers: %v", res.Peers)
+	}
+}
+
+func TestHTTPTrackerFailure(t *testing.T) {
+	s := newTestHTTPTracker(t, func(q url.Values) map[string]interface{} {
+		return map[string]interface{}{"failure reason": []byte("unregistered torrent")}
+	})
+
+	_, err := NewHTTPTracker(s.URL).Announce(AnnounceRequest{})
+	if err == nil || err.Error() != "Tracker failure: unregistered torrent" {
+		t.Errorf("expected the failure reason as an error but got: %v", err)
+	}
+}
+
+func TestHTTPTrackerKeepsExistingQuery(t *testing.T) {
+	var query url.Values
+	s := newTestHTTPTracker(t, func(q url.Values) map[string]interface{} {
+		query = q
+		return map[string]interface{}{"interval": 1800}
+	})
+
+	_, err := NewHTTPTracker(s.URL + "/announce?passkey=secret").Announce(AnnounceRequest{})
+	handleTestErr(err, t)
+
+	if query.Get("passkey") != "secret" || query.Get("info_hash") == "" {
+		t.Errorf("expected the passkey and announce query but got: %v", query)
+	}
+}
+
+func TestHTTPTrackerScrape(t *testing.T) {
+	known := [20]byte{1}
+	var query url.Values
+	var path string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, path = r.URL.Query(), r.URL.Path
+		b, _ := bencode.Encode(map[string]interface{}{
+			"files": map[string]interface{}{
+				string(known[:]): map[string]interface{}{"complete": 5, "downloaded": 50, "incomplete": 10},
+			},
+		})
+		w.Write(b)
+	}))
+	defer s.Close()
+
+	res, err := NewHTTPTracker(s.URL+"/announce.php?passkey=secret").Scrape(known, [20]byte{2})
+	handleTestErr(err, t)
+
+	if path != "/scrape.php" || query.Get("passkey") != "secret" || len(query["info_hash"]) != 2 {
+		t.Errorf("unexpected scrape request to %s with: %v", path, query)
+	}
+
+	expected := ScrapeResponse{InfoHash: known, Seeders: 5, Completed: 50, Leechers: 10}
+	if len(res) != 1 || res[0] != expected {
+		t.Errorf("expected only %+v but got: %+v", expected, res)
+	}
+
+	if _, err := NewHTTPTracker(s.URL + "/tracker").Scrape(known); err == nil {
+		t.Errorf("scrape should fail when the URL doesn't end in announce")
+	}
+}
+
+func TestNewTracker(t *testing.T) {
+	tracker, err := NewTracker("https://tracker.example.com/announce")
+	handleTestErr(err, t)
+	if _, ok := tracker.(*HTTPTracker); !ok {
+		t.Errorf("expected an HTTP tracker but got: %T", tracker)
+	}
+
+	if _, err := NewTracker("wss://tracker.example.com"); err == nil {
+		t.Errorf("unsupported schemes should fail")
+	}
+}
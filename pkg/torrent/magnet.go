@@ -2,6 +2,7 @@ package torrent
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
@@ -9,7 +10,6 @@ import (
 	"os"
 	"strings"
 	"tor/pkg/bencode"
-	"tor/pkg/util"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -18,10 +18,23 @@ type MagnetUri struct {
 	InfoHash    [20]byte
 	DisplayName string
 	Trackers    []string
+
+	// Updatable torrents (BEP 46) are published in the DHT under a public
+	// key and salt, InfoHash is empty until the magnet's resolved
+	PublicKey ed25519.PublicKey
+	Salt      []byte
 }
 
 const MagnetUriPrefix = "magnet:?"
 
+// DHTPeerFetcher gives a DHT peer fetcher for a torrent, it's set when a DHT
+// node is running so magnets without trackers can still find peers
+var DHTPeerFetcher func(infoHash [20]byte) PeerFetcher
+
+// DHTTorrentResolver looks up the current info hash of an updatable torrent,
+// it's set when a DHT node is running
+var DHTTorrentResolver func(k ed25519.PublicKey, salt []byte) ([20]byte, error)
+
 func ParseMagnetUri(uri string) (*MagnetUri, error) {
 	if !strings.HasPrefix(uri, MagnetUriPrefix) {
 		return nil, fmt.Errorf("Uri doesn't start with %s", MagnetUriPrefix)
@@ -42,6 +55,26 @@ func ParseMagnetUri(uri string) (*MagnetUri, error) {
 				return nil, err
 			}
 			copy(ret.InfoHash[:], hash)
+		case "xs":
+			for _, xs := range v {
+				if !strings.HasPrefix(xs, btpkPrefix) {
+					continue
+				}
+				key, err := hex.DecodeString(xs[len(btpkPrefix):])
+				if err != nil {
+					return nil, err
+				}
+				if len(key) != ed25519.PublicKeySize {
+					return nil, fmt.Errorf("Unexpected public key length")
+				}
+				ret.PublicKey = key
+			}
+		case "s":
+			salt, err := hex.DecodeString(v[0])
+			if err != nil {
+				return nil, err
+			}
+			ret.Salt = salt
 		case "dn":
 			ret.DisplayName = v[0]
 		case "tr":
@@ -51,6 +84,27 @@ func ParseMagnetUri(uri string) (*MagnetUri, error) {
 	return &ret, nil
 }
 
+const btpkPrefix = "urn:btpk:"
+
+// Updatable is whether the magnet is for a torrent published under a key
+func (m *MagnetUri) Updatable() bool {
+	return m.PublicKey != nil
+}
+
+// Resolve sets the info hash of an updatable magnet to the torrent currently
+// published under its key
+func (m *MagnetUri) Resolve() error {
+	if DHTTorrentResolver == nil {
+		return fmt.Errorf("Updatable magnets need the DHT")
+	}
+	infoHash, err := DHTTorrentResolver(m.PublicKey, m.Salt)
+	if err != nil {
+		return fmt.Errorf("Couldn't resolve %x: %w", m.PublicKey, err)
+	}
+	m.InfoHash = infoHash
+	return nil
+}
+
 func GetHashFromXt(xt string) ([]byte, error) {
 	parts := strings.Split(xt, ":")
 	if len(parts) != 3 {
@@ -79,38 +133,35 @@ func GetMetadataFromMagnetUri(uriString string) (*TorrentInfo, error) {
 		log.Error(err)
 		return nil, err
 	}
+	return GetMetadataFromMagnet(uri)
+}
 
-	r := AnnounceRequest{
-		InfoHash: uri.InfoHash,
-		Left:     100,
-		NumWant:  -1,
-		Port:     6881,
+// GetMetadataFromMagnet gets the info dict from the magnet's peers, resolving
+// it first if it's updatable
+func GetMetadataFromMagnet(uri *MagnetUri) (*TorrentInfo, error) {
+	if uri.Updatable() && uri.InfoHash == [20]byte{} {
+		if err := uri.Resolve(); err != nil {
+			return nil, err
+		}
 	}
+
 	peerId := GenPeerId()
-	addrs := util.GetLiveTrackerAddressesFromUrls(uri.Trackers)
-	if len(addrs) == 0 {
-		err = fmt.Errorf("No live adresses in magnet URI, could use DHT, but IDK how to right now")
-		return nil, err
+	var peers []TorrentPeer
+	if trackerUrls := LiveTrackerUrls(uri.Trackers); len(trackerUrls) > 0 {
+		peers = append(peers, NewTrackersPeerFetcher(uri.InfoHash, trackerUrls).GetPeers()...)
+	}
+	if DHTPeerFetcher != nil {
+		peers = append(peers, DHTPeerFetcher(uri.InfoHash).GetPeers()...)
 	}
 
-	for _, addr := range addrs {
-		c, err := NewUDPTrackerConn(addr)
-		if err != nil {
-			log.Warn(err)
-			continue
-		}
-		res, err := c.Announce(r)
-
-		if err != nil {
-			log.Warn(err)
-			continue
-		}
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("Couldn't find any peers from the magnet's trackers or the DHT")
+	}
 
-		for _, peer := range res.Peers {
-			torrentInfo := getMetadataFromPeer(peer, peerId, uri.InfoHash)
-			if torrentInfo != nil {
-				return torrentInfo, nil
-			}
+	for _, peer := range peers {
+		torrentInfo := getMetadataFromPeer(peer, peerId, uri.InfoHash)
+		if torrentInfo != nil {
+			return torrentInfo, nil
 		}
 	}
 	return nil, fmt.Errorf("Couldn't find any peers that I could download from")
@@ -31,3 +31,25 @@ func TestParseMagnetUri(t *testing.T) {
 		t.Errorf("Unexpected number of trackers")
 	}
 }
+
+func TestParseUpdatableMagnetUri(t *testing.T) {
+	key := "8543d3e6115f0f98c944077a4493dcd543e49c739fd998550a1f614ab36ed63e"
+	uri, err := ParseMagnetUri("magnet:?xs=urn:btpk:" + key + "&s=6e616d65")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !uri.Updatable() || hex.EncodeToString(uri.PublicKey) != key {
+		t.Errorf("Unexpected public key: %x", uri.PublicKey)
+	}
+	if string(uri.Salt) != "name" {
+		t.Errorf("Unexpected salt: %s", uri.Salt)
+	}
+	if uri.InfoHash != [20]byte{} {
+		t.Errorf("The info hash isn't known until it's resolved")
+	}
+
+	if _, err := ParseMagnetUri("magnet:?xs=urn:btpk:8543d3e6"); err == nil {
+		t.Errorf("Expected short keys to be rejected")
+	}
+}
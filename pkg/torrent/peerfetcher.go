@@ -1,7 +1,13 @@
 package torrent
 
 import (
+	"errors"
+	"fmt"
 	"math/rand"
+	"net"
+	"net/url"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -11,83 +17,403 @@ type PeerFetcher interface {
 	GetPeers() []TorrentPeer
 }
 
-type UDPTracker struct {
-	trackerAddresses []string
-	infoHash         [20]byte
+// Tracker announces to a single UDP or HTTP tracker
+type Tracker interface {
+	Announce(r AnnounceRequest) (AnnounceResponse, error)
+	Scrape(infoHashes ...[20]byte) ([]ScrapeResponse, error)
 }
 
-type Tracker interface {
-	AnnounceAndGetPeers() []TorrentPeer
+// NewTracker picks the tracker client from the announce URL's scheme
+func NewTracker(trackerUrl string) (Tracker, error) {
+	u, err := url.Parse(trackerUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "udp":
+		udpAddr, err := net.ResolveUDPAddr("udp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		if udpAddr.IP.IsLoopback() {
+			return nil, fmt.Errorf("Resolved to self so skipping")
+		}
+		return NewUDPTracker(u.Host), nil
+	case "http", "https":
+		return NewHTTPTracker(trackerUrl), nil
+	}
+	return nil, fmt.Errorf("Unsupported tracker scheme: %s", u.Scheme)
 }
 
-type TrackersPeerFetcher struct {
-	trackerAddresses []string
-	infoHash         [20]byte
+// AnnounceStats are the transfer totals reported to trackers
+type AnnounceStats struct {
+	Uploaded   uint64
+	Downloaded uint64
+	Left       uint64
+}
+
+// AnnounceStatsSetter is implemented by peer fetchers that announce to
+// trackers so they can report the session's transfer totals
+type AnnounceStatsSetter interface {
+	SetAnnounceStats(stats func() AnnounceStats)
+}
+
+// SwarmScraper is a PeerFetcher that can ask about the torrent's swarm
+type SwarmScraper interface {
+	Scrape() (ScrapeResponse, error)
+}
+
+// DecentralisedPeerFetcher finds peers without asking the torrent's
+// trackers e.g. DHT or LSD, private torrents don't use them
+type DecentralisedPeerFetcher interface {
+	PeerFetcher
+	Decentralised()
 }
 
-func NewTrackersPeerFetcher(infoHash [20]byte, trackerAddresses []string) *TrackersPeerFetcher {
-	return &TrackersPeerFetcher{
-		infoHash:         infoHash,
-		trackerAddresses: trackerAddresses,
+// MultiPeerFetcher gets peers from all of its fetchers
+type MultiPeerFetcher []PeerFetcher
+
+func (m MultiPeerFetcher) GetPeers() []TorrentPeer {
+	peers := []TorrentPeer{}
+	for _, f := range m {
+		peers = append(peers, f.GetPeers()...)
 	}
+	return peers
 }
 
-func (fetcher TrackersPeerFetcher) GetPeers() []TorrentPeer {
-	r := AnnounceRequest{
-		InfoHash: fetcher.infoHash,
-		Left:     1,
-		NumWant:  -1,
-		Port:     6881,
+// Run runs the fetchers that keep finding peers and connects to the peers
+// the others give once
+func (m MultiPeerFetcher) Run(s PeerSession, stop <-chan struct{}) {
+	var wg sync.WaitGroup
+	for _, f := range m {
+		wg.Add(1)
+		go func(f PeerFetcher) {
+			defer wg.Done()
+			if sf, ok := f.(SessionPeerFetcher); ok {
+				sf.Run(s, stop)
+			} else {
+				s.AddPeers(f.GetPeers())
+			}
+		}(f)
 	}
+	wg.Wait()
+}
 
-	peers := []TorrentPeer{}
+func (m MultiPeerFetcher) SetAnnounceStats(stats func() AnnounceStats) {
+	for _, f := range m {
+		if s, ok := f.(AnnounceStatsSetter); ok {
+			s.SetAnnounceStats(stats)
+		}
+	}
+}
 
-	for addressesTried := 0; len(peers) < 50 && addressesTried < 5; addressesTried++ {
-		c, err := NewUDPTrackerConn(fetcher.trackerAddresses[rand.Intn(len(fetcher.trackerAddresses))])
-		if err != nil {
-			log.Warn(err)
-			continue
+// Scrape uses the first fetcher that can scrape
+func (m MultiPeerFetcher) Scrape() (ScrapeResponse, error) {
+	for _, f := range m {
+		if s, ok := f.(SwarmScraper); ok {
+			return s.Scrape()
 		}
-		res, err := c.Announce(r)
-		if err != nil {
-			log.Warn(err)
-			continue
+	}
+	return ScrapeResponse{}, errors.New("No peer fetchers can scrape")
+}
 
+// withoutDecentralised drops the fetchers that don't use the torrent's
+// trackers
+func withoutDecentralised(pf PeerFetcher) PeerFetcher {
+	switch f := pf.(type) {
+	case DecentralisedPeerFetcher:
+		return MultiPeerFetcher{}
+	case MultiPeerFetcher:
+		kept := MultiPeerFetcher{}
+		for _, sub := range f {
+			if _, ok := sub.(DecentralisedPeerFetcher); !ok {
+				kept = append(kept, withoutDecentralised(sub))
+			}
 		}
+		return kept
+	}
+	return pf
+}
+
+// Announce to a tracker in every tier rather than just the first that works
+var AnnounceToAllTiers = false
+
+type TrackersPeerFetcher struct {
+	infoHash [20]byte
+	// Same for every announce so trackers can recognise us
+	peerId [20]byte
+	key    uint32
+	stats  func() AnnounceStats
+	health *TrackerHealthChecker
+
+	mx sync.Mutex
+	// Tracker URLs in BEP 12 tiers, the last one that worked is first in its tier
+	tiers [][]string
+	// Kept so UDP connection ids are reused
+	trackers map[string]Tracker
+	started  map[string]bool
+	// When trackers that failed will be announced to again
+	retryAt map[string]time.Time
+}
+
+// NewTrackersPeerFetcher treats all the trackers as a single tier
+func NewTrackersPeerFetcher(infoHash [20]byte, trackerUrls []string) *TrackersPeerFetcher {
+	return NewTieredTrackersPeerFetcher(infoHash, [][]string{trackerUrls})
+}
 
-		for _, peer := range res.Peers {
-			peers = append(peers, peer)
+func NewTieredTrackersPeerFetcher(infoHash [20]byte, tiers [][]string) *TrackersPeerFetcher {
+	fetcher := &TrackersPeerFetcher{
+		infoHash: infoHash,
+		peerId:   GenPeerId(),
+		key:      rand.Uint32(),
+		health:   DefaultTrackerHealth,
+		trackers: make(map[string]Tracker),
+		started:  make(map[string]bool),
+		retryAt:  make(map[string]time.Time),
+	}
+
+	for _, tier := range tiers {
+		if len(tier) == 0 {
+			continue
+		}
+
+		shuffled := append([]string{}, tier...)
+		rand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		// Trackers we know work well go first, the rest stay shuffled
+		fetcher.tiers = append(fetcher.tiers, fetcher.health.Sort(shuffled))
+	}
+	return fetcher
+}
+
+func (fetcher *TrackersPeerFetcher) SetAnnounceStats(stats func() AnnounceStats) {
+	fetcher.mx.Lock()
+	defer fetcher.mx.Unlock()
+	fetcher.stats = stats
+}
+
+func (fetcher *TrackersPeerFetcher) GetPeers() []TorrentPeer {
+	peers := []TorrentPeer{}
+	addressesTried := 0
+
+	for tier := 0; tier < fetcher.numTiers(); tier++ {
+		for _, trackerUrl := range fetcher.tierUrls(tier) {
+			if len(peers) >= 50 || addressesTried >= 5 {
+				return peers
+			}
+			addressesTried++
+
+			res, err := fetcher.announceTo(trackerUrl, fetcher.announceRequest(trackerUrl))
+			if err != nil {
+				log.Warn(err)
+				continue
+			}
+			fetcher.promote(tier, trackerUrl)
+
+			if res.Warning != "" {
+				log.Warnf("Warning from tracker %s: %s", trackerUrl, res.Warning)
+			}
+
+			for _, peer := range res.Peers {
+				peers = append(peers, peer)
+			}
 		}
 	}
 	return peers
 }
 
-func (t UDPTracker) AnnounceAndGetPeers() []TorrentPeer {
-	r := AnnounceRequest{
-		InfoHash: t.infoHash,
-		Left:     1,
-		NumWant:  -1,
-		Port:     6881,
+// announceTo announces to a single tracker, a tracker that hasn't heard
+// from us yet gets started rather than no event
+func (fetcher *TrackersPeerFetcher) announceTo(trackerUrl string, r AnnounceRequest) (AnnounceResponse, error) {
+	t, err := fetcher.tracker(trackerUrl)
+	if err != nil {
+		return AnnounceResponse{}, fmt.Errorf("%s: %w", trackerUrl, err)
 	}
 
-	peers := []TorrentPeer{}
+	fetcher.mx.Lock()
+	if r.Event == EventNone && !fetcher.started[trackerUrl] {
+		r.Event = EventStarted
+	}
+	fetcher.mx.Unlock()
 
-	for addressesTried := 0; len(peers) < 50 && addressesTried < 5; addressesTried++ {
-		c, err := NewUDPTrackerConn(t.trackerAddresses[rand.Intn(len(t.trackerAddresses))])
-		if err != nil {
-			log.Warn(err)
-			continue
+	start := time.Now()
+	res, err := t.Announce(r)
+	fetcher.health.Record(trackerUrl, time.Since(start), err)
+	if err != nil {
+		return res, fmt.Errorf("%s: %w", trackerUrl, err)
+	}
+
+	fetcher.mx.Lock()
+	if r.Event == EventStopped {
+		delete(fetcher.started, trackerUrl)
+	} else {
+		fetcher.started[trackerUrl] = true
+	}
+	fetcher.mx.Unlock()
+	return res, nil
+}
+
+// Scrape asks the trackers in tier order until one knows about the torrent
+func (fetcher *TrackersPeerFetcher) Scrape() (ScrapeResponse, error) {
+	var errs []error
+	for tier := 0; tier < fetcher.numTiers(); tier++ {
+		for _, trackerUrl := range fetcher.tierUrls(tier) {
+			t, err := fetcher.tracker(trackerUrl)
+			if err == nil {
+				var res []ScrapeResponse
+				res, err = t.Scrape(fetcher.infoHash)
+				if err == nil && len(res) == 0 {
+					err = errors.New("Tracker doesn't know the torrent")
+				}
+				if err == nil {
+					return res[0], nil
+				}
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", trackerUrl, err))
 		}
-		res, err := c.Announce(r)
-		if err != nil {
-			log.Warn(err)
-			continue
+	}
+
+	if len(errs) == 0 {
+		return ScrapeResponse{}, errors.New("No trackers to scrape")
+	}
+	return ScrapeResponse{}, errors.Join(errs...)
+}
 
+func (fetcher *TrackersPeerFetcher) numTiers() int {
+	fetcher.mx.Lock()
+	defer fetcher.mx.Unlock()
+	return len(fetcher.tiers)
+}
+
+// tierUrls copies a tier so it can be walked while trackers are promoted,
+// trackers that keep failing are left until last
+func (fetcher *TrackersPeerFetcher) tierUrls(tier int) []string {
+	fetcher.mx.Lock()
+	urls := append([]string{}, fetcher.tiers[tier]...)
+	fetcher.mx.Unlock()
+	return fetcher.health.healthyFirst(urls)
+}
+
+// promote moves a tracker that answered to the front of its tier
+func (fetcher *TrackersPeerFetcher) promote(tier int, trackerUrl string) {
+	fetcher.mx.Lock()
+	defer fetcher.mx.Unlock()
+
+	urls := fetcher.tiers[tier]
+	for i, u := range urls {
+		if u == trackerUrl {
+			copy(urls[1:i+1], urls[:i])
+			urls[0] = trackerUrl
+			return
 		}
+	}
+}
 
-		for _, peer := range res.Peers {
-			peers = append(peers, peer)
+func (fetcher *TrackersPeerFetcher) setRetryAt(trackerUrl string, retryAt time.Time) {
+	fetcher.mx.Lock()
+	defer fetcher.mx.Unlock()
+	if retryAt.IsZero() {
+		delete(fetcher.retryAt, trackerUrl)
+	} else {
+		fetcher.retryAt[trackerUrl] = retryAt
+	}
+}
+
+// inUse is whether a tracker is the one to announce to in its tier, the first
+// that isn't waiting to retry (BEP 12). Later tiers are only used while every
+// tracker in the ones before is waiting, unless AnnounceToAllTiers is set
+func (fetcher *TrackersPeerFetcher) inUse(trackerUrl string, now time.Time) bool {
+	for tier := 0; tier < fetcher.numTiers(); tier++ {
+		current := ""
+		for _, u := range fetcher.tierUrls(tier) {
+			fetcher.mx.Lock()
+			retryAt := fetcher.retryAt[u]
+			fetcher.mx.Unlock()
+			if !now.Before(retryAt) {
+				current = u
+				break
+			}
+		}
+
+		if current == trackerUrl {
+			return true
+		}
+		if current != "" && !AnnounceToAllTiers {
+			return false
 		}
 	}
-	return peers
+	return false
+}
+
+func (fetcher *TrackersPeerFetcher) tracker(trackerUrl string) (Tracker, error) {
+	fetcher.mx.Lock()
+	t, ok := fetcher.trackers[trackerUrl]
+	fetcher.mx.Unlock()
+	if ok {
+		return t, nil
+	}
+
+	// Resolving can be slow so it's done without holding the lock
+	t, err := NewTracker(trackerUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	fetcher.mx.Lock()
+	defer fetcher.mx.Unlock()
+	if existing, ok := fetcher.trackers[trackerUrl]; ok {
+		// Another announce got there first, keep the one it's using
+		return existing, nil
+	}
+	fetcher.trackers[trackerUrl] = t
+	return t, nil
+}
+
+func (fetcher *TrackersPeerFetcher) announceRequest(trackerUrl string) AnnounceRequest {
+	fetcher.mx.Lock()
+	stats := AnnounceStats{Left: 1}
+	if fetcher.stats != nil {
+		stats = fetcher.stats()
+	}
+
+	event := EventNone
+	if !fetcher.started[trackerUrl] {
+		event = EventStarted
+	}
+	fetcher.mx.Unlock()
+
+	return fetcher.newAnnounceRequest(stats, event)
+}
+
+func (fetcher *TrackersPeerFetcher) newAnnounceRequest(stats AnnounceStats, event uint32) AnnounceRequest {
+	return AnnounceRequest{
+		InfoHash:   fetcher.infoHash,
+		PeerId:     fetcher.peerId,
+		Key:        fetcher.key,
+		Uploaded:   stats.Uploaded,
+		Downloaded: stats.Downloaded,
+		Left:       stats.Left,
+		Event:      event,
+		NumWant:    -1,
+		Port:       uint16(ListenPort),
+	}
+}
+
+// Run keeps announcing until stop is closed. Each tracker has its own
+// announcer but only the first working one in a tier is used, and only the
+// first working tier unless AnnounceToAllTiers is set
+func (fetcher *TrackersPeerFetcher) Run(s PeerSession, stop <-chan struct{}) {
+	var wg sync.WaitGroup
+	for tier := 0; tier < fetcher.numTiers(); tier++ {
+		for _, trackerUrl := range fetcher.tierUrls(tier) {
+			a := newTrackerAnnouncer(tier, trackerUrl, fetcher, s)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				a.run(stop)
+			}()
+		}
+	}
+	wg.Wait()
 }
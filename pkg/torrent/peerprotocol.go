@@ -10,9 +10,12 @@ import (
 	"io"
 	"math"
 	"net"
+	"net/netip"
 	"os"
-	"strings"
+	"sync/atomic"
 	"time"
+	"tor/pkg/mse"
+	"tor/pkg/util"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -20,10 +23,21 @@ import (
 const PSTR = "BitTorrent protocol"
 const MaxQueuedRequests = 10
 
+// Sent as "v" in the extension handshake
+const ClientVersion = "tor 0.1"
+
+// How many requests we'll queue from a peer, sent as "reqq"
+const MaxPeerRequests = 250
+
+// Port we accept peer connections on
+var ListenPort = 6881
+
+// Whether peer connections use Message Stream Encryption
+var EncryptionPolicy = mse.Preferred
+
 type PeerInfo struct {
-	// Peer Info
-	Ipaddr string
-	Port   string
+	// Peer address, IPv4 addresses are never IPv4-mapped IPv6
+	netip.AddrPort
 }
 
 type PeerConnection struct {
@@ -34,6 +48,8 @@ type PeerConnection struct {
 	PeerInterested bool
 	PeerInfo       PeerInfo
 	NodeBitfield   *ThreadSafeBitfield
+	// Tell the peer we're only uploading e.g. when seeding
+	UploadOnly bool
 
 	// Client info
 	ClientPeerId [20]byte
@@ -48,16 +64,25 @@ type PeerConnection struct {
 	PieceRequestState
 	BitTorrentExtensions
 
+	// Extensions we advertise and dispatch to, DefaultExtensionRegistry if nil
+	Extensions *ExtensionRegistry
+
+	// Blocks the peer asked for that we haven't sent, at most MaxPeerRequests
+	peerRequests []blockRequest
+
 	pieceCache *PieceCache
 	conn       net.Conn
+	// Session counter for bytes we've sent in pieces
+	uploaded *atomic.Int64
 }
 
 func PeerInfoFromAddress(addr string) PeerInfo {
-	p := strings.Split(addr, ":")
-	return PeerInfo{
-		Ipaddr: p[0],
-		Port:   p[1],
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		log.Warnf("Couldn't parse peer address %s: %s", addr, err)
+		return PeerInfo{}
 	}
+	return PeerInfo{netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())}
 }
 
 type BlockState uint8
@@ -68,6 +93,10 @@ const (
 	HAVE          BlockState = 2
 )
 
+type blockRequest struct {
+	index, begin, length int
+}
+
 type PieceRequestState struct {
 	PieceIndex       int
 	BlockSize        int
@@ -125,9 +154,33 @@ func (pc *PeerConnection) TryConnect() error {
 		return nil
 	}
 
-	log.Debugf("Trying to Connect: %s:%s\n", pc.PeerInfo.Ipaddr, pc.PeerInfo.Port)
+	addr := pc.PeerInfo.String()
+	log.Debugf("Trying to Connect: %s\n", addr)
 
-	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%s", pc.PeerInfo.Ipaddr, pc.PeerInfo.Port), 500*time.Millisecond)
+	conn, err := dialPeer(addr)
+	if err != nil {
+		return err
+	}
+
+	if EncryptionPolicy == mse.Disabled {
+		pc.conn = conn
+		return nil
+	}
+
+	encryptedConn, err := mse.Initiate(conn, pc.InfoHash, EncryptionPolicy)
+	if err == nil {
+		log.Debugf("Negotiated %v encryption with %s", encryptedConn.Method(), addr)
+		pc.conn = encryptedConn
+		return nil
+	}
+	conn.Close()
+
+	if EncryptionPolicy == mse.Required {
+		return err
+	}
+
+	log.Debugf("Encrypted handshake with %s failed, retrying with plaintext: %s", addr, err)
+	conn, err = dialPeer(addr)
 	if err != nil {
 		return err
 	}
@@ -220,7 +273,10 @@ func (pc *PeerConnection) ReadAndHandleMessage() error {
 		log.Warnf("Error reading message %s\n", err)
 		return err
 	}
-	return pc.HandleMessage(msg)
+	if err := pc.HandleMessage(msg); err != nil {
+		return err
+	}
+	return pc.servePeerRequests()
 }
 
 func (pc *PeerConnection) ReadAndHandleMessages() error {
@@ -228,7 +284,7 @@ func (pc *PeerConnection) ReadAndHandleMessages() error {
 		msg, err := pc.ReadMessage(1 * time.Second)
 		if err != nil {
 			if errors.Is(err, os.ErrDeadlineExceeded) {
-				return nil
+				return pc.servePeerRequests()
 			}
 			log.Warnf("Error reading message %s\n", err)
 			return err
@@ -238,7 +294,6 @@ func (pc *PeerConnection) ReadAndHandleMessages() error {
 			return err
 		}
 	}
-	return nil
 }
 
 func (pc *PeerConnection) HandleMessage(msg []byte) error {
@@ -357,7 +412,23 @@ func (pc *PeerConnection) SendNotInterested() error {
 }
 
 func (pc *PeerConnection) SendExtensionHandshake() error {
-	m := ExtensionHandshakeMessage{M: map[string]interface{}{"ut_metadata": 3}}
+	m := ExtensionHandshakeMessage{
+		M:          pc.extensionRegistry().HandshakeM(),
+		V:          ClientVersion,
+		P:          ListenPort,
+		Reqq:       MaxPeerRequests,
+		UploadOnly: pc.UploadOnly,
+	}
+
+	if addrPort, err := netip.ParseAddrPort(pc.conn.RemoteAddr().String()); err == nil {
+		m.YourIp = addrPort.Addr().Unmap()
+	}
+	if ip, ok := util.ExternalIP.GetFamily(false); ok {
+		m.Ipv4 = ip
+	}
+	if ip, ok := util.ExternalIP.GetFamily(true); ok {
+		m.Ipv6 = ip
+	}
 	return pc.send(m.Serialize())
 }
 
@@ -380,7 +451,11 @@ func (pc *PeerConnection) SendPiece(index, begin, length int) error {
 	binary.BigEndian.PutUint32(msg[5:], uint32(index))
 	binary.BigEndian.PutUint32(msg[9:], uint32(begin))
 	copy(msg[13:], block)
-	return pc.send(msg)
+	err := pc.send(msg)
+	if err == nil && pc.uploaded != nil {
+		pc.uploaded.Add(int64(len(block)))
+	}
+	return err
 }
 
 func (pc *PeerConnection) handleHandshakeResponse(msg []byte) error {
@@ -503,7 +578,23 @@ func (pc *PeerConnection) handleRequest(payload []byte) {
 	begin := binary.BigEndian.Uint32(payload[4:])
 	length := binary.BigEndian.Uint32(payload[8:])
 	log.Debugf("Got Request for index: %v begin: %v length: %v \n", index, begin, length)
-	pc.SendPiece(int(index), int(begin), int(length))
+	if len(pc.peerRequests) >= MaxPeerRequests {
+		log.Debugf("Dropping request from %s, it has %v queued", pc.PeerInfo, len(pc.peerRequests))
+		return
+	}
+	pc.peerRequests = append(pc.peerRequests, blockRequest{int(index), int(begin), int(length)})
+}
+
+// servePeerRequests sends the blocks the peer asked for that weren't cancelled
+func (pc *PeerConnection) servePeerRequests() error {
+	requests := pc.peerRequests
+	pc.peerRequests = nil
+	for _, r := range requests {
+		if err := pc.SendPiece(r.index, r.begin, r.length); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (pc *PeerConnection) handlePiece(payload []byte) {
@@ -523,6 +614,14 @@ func (pc *PeerConnection) handleCancel(payload []byte) {
 	begin := binary.BigEndian.Uint32(payload[4:])
 	length := binary.BigEndian.Uint32(payload[8:])
 	log.Debugf("Got Cancel for index: %v begin: %v length: %v \n", index, begin, length)
+
+	cancelled := blockRequest{int(index), int(begin), int(length)}
+	for i, r := range pc.peerRequests {
+		if r == cancelled {
+			pc.peerRequests = append(pc.peerRequests[:i], pc.peerRequests[i+1:]...)
+			return
+		}
+	}
 }
 
 func (pc *PeerConnection) getPiece(pieceIndex int, pieceSize int) ([]byte, error) {
@@ -538,7 +637,7 @@ func (pc *PeerConnection) getPiece(pieceIndex int, pieceSize int) ([]byte, error
 	pc.Requesting = true
 	nextRequest := 0
 	for {
-		if pc.BlocksRequesting < MaxQueuedRequests && nextRequest < blocksRequired {
+		if pc.BlocksRequesting < pc.maxQueuedRequests() && nextRequest < blocksRequired {
 			if nextRequest == blocksRequired-1 {
 				blockSize = pieceSize - nextRequest*pc.BlockSize
 			}
@@ -561,6 +660,15 @@ func (pc *PeerConnection) getPiece(pieceIndex int, pieceSize int) ([]byte, error
 	return pc.Piece, nil
 }
 
+// maxQueuedRequests is how many block requests we pipeline, bounded by the
+// reqq the peer sent in its extension handshake
+func (pc *PeerConnection) maxQueuedRequests() int {
+	if pc.PeerReqq > 0 && pc.PeerReqq < MaxQueuedRequests {
+		return pc.PeerReqq
+	}
+	return MaxQueuedRequests
+}
+
 func (pc *PeerConnection) gotAllBlocks() bool {
 	for _, bs := range pc.BlocksState {
 		if bs == REQUESTED {
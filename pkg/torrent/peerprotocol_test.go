@@ -0,0 +1,31 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func blockMessage(id byte, index, begin, length int) []byte {
+	msg := make([]byte, 17)
+	binary.BigEndian.PutUint32(msg, 13)
+	msg[4] = id
+	binary.BigEndian.PutUint32(msg[5:], uint32(index))
+	binary.BigEndian.PutUint32(msg[9:], uint32(begin))
+	binary.BigEndian.PutUint32(msg[13:], uint32(length))
+	return msg
+}
+
+func TestPeerRequestsAreCappedAtReqq(t *testing.T) {
+	pc := &PeerConnection{}
+	for i := 0; i < MaxPeerRequests+5; i++ {
+		handleTestErr(pc.HandleMessage(blockMessage(6, i, 0, 16384)), t)
+	}
+	if len(pc.peerRequests) != MaxPeerRequests {
+		t.Fatalf("Expected %v queued requests but got %v", MaxPeerRequests, len(pc.peerRequests))
+	}
+
+	handleTestErr(pc.HandleMessage(blockMessage(8, 1, 0, 16384)), t)
+	if len(pc.peerRequests) != MaxPeerRequests-1 || pc.peerRequests[1].index != 2 {
+		t.Errorf("Expected the cancelled request to be dropped from the queue")
+	}
+}
@@ -4,13 +4,17 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"errors"
+	"fmt"
 	"io"
 	"math"
 	"net"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
+	"tor/pkg/mse"
 	"tor/pkg/util"
 
 	log "github.com/sirupsen/logrus"
@@ -33,8 +37,21 @@ type TorrentSession struct {
 	failedWorkChan  chan int
 	fileLock        sync.Mutex
 	dataDir         string
-	peersStarted    int
-	peerConsMx      sync.Mutex
+	// Holds one for each peer we're connected or handshaking with, so there's
+	// never more than Threads
+	peerSlots  chan struct{}
+	peerConsMx sync.Mutex
+	// Bytes of verified pieces we've downloaded and blocks we've uploaded
+	downloaded atomic.Int64
+	uploaded   atomic.Int64
+	// Peers we're connected or connecting to
+	connectedPeers map[netip.AddrPort]bool
+
+	stop        chan struct{}
+	stopOnce    sync.Once
+	fetcherDone chan struct{}
+
+	webSeeds []*WebSeed
 
 	pieceCache PieceCache
 }
@@ -47,12 +64,30 @@ func NewTorrentSession(infoHash [20]byte, torrentInfo TorrentInfo, peerfetcher P
 		peerId:         GenPeerId(),
 		workChan:       make(chan int, Threads),
 		failedWorkChan: make(chan int, Threads),
+		peerSlots:      make(chan struct{}, Threads),
 		dataDir:        DataDir,
+		connectedPeers: make(map[netip.AddrPort]bool),
+		stop:           make(chan struct{}),
 	}
+	ts.applyPrivatePolicy()
 	ts.initialize()
 	return &ts
 }
 
+// DecentralisedPeersAllowed is false for private torrents, they only get
+// peers from their own trackers so DHT, PEX and LSD are off (BEP 27)
+func (ts *TorrentSession) DecentralisedPeersAllowed() bool {
+	return !ts.TorrentInfo.Private
+}
+
+func (ts *TorrentSession) applyPrivatePolicy() {
+	if ts.DecentralisedPeersAllowed() || ts.PeerFetcher == nil {
+		return
+	}
+	log.Infof("%s is private, only using its trackers for peers", ts.TorrentInfo.Name)
+	ts.PeerFetcher = withoutDecentralised(ts.PeerFetcher)
+}
+
 func handleInitError(err error) {
 	if err != nil {
 		panic(err)
@@ -174,52 +209,75 @@ func (ts *TorrentSession) initializeBitField(filePaths []string) error {
 
 func (ts *TorrentSession) StartSession() {
 	ts.pieceCache = *NewPieceCache(ts.TorrentInfo, ts.dataDir)
-	peers := ts.GetPeers()
+	ts.setAnnounceStats()
+	ts.runPeerFetcher()
+	go ts.acceptPeers()
+	for _, ws := range ts.webSeeds {
+		go ts.handleWebSeed(ws)
+	}
 
-	go ts.startPeers(peers)
 	// Start scheduling work for PCs to pick up
 	ts.scheduleWork()
 }
 
 func (ts *TorrentSession) StartSeeding() error {
+	if TCPListener == nil && UTPSocket == nil {
+		return errors.New("No listeners for peers to connect to")
+	}
 
 	ts.pieceCache = *NewPieceCache(ts.TorrentInfo, ts.dataDir)
-	// ts.pieceCache.fileLock = ts.fileLock
-	ln, err := net.Listen("tcp", ":6881")
-	if err != nil {
-		log.Error(err)
-		return err
+	ts.setAnnounceStats()
+	ts.runPeerFetcher()
+	ts.acceptPeers()
+	return nil
+}
+
+// acceptPeers takes the peers that connect to us for this torrent on the
+// shared listeners until the session stops
+func (ts *TorrentSession) acceptPeers() {
+	conns := make(chan net.Conn)
+	incomingPeers.register(ts.InfoHash, conns, ts.stop)
+	defer incomingPeers.unregister(ts.InfoHash, ts.stop)
+	if TCPListener != nil {
+		incomingPeers.listen(TCPListener)
+	}
+	if UTPSocket != nil {
+		incomingPeers.listen(UTPSocket)
 	}
-	defer ln.Close()
 
 	for {
-		if ts.peersStarted >= Threads {
-			time.Sleep(5 * time.Second)
-			continue
-		}
-
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Error(err)
-			continue
+		select {
+		case <-ts.stop:
+			return
+		case conn := <-conns:
+			if !ts.tryReservePeerSlot() {
+				log.Debugf("Turning away %s, we've got enough peers", conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
+			go ts.acceptPeer(conn)
 		}
+	}
+}
 
-		bfLength := int(math.Ceil(float64(ts.TorrentInfo.GetNumPieces()) / 8))
-		peerConn := NewReceivedPeerConnection(ts.peerId, ts.InfoHash, bfLength, ts.pieceBitField, conn, &ts.pieceCache)
-
-		err = peerConn.Handshake()
-
-		if err != nil {
-			log.Warnf("Error from handshake: %s \n", err)
-			continue
-		}
+// acceptPeer does the BitTorrent handshake with a peer that connected to us,
+// on its own so a slow peer doesn't hold up the others
+func (ts *TorrentSession) acceptPeer(conn net.Conn) {
+	bfLength := int(math.Ceil(float64(ts.TorrentInfo.GetNumPieces()) / 8))
+	peerConn := NewReceivedPeerConnection(ts.peerId, ts.InfoHash, bfLength, ts.pieceBitField, conn, &ts.pieceCache)
+	peerConn.UploadOnly = ts.gotAllPieces()
+	peerConn.uploaded = &ts.uploaded
 
-		ts.peerConsMx.Lock()
-		ts.peersStarted++
-		ts.peerConsMx.Unlock()
-		go ts.handleSeedingPeerConnection(peerConn)
+	conn.SetDeadline(time.Now().Add(mse.HandshakeTimeout))
+	err := peerConn.Handshake()
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		log.Warnf("Error from handshake: %s \n", err)
+		conn.Close()
+		ts.releasePeerSlot()
+		return
 	}
-	return nil
+	ts.handleSeedingPeerConnection(peerConn)
 }
 
 func (ts *TorrentSession) GetMetadata() {
@@ -301,29 +359,112 @@ func (ts *TorrentSession) GetMetadata() {
 	}
 }
 
+// runPeerFetcher keeps finding peers until the session is stopped if the
+// fetcher can, otherwise it just connects to the peers it gives once
+func (ts *TorrentSession) runPeerFetcher() {
+	f, ok := ts.PeerFetcher.(SessionPeerFetcher)
+	if !ok {
+		go ts.startPeers(ts.GetPeers())
+		return
+	}
+
+	ts.fetcherDone = make(chan struct{})
+	go func() {
+		defer close(ts.fetcherDone)
+		f.Run(ts, ts.stop)
+	}()
+}
+
+// Stop tells the trackers we're going and waits for them to hear it
+func (ts *TorrentSession) Stop() {
+	ts.stopOnce.Do(func() { close(ts.stop) })
+	if ts.fetcherDone != nil {
+		<-ts.fetcherDone
+	}
+}
+
+func (ts *TorrentSession) AddPeers(peers []TorrentPeer) {
+	if ts.gotAllPieces() {
+		return
+	}
+	go ts.startPeers(peers)
+}
+
+func (ts *TorrentSession) NeedsPeers() bool {
+	if ts.gotAllPieces() {
+		return false
+	}
+
+	return len(ts.peerSlots) < cap(ts.peerSlots)/2
+}
+
+// reservePeerSlot waits until we're under Threads peers and takes a slot for
+// another, false if the session stopped first
+func (ts *TorrentSession) reservePeerSlot() bool {
+	select {
+	case ts.peerSlots <- struct{}{}:
+		return true
+	case <-ts.stop:
+		return false
+	}
+}
+
+// tryReservePeerSlot takes a slot for another peer if we're under Threads
+func (ts *TorrentSession) tryReservePeerSlot() bool {
+	select {
+	case ts.peerSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (ts *TorrentSession) releasePeerSlot() {
+	<-ts.peerSlots
+}
+
+// claimPeer marks a peer as being connected to, false if it already is
+func (ts *TorrentSession) claimPeer(addr netip.AddrPort) bool {
+	ts.peerConsMx.Lock()
+	defer ts.peerConsMx.Unlock()
+
+	if ts.connectedPeers[addr] {
+		return false
+	}
+	ts.connectedPeers[addr] = true
+	return true
+}
+
+func (ts *TorrentSession) releasePeer(addr netip.AddrPort) {
+	ts.peerConsMx.Lock()
+	defer ts.peerConsMx.Unlock()
+	delete(ts.connectedPeers, addr)
+}
+
 func (ts *TorrentSession) startPeers(peers []TorrentPeer) {
 	for i := range peers {
-		if ts.peersStarted >= Threads {
-			time.Sleep(5 * time.Second)
-			continue
+		if !ts.reservePeerSlot() {
+			return
 		}
 		peer := peers[i]
 
+		if !ts.claimPeer(peer.AddrPort) {
+			ts.releasePeerSlot()
+			continue
+		}
+
 		bfLength := int(math.Ceil(float64(ts.TorrentInfo.GetNumPieces()) / 8))
 		peerConn := NewPeerConnection(peer.ToPeerInfo(), ts.peerId, ts.InfoHash, bfLength, ts.pieceBitField)
 		err := peerConn.Handshake()
 
 		if err != nil {
 			log.Warnf("Error from handshake: %s \n", err)
+			ts.releasePeer(peer.AddrPort)
+			ts.releasePeerSlot()
 			continue
 		}
 
-		if err == nil {
-			ts.peerConsMx.Lock()
-			ts.peersStarted++
-			ts.peerConsMx.Unlock()
-			go ts.handlePeerConnection(peerConn, nil, false)
-		}
+		go ts.handlePeerConnection(peerConn, nil, false)
 	}
 }
 
@@ -370,9 +511,7 @@ func (ts *TorrentSession) handleSeedingPeerConnection(pc *PeerConnection) {
 		}
 	}
 
-	ts.peerConsMx.Lock()
-	ts.peersStarted--
-	ts.peerConsMx.Unlock()
+	ts.releasePeerSlot()
 }
 
 func (ts *TorrentSession) handlePeerConnection(pc *PeerConnection, closeChan chan bool, seed bool) {
@@ -418,30 +557,34 @@ func (ts *TorrentSession) handlePeerConnection(pc *PeerConnection, closeChan cha
 		}
 		log.Tracef("Trying to get piece: %v \n", pieceIndex)
 
-		pl := ts.TorrentInfo.PieceLength
-		if pieceIndex == (ts.TorrentInfo.GetNumPieces() - 1) {
-			pl = ts.TorrentInfo.GetTotalLength() - (ts.TorrentInfo.PieceLength * pieceIndex)
-		}
-		piece, err := pc.getPiece(pieceIndex, pl)
+		piece, err := pc.getPiece(pieceIndex, ts.pieceSize(pieceIndex))
 		if err != nil {
 			log.Warnf("Error getting Piece %s", err)
 			ts.failedWorkChan <- pieceIndex
 			break
 		}
 		log.Infof("Downloaded Piece: %v\n", pieceIndex)
-		if ts.verifyPiece(pieceIndex, piece) {
-			log.Debugf("Verified and now writing Piece: %v\n", pieceIndex)
-			ts.writePieceToFile(pieceIndex, piece)
-			ts.pieceBitField.SetBitFieldPiece(pieceIndex)
-		} else {
-			log.Warnf("Piece %v failed verification, will reschedule", pieceIndex)
-			ts.failedWorkChan <- pieceIndex
-		}
+		ts.savePiece(pieceIndex, piece)
 	}
 
-	ts.peerConsMx.Lock()
-	ts.peersStarted--
-	ts.peerConsMx.Unlock()
+	ts.releasePeer(pc.PeerInfo.AddrPort)
+	ts.releasePeerSlot()
+}
+
+// savePiece writes a downloaded piece if it verifies, otherwise it's
+// rescheduled
+func (ts *TorrentSession) savePiece(pieceIndex int, piece []byte) bool {
+	if !ts.verifyPiece(pieceIndex, piece) {
+		log.Warnf("Piece %v failed verification, will reschedule", pieceIndex)
+		ts.failedWorkChan <- pieceIndex
+		return false
+	}
+
+	log.Debugf("Verified and now writing Piece: %v\n", pieceIndex)
+	ts.writePieceToFile(pieceIndex, piece)
+	ts.pieceBitField.SetBitFieldPiece(pieceIndex)
+	ts.downloaded.Add(int64(len(piece)))
+	return true
 }
 
 func (ts *TorrentSession) writePieceToFile(pieceIndex int, piece []byte) {
@@ -531,3 +674,61 @@ func (ts *TorrentSession) gotAllPieces() bool {
 	}
 	return true
 }
+
+// pieceSize is the piece length except for the last piece which can be shorter
+func (ts *TorrentSession) pieceSize(pieceIndex int) int {
+	if pieceIndex == ts.TorrentInfo.GetNumPieces()-1 {
+		return ts.TorrentInfo.GetTotalLength() - ts.TorrentInfo.PieceLength*pieceIndex
+	}
+	return ts.TorrentInfo.PieceLength
+}
+
+func (ts *TorrentSession) AnnounceStats() AnnounceStats {
+	left := 0
+	for i := 0; i < ts.TorrentInfo.GetNumPieces(); i++ {
+		if !ts.pieceBitField.HasPiece(i) {
+			left += ts.pieceSize(i)
+		}
+	}
+
+	return AnnounceStats{
+		Uploaded:   uint64(ts.uploaded.Load()),
+		Downloaded: uint64(ts.downloaded.Load()),
+		Left:       uint64(left),
+	}
+}
+
+type SessionStats struct {
+	AnnounceStats
+	Peers int
+	// Nil if the peer fetcher can't scrape or the scrape failed
+	Swarm *ScrapeResponse
+}
+
+func (s SessionStats) String() string {
+	str := fmt.Sprintf("%v peers, downloaded %v bytes, uploaded %v bytes, %v bytes left", s.Peers, s.Downloaded, s.Uploaded, s.Left)
+	if s.Swarm != nil {
+		str += ", swarm: " + s.Swarm.String()
+	}
+	return str
+}
+
+// Stats scrapes the trackers for the swarm so it can be slow
+func (ts *TorrentSession) Stats() SessionStats {
+	stats := SessionStats{AnnounceStats: ts.AnnounceStats(), Peers: len(ts.peerSlots)}
+	if s, ok := ts.PeerFetcher.(SwarmScraper); ok {
+		swarm, err := s.Scrape()
+		if err != nil {
+			log.Debugf("Scrape failed: %s", err)
+		} else {
+			stats.Swarm = &swarm
+		}
+	}
+	return stats
+}
+
+func (ts *TorrentSession) setAnnounceStats() {
+	if s, ok := ts.PeerFetcher.(AnnounceStatsSetter); ok {
+		s.SetAnnounceStats(ts.AnnounceStats)
+	}
+}
@@ -6,9 +6,12 @@ import (
 	"crypto/sha1"
 	"encoding/hex"
 	"math"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 	"tor/pkg/util"
 )
 
@@ -307,7 +310,7 @@ func handleTestErr(err error, t *testing.T) {
 type localPeerFetcher struct{}
 
 func (f localPeerFetcher) GetPeers() []TorrentPeer {
-	return []TorrentPeer{{2130706433, 6881}}
+	return []TorrentPeer{NewTorrentPeer(netip.MustParseAddr("127.0.0.1"), 6881)}
 }
 
 func NewTorrentSessionWithDir(infoHash [20]byte, torrentInfo TorrentInfo, peerfetcher PeerFetcher, dataDir string) *TorrentSession {
@@ -319,7 +322,10 @@ func NewTorrentSessionWithDir(infoHash [20]byte, torrentInfo TorrentInfo, peerfe
 		workChan:       make(chan int, Threads),
 		failedWorkChan: make(chan int, Threads),
 		dataDir:        dataDir,
+		connectedPeers: make(map[netip.AddrPort]bool),
+		stop:           make(chan struct{}),
 	}
+	ts.applyPrivatePolicy()
 	ts.initialize()
 	return &ts
 }
@@ -346,3 +352,73 @@ func TestVerifyPiece(t *testing.T) {
 		t.Errorf("piece should have failed verification")
 	}
 }
+
+type decentralisedPeerFetcher struct{ localPeerFetcher }
+
+func (f decentralisedPeerFetcher) Decentralised() {}
+
+func TestPrivateTorrentOnlyUsesTrackers(t *testing.T) {
+	trackers := NewTrackersPeerFetcher([20]byte{1}, []string{"udp://tracker.example.com:6969"})
+	pf := MultiPeerFetcher{trackers, decentralisedPeerFetcher{}}
+	ti := TorrentInfo{Name: "private.txt", Length: 1, PieceLength: 1, Pieces: make([]byte, 20), Private: true}
+
+	ts := NewTorrentSessionWithDir([20]byte{1}, ti, pf, t.TempDir())
+	kept, ok := ts.PeerFetcher.(MultiPeerFetcher)
+	if ts.DecentralisedPeersAllowed() || !ok || len(kept) != 1 || kept[0] != trackers {
+		t.Errorf("private torrents should only keep the trackers but got: %#v", ts.PeerFetcher)
+	}
+
+	ti.Private = false
+	ts = NewTorrentSessionWithDir([20]byte{1}, ti, pf, t.TempDir())
+	if kept := ts.PeerFetcher.(MultiPeerFetcher); len(kept) != 2 {
+		t.Errorf("public torrents should keep every peer fetcher")
+	}
+}
+
+func TestSessionStatsString(t *testing.T) {
+	stats := SessionStats{AnnounceStats: AnnounceStats{Uploaded: 1, Downloaded: 2, Left: 3}, Peers: 4}
+	if s := stats.String(); s != "4 peers, downloaded 2 bytes, uploaded 1 bytes, 3 bytes left" {
+		t.Errorf("Unexpected stats without a swarm: %s", s)
+	}
+
+	stats.Swarm = &ScrapeResponse{Seeders: 5, Leechers: 6, Completed: 7}
+	if s := stats.String(); !strings.HasSuffix(s, "swarm: 5 seeders, 6 leechers, downloaded 7 times") {
+		t.Errorf("Expected the swarm in the stats but got: %s", s)
+	}
+}
+
+func TestPeerSlotsStopAtThreads(t *testing.T) {
+	ts := TorrentSession{
+		peerSlots: make(chan struct{}, 2),
+		stop:      make(chan struct{}),
+	}
+	if !ts.reservePeerSlot() || !ts.reservePeerSlot() {
+		t.Fatalf("Should get a slot for each thread")
+	}
+
+	reserved := make(chan bool)
+	go func() { reserved <- ts.reservePeerSlot() }()
+	select {
+	case <-reserved:
+		t.Fatalf("Shouldn't get a slot while they're all taken")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ts.releasePeerSlot()
+	if !<-reserved {
+		t.Errorf("Should get the slot that was released")
+	}
+	if peers := ts.Stats().Peers; peers != 2 {
+		t.Errorf("Expected 2 peers but got %v", peers)
+	}
+
+	if ts.tryReservePeerSlot() {
+		t.Errorf("Shouldn't get a slot without waiting while they're all taken")
+	}
+
+	go func() { reserved <- ts.reservePeerSlot() }()
+	ts.Stop()
+	if <-reserved {
+		t.Errorf("Shouldn't get a slot once the session's stopped")
+	}
+}
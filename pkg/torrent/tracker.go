@@ -1,107 +1,264 @@
 package torrent
 
 import (
-	"bufio"
 	"encoding/binary"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
+	"net/netip"
+	"os"
+	"sync"
 	"time"
 )
 
-type TrackerConn struct {
-	conn          *net.UDPConn
-	transactionId uint32
-	connectionId  uint64
+// UDP tracker actions (BEP 15)
+const (
+	actionConnect  uint32 = 0
+	actionAnnounce uint32 = 1
+	actionScrape   uint32 = 2
+	actionError    uint32 = 3
+)
+
+const udpTrackerProtocolId uint64 = 0x41727101980
+
+// Connection ids can be reused for a minute after they're handed out
+const udpConnectionIdLifetime = time.Minute
+
+// A request is retransmitted after UDPTrackerTimeout * 2^n seconds for n up
+// to UDPTrackerRetries, so the defaults give up after about 2 hours
+var UDPTrackerTimeout = 15 * time.Second
+var UDPTrackerRetries = 8
+
+var errUDPTrackerTimeout = errors.New("UDP tracker didn't respond")
+
+// UDPTracker announces to a udp:// tracker
+type UDPTracker struct {
+	addr string
+
+	mx           sync.Mutex
+	connectionId uint64
+	connectedAt  time.Time
 }
 
-func NewUDPTrackerConn(trackerAddr string) (*TrackerConn, error) {
-	udpAddr, err := net.ResolveUDPAddr("udp", trackerAddr)
-	if err != nil {
-		return nil, err
-	}
+func NewUDPTracker(trackerAddr string) *UDPTracker {
+	return &UDPTracker{addr: trackerAddr}
+}
 
-	if udpAddr.IP.String() == "127.0.0.1" {
-		return nil, fmt.Errorf("Resolved to self so skipping")
+func (t *UDPTracker) Announce(r AnnounceRequest) (AnnounceResponse, error) {
+	if r.PeerId == [20]byte{} {
+		r.PeerId = GenPeerId()
 	}
 
-	conn, err := net.DialUDP("udp", nil, udpAddr)
+	var res AnnounceResponse
+	err := t.do(actionAnnounce, func(connectionId uint64, transactionId uint32) []byte {
+		r.connectionId = connectionId
+		r.transactionId = transactionId
+		return r.getAnnouncePacket()
+	}, func(b []byte, ipv6 bool) error {
+		if len(b) < 20 {
+			return fmt.Errorf("Announce response too short: %v bytes", len(b))
+		}
+		res = parseAnnounceResponse(b, len(b), ipv6)
+		return nil
+	})
+	return res, err
+}
 
-	if err != nil {
-		return nil, err
+// Most info hashes a UDP scrape fits in a packet
+const maxUDPScrapeInfoHashes = 74
+
+func (t *UDPTracker) Scrape(infoHashes ...[20]byte) ([]ScrapeResponse, error) {
+	res := make([]ScrapeResponse, 0, len(infoHashes))
+	for len(infoHashes) > 0 {
+		batch := infoHashes
+		if len(batch) > maxUDPScrapeInfoHashes {
+			batch = batch[:maxUDPScrapeInfoHashes]
+		}
+		infoHashes = infoHashes[len(batch):]
+
+		err := t.do(actionScrape, func(connectionId uint64, transactionId uint32) []byte {
+			return getScrapePacket(connectionId, transactionId, batch)
+		}, func(b []byte, ipv6 bool) error {
+			if len(b) < 8+12*len(batch) {
+				return fmt.Errorf("Scrape response too short: %v bytes", len(b))
+			}
+			res = append(res, parseScrapeResponse(b[8:], batch)...)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
+	return res, nil
+}
 
-	// Connect
-	connectionPacket, err := genConnectionPacket(rand.Uint32())
+// do sends a request to the tracker connecting first if we don't have a
+// connection id, retrying on the BEP 15 schedule until handle accepts a
+// response. Requests to the same tracker can be in flight at once, they
+// only share the connection id.
+func (t *UDPTracker) do(action uint32, build func(connectionId uint64, transactionId uint32) []byte, handle func(b []byte, ipv6 bool) error) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", t.addr)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	fmt.Printf("connection packet: % x\n", connectionPacket)
-
-	_, err = conn.Write(connectionPacket[:])
+	// Trackers reached over IPv6 reply with IPv6 peers
+	ipv6 := udpAddr.IP.To4() == nil
 
+	conn, err := net.DialUDP("udp", nil, udpAddr)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer conn.Close()
+
+	for n := 0; n <= UDPTrackerRetries; n++ {
+		timeout := UDPTrackerTimeout << n
+
+		connectionId, ok := t.connection()
+		if !ok {
+			b, err := t.roundTrip(conn, actionConnect, timeout, genConnectionPacket)
+			if errors.Is(err, errUDPTrackerTimeout) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if len(b) < 16 {
+				return fmt.Errorf("Connect response too short: %v bytes", len(b))
+			}
+			connectionId = binary.BigEndian.Uint64(b[8:])
+			t.setConnection(connectionId, time.Now())
+		}
 
+		b, err := t.roundTrip(conn, action, timeout, func(transactionId uint32) []byte {
+			return build(connectionId, transactionId)
+		})
+		if errors.Is(err, errUDPTrackerTimeout) {
+			continue
+		}
+		if err != nil {
+			// The tracker may have forgotten our connection id so get a new one next time
+			t.setConnection(0, time.Time{})
+			return err
+		}
+		return handle(b, ipv6)
 	}
+	return errUDPTrackerTimeout
+}
+
+// connection is the connection id if it can still be used
+func (t *UDPTracker) connection() (uint64, bool) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return t.connectionId, time.Since(t.connectedAt) <= udpConnectionIdLifetime
+}
+
+func (t *UDPTracker) setConnection(connectionId uint64, connectedAt time.Time) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.connectionId = connectionId
+	t.connectedAt = connectedAt
+}
 
-	conn.SetDeadline(time.Now().Add(time.Second * 5))
-	buf := make([]byte, 32)
-	n, err := bufio.NewReader(conn).Read(buf)
-	conn.SetDeadline(time.Time{})
+// roundTrip sends a packet and waits for the response with the same
+// transaction id. Error responses from the tracker are returned as errors.
+func (t *UDPTracker) roundTrip(conn *net.UDPConn, action uint32, timeout time.Duration, build func(transactionId uint32) []byte) ([]byte, error) {
+	transactionId := rand.Uint32()
+	_, err := conn.Write(build(transactionId))
 	if err != nil {
 		return nil, err
-
 	}
 
-	action := binary.BigEndian.Uint32(buf)
-	receivedTransactionId := binary.BigEndian.Uint32(buf[4:])
-	connectionId := binary.BigEndian.Uint64(buf[8:])
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, errUDPTrackerTimeout
+		}
+		if err != nil {
+			return nil, err
+		}
 
-	fmt.Printf("n: %v, action: % x, received tid: % x, conn Id: % x\n", n, action, receivedTransactionId, connectionId)
+		if n < 8 || binary.BigEndian.Uint32(buf[4:]) != transactionId {
+			// Late response to an earlier attempt or garbage
+			continue
+		}
 
-	return &TrackerConn{
-		conn:          conn,
-		transactionId: receivedTransactionId,
-		connectionId:  connectionId,
-	}, nil
+		switch binary.BigEndian.Uint32(buf) {
+		case action:
+			return buf[:n], nil
+		case actionError:
+			return nil, fmt.Errorf("Tracker error: %s", buf[8:n])
+		default:
+			return nil, fmt.Errorf("Unexpected action %v from tracker", binary.BigEndian.Uint32(buf))
+		}
+	}
 }
 
-func (c TrackerConn) Announce(r AnnounceRequest) (AnnounceResponse, error) {
-	r.connectionId = c.connectionId
-	r.transactionId = c.transactionId
-	r.PeerId = GenPeerId()
-	p := r.getAnnouncePacket()
-
-	_, err := c.conn.Write(p[:])
+func genConnectionPacket(transactionId uint32) []byte {
+	pak := make([]byte, 16)
+	binary.BigEndian.PutUint64(pak, udpTrackerProtocolId)
+	binary.BigEndian.PutUint32(pak[8:], actionConnect)
+	binary.BigEndian.PutUint32(pak[12:], transactionId)
+	return pak
+}
 
-	c.conn.SetDeadline(time.Now().Add(time.Second * 10))
+// Announce events, the values are the ones used by UDP trackers
+const (
+	EventNone      uint32 = 0
+	EventCompleted uint32 = 1
+	EventStarted   uint32 = 2
+	EventStopped   uint32 = 3
+)
 
-	buf := make([]byte, 1024)
-	n, err := bufio.NewReader(c.conn).Read(buf)
-	if err != nil {
-		return AnnounceResponse{}, err
-	}
+var eventToString = map[uint32]string{
+	EventCompleted: "completed",
+	EventStarted:   "started",
+	EventStopped:   "stopped",
+}
 
-	fmt.Printf("Received %v bytes for announce\n", n)
-	res := parseAnnounceResponse(buf, n)
-	return res, nil
+// ScrapeResponse is what a tracker knows about a torrent's swarm
+type ScrapeResponse struct {
+	InfoHash [20]byte
+	Seeders  uint32
+	// Number of times the torrent has been downloaded
+	Completed uint32
+	Leechers  uint32
 }
 
-func genConnectionPacket(transactionId uint32) ([16]byte, error) {
-	pak := [16]byte{}
+func (r ScrapeResponse) String() string {
+	return fmt.Sprintf("%v seeders, %v leechers, downloaded %v times", r.Seeders, r.Leechers, r.Completed)
+}
 
-	mc, err := hex.DecodeString("0000041727101980")
-	if err != nil {
-		return pak, err
+func getScrapePacket(connectionId uint64, transactionId uint32, infoHashes [][20]byte) []byte {
+	pack := make([]byte, 16, 16+20*len(infoHashes))
+	binary.BigEndian.PutUint64(pack, connectionId)
+	binary.BigEndian.PutUint32(pack[8:], actionScrape)
+	binary.BigEndian.PutUint32(pack[12:], transactionId)
+	for _, ih := range infoHashes {
+		pack = append(pack, ih[:]...)
 	}
+	return pack
+}
 
-	copy(pak[:], mc)
-
-	binary.BigEndian.PutUint32(pak[12:], transactionId)
-
-	return pak, nil
+// parseScrapeResponse parses the seeders, completed, leechers entries that
+// come back in the same order as the info hashes
+func parseScrapeResponse(b []byte, infoHashes [][20]byte) []ScrapeResponse {
+	res := make([]ScrapeResponse, 0, len(infoHashes))
+	for i, ih := range infoHashes {
+		if len(b) < 12*(i+1) {
+			break
+		}
+		entry := b[12*i:]
+		res = append(res, ScrapeResponse{
+			InfoHash:  ih,
+			Seeders:   binary.BigEndian.Uint32(entry),
+			Completed: binary.BigEndian.Uint32(entry[4:]),
+			Leechers:  binary.BigEndian.Uint32(entry[8:]),
+		})
+	}
+	return res
 }
 
 type AnnounceRequest struct {
@@ -120,24 +277,52 @@ type AnnounceRequest struct {
 }
 
 type TorrentPeer struct {
-	IpAddr uint32
-	Port   uint16
+	netip.AddrPort
+}
+
+func NewTorrentPeer(addr netip.Addr, port uint16) TorrentPeer {
+	return TorrentPeer{netip.AddrPortFrom(addr.Unmap(), port)}
 }
 
 func (p TorrentPeer) ToPeerInfo() PeerInfo {
-	return PeerInfo{
-		Ipaddr: Int32ToIpString(p.IpAddr),
-		Port:   fmt.Sprintf("%v", p.Port),
+	return PeerInfo{p.AddrPort}
+}
+
+// Compact is the 6 byte IPv4 or 18 byte IPv6 compact form of the peer
+func (p TorrentPeer) Compact() []byte {
+	b, _ := p.Addr().MarshalBinary()
+	return binary.BigEndian.AppendUint16(b, p.Port())
+}
+
+// ParseCompactPeers parses a compact peer list of 6 byte IPv4 entries or
+// 18 byte IPv6 entries, trailing bytes are ignored
+func ParseCompactPeers(b []byte, ipv6 bool) []TorrentPeer {
+	addrLen := 4
+	if ipv6 {
+		addrLen = 16
+	}
+	entryLen := addrLen + 2
+
+	peers := make([]TorrentPeer, 0, len(b)/entryLen)
+	for i := 0; i+entryLen <= len(b); i += entryLen {
+		addr, _ := netip.AddrFromSlice(b[i : i+addrLen])
+		port := binary.BigEndian.Uint16(b[i+addrLen:])
+		peers = append(peers, NewTorrentPeer(addr, port))
 	}
+	return peers
 }
 
 type AnnounceResponse struct {
 	action        uint32
 	transactionId uint32
 	interval      uint32
+	minInterval   uint32
 	leechers      uint32
 	seeders       uint32
+	trackerId     string
 	Peers         []TorrentPeer
+	// Tracker warnings don't stop the announce from working
+	Warning string
 }
 
 func (r *AnnounceResponse) print() {
@@ -145,53 +330,39 @@ func (r *AnnounceResponse) print() {
 	fmt.Printf("Peers: %v", len(r.Peers))
 
 	for _, p := range r.Peers {
-		// fmt.Printf("%v.%v.%v.%v" p.ip )
-		fmt.Printf("port: %v\n", p.Port)
+		fmt.Printf("peer: %v\n", p)
 	}
 }
 
-func parseAnnounceResponse(b []byte, l int) AnnounceResponse {
+func parseAnnounceResponse(b []byte, l int, ipv6 bool) AnnounceResponse {
 	if l < 20 {
 		return AnnounceResponse{
 			action: binary.BigEndian.Uint32(b[:]),
 		}
 	}
-	peers := (l - 20) / 6
 
-	rv := AnnounceResponse{
+	return AnnounceResponse{
 		action:        binary.BigEndian.Uint32(b[:]),
 		transactionId: binary.BigEndian.Uint32(b[4:]),
 		interval:      binary.BigEndian.Uint32(b[8:]),
 		leechers:      binary.BigEndian.Uint32(b[12:]),
 		seeders:       binary.BigEndian.Uint32(b[16:]),
-		Peers:         make([]TorrentPeer, peers),
-	}
-
-	for i := 0; i < peers; i++ {
-		rv.Peers[i].IpAddr = binary.BigEndian.Uint32(b[20+6*i:])
-		rv.Peers[i].Port = binary.BigEndian.Uint16(b[24+6*i:])
+		Peers:         ParseCompactPeers(b[20:l], ipv6),
 	}
-
-	return rv
 }
 
 func (r AnnounceRequest) getAnnouncePacket() []byte {
 	pack := make([]byte, 98)
 	binary.BigEndian.PutUint64(pack, r.connectionId) // 8 bytes
 	// Action - 1 for Announce
-	binary.BigEndian.PutUint32(pack[8:], 1)                // 4 bytes
-	binary.BigEndian.PutUint32(pack[12:], r.transactionId) // 4 bytes
-	copy(pack[16:], r.InfoHash[:])                         // 20 bytes
-	copy(pack[36:], r.PeerId[:])                           // 20 bytes
-	binary.BigEndian.PutUint64(pack[56:], r.Downloaded)    // 8 bytes
-	binary.BigEndian.PutUint64(pack[64:], r.Left)          // 8 bytes
-	binary.BigEndian.PutUint64(pack[72:], r.Uploaded)      // 8 bytes
-	// Event
-	// none = 0
-	// completed = 1
-	// started = 2
-	// stopped = 3
-	binary.BigEndian.PutUint32(pack[80:], 0)                 // 4 bytes
+	binary.BigEndian.PutUint32(pack[8:], actionAnnounce)     // 4 bytes
+	binary.BigEndian.PutUint32(pack[12:], r.transactionId)   // 4 bytes
+	copy(pack[16:], r.InfoHash[:])                           // 20 bytes
+	copy(pack[36:], r.PeerId[:])                             // 20 bytes
+	binary.BigEndian.PutUint64(pack[56:], r.Downloaded)      // 8 bytes
+	binary.BigEndian.PutUint64(pack[64:], r.Left)            // 8 bytes
+	binary.BigEndian.PutUint64(pack[72:], r.Uploaded)        // 8 bytes
+	binary.BigEndian.PutUint32(pack[80:], r.Event)           // 4 bytes
 	binary.BigEndian.PutUint32(pack[84:], r.Ipaddr)          // 4 bytes
 	binary.BigEndian.PutUint32(pack[88:], r.Key)             // 4 bytes
 	binary.BigEndian.PutUint32(pack[92:], uint32(r.NumWant)) // 4 bytes
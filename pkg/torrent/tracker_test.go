@@ -1,5 +1,16 @@
 package torrent
 
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
 // func TestAnnounceRequest(t *testing.T) {
 // 	fileName := "C:\\Users\\usa_m\\Downloads\\Solus-4.4-Budgie.torrent"
 
@@ -37,3 +48,269 @@ package torrent
 // 		// }
 // 	}
 // }
+
+func TestParseCompactPeers(t *testing.T) {
+	v4 := []byte{127, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0, 80}
+	peers := ParseCompactPeers(v4, false)
+	if len(peers) != 2 || peers[0].String() != "127.0.0.1:6881" || peers[1].String() != "10.0.0.2:80" {
+		t.Errorf("unexpected IPv4 peers: %v", peers)
+	}
+
+	v6 := append(netip.MustParseAddr("2001:db8::1").AsSlice(), 0x1a, 0xe1)
+	peers = ParseCompactPeers(v6, true)
+	if len(peers) != 1 || peers[0].String() != "[2001:db8::1]:6881" {
+		t.Errorf("unexpected IPv6 peers: %v", peers)
+	}
+
+	if !bytes.Equal(peers[0].Compact(), v6) {
+		t.Errorf("expected compact peer %x but got: %x", v6, peers[0].Compact())
+	}
+}
+
+func TestParseAnnounceResponseIPv6(t *testing.T) {
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint32(b, 1)
+	b = append(b, NewTorrentPeer(netip.MustParseAddr("2001:db8::2"), 51413).Compact()...)
+
+	res := parseAnnounceResponse(b, len(b), true)
+	if len(res.Peers) != 1 || res.Peers[0].String() != "[2001:db8::2]:51413" {
+		t.Errorf("expected one IPv6 peer but got: %v", res.Peers)
+	}
+}
+
+func TestPeerInfoFromAddress(t *testing.T) {
+	p := PeerInfoFromAddress("[::ffff:10.0.0.1]:6881")
+	if p.String() != "10.0.0.1:6881" {
+		t.Errorf("IPv4-mapped addresses should be unmapped but got: %s", p)
+	}
+
+	p = PeerInfoFromAddress("[2001:db8::1]:6881")
+	if !p.Addr().Is6() || p.Port() != 6881 {
+		t.Errorf("expected IPv6 peer but got: %s", p)
+	}
+}
+
+// fakeUDPTracker answers connect and announce requests, announces for
+// errorInfoHash get an error response
+type fakeUDPTracker struct {
+	conn          net.PacketConn
+	errorInfoHash [20]byte
+
+	mx        sync.Mutex
+	connects  int
+	drop      int
+	announces []AnnounceRequest
+	// Announces are recorded but not answered
+	ignoreAnnounces bool
+}
+
+func newFakeUDPTracker(t *testing.T) *fakeUDPTracker {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	handleTestErr(err, t)
+	t.Cleanup(func() { conn.Close() })
+
+	f := &fakeUDPTracker{conn: conn, errorInfoHash: [20]byte{0xee}}
+	go f.serve()
+	return f
+}
+
+func (f *fakeUDPTracker) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		f.mx.Lock()
+		if f.drop > 0 {
+			f.drop--
+			f.mx.Unlock()
+			continue
+		}
+
+		b := buf[:n]
+		action := binary.BigEndian.Uint32(b[8:])
+		resp := binary.BigEndian.AppendUint32(nil, action)
+		resp = append(resp, b[12:16]...)
+
+		switch action {
+		case actionConnect:
+			f.connects++
+			resp = binary.BigEndian.AppendUint64(resp, 1234)
+		case actionAnnounce:
+			r := AnnounceRequest{
+				Downloaded: binary.BigEndian.Uint64(b[56:]),
+				Left:       binary.BigEndian.Uint64(b[64:]),
+				Uploaded:   binary.BigEndian.Uint64(b[72:]),
+				Event:      binary.BigEndian.Uint32(b[80:]),
+			}
+			copy(r.InfoHash[:], b[16:])
+			f.announces = append(f.announces, r)
+			if f.ignoreAnnounces {
+				f.mx.Unlock()
+				continue
+			}
+
+			if r.InfoHash == f.errorInfoHash {
+				binary.BigEndian.PutUint32(resp, actionError)
+				resp = append(resp, "unregistered torrent"...)
+			} else {
+				resp = binary.BigEndian.AppendUint32(resp, 1800)
+				resp = binary.BigEndian.AppendUint32(resp, 1)
+				resp = binary.BigEndian.AppendUint32(resp, 2)
+				resp = append(resp, NewTorrentPeer(netip.MustParseAddr("10.0.0.1"), 6881).Compact()...)
+			}
+		case actionScrape:
+			// Each info hash gets its first byte as seeders, completed and leechers
+			for i := 16; i+20 <= n; i += 20 {
+				v := uint32(b[i])
+				resp = binary.BigEndian.AppendUint32(resp, v)
+				resp = binary.BigEndian.AppendUint32(resp, v+1)
+				resp = binary.BigEndian.AppendUint32(resp, v+2)
+			}
+		}
+		f.mx.Unlock()
+
+		f.conn.WriteTo(resp, addr)
+	}
+}
+
+func TestUDPTrackerAnnounce(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	tracker := NewUDPTracker(f.conn.LocalAddr().String())
+
+	r := AnnounceRequest{Uploaded: 1, Downloaded: 2, Left: 3, Event: EventCompleted, NumWant: -1}
+	res, err := tracker.Announce(r)
+	handleTestErr(err, t)
+
+	if len(res.Peers) != 1 || res.Peers[0].String() != "10.0.0.1:6881" || res.interval != 1800 {
+		t.Errorf("unexpected announce response: %+v", res)
+	}
+
+	_, err = tracker.Announce(r)
+	handleTestErr(err, t)
+
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if f.connects != 1 {
+		t.Errorf("the connection id should be reused but connected %v times", f.connects)
+	}
+
+	got := f.announces[0]
+	if got.Uploaded != 1 || got.Downloaded != 2 || got.Left != 3 || got.Event != EventCompleted {
+		t.Errorf("announce didn't carry the request values: %+v", got)
+	}
+}
+
+func TestUDPTrackerError(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	tracker := NewUDPTracker(f.conn.LocalAddr().String())
+
+	_, err := tracker.Announce(AnnounceRequest{InfoHash: f.errorInfoHash})
+	if err == nil || err.Error() != "Tracker error: unregistered torrent" {
+		t.Errorf("expected the tracker's error message but got: %v", err)
+	}
+}
+
+func TestUDPTrackerScrape(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	tracker := NewUDPTracker(f.conn.LocalAddr().String())
+
+	infoHashes := make([][20]byte, maxUDPScrapeInfoHashes+2)
+	for i := range infoHashes {
+		infoHashes[i][0] = byte(i)
+	}
+
+	res, err := tracker.Scrape(infoHashes...)
+	handleTestErr(err, t)
+
+	if len(res) != len(infoHashes) {
+		t.Fatalf("expected %v scrape responses but got: %v", len(infoHashes), len(res))
+	}
+
+	last := res[len(res)-1]
+	expected := ScrapeResponse{InfoHash: infoHashes[len(infoHashes)-1], Seeders: 75, Completed: 76, Leechers: 77}
+	if last != expected {
+		t.Errorf("expected %+v but got: %+v", expected, last)
+	}
+}
+
+func TestUDPTrackerRetransmits(t *testing.T) {
+	defer func(timeout time.Duration, retries int) {
+		UDPTrackerTimeout, UDPTrackerRetries = timeout, retries
+	}(UDPTrackerTimeout, UDPTrackerRetries)
+	UDPTrackerTimeout, UDPTrackerRetries = 20*time.Millisecond, 3
+
+	f := newFakeUDPTracker(t)
+	f.mx.Lock()
+	f.drop = 2
+	f.mx.Unlock()
+	tracker := NewUDPTracker(f.conn.LocalAddr().String())
+
+	_, err := tracker.Announce(AnnounceRequest{})
+	handleTestErr(err, t)
+
+	// Nothing answers so we should give up after the last retry
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	handleTestErr(err, t)
+	defer silent.Close()
+
+	_, err = NewUDPTracker(silent.LocalAddr().String()).Announce(AnnounceRequest{})
+	if !errors.Is(err, errUDPTrackerTimeout) {
+		t.Errorf("expected a timeout but got: %v", err)
+	}
+}
+
+func TestUDPTrackerRequestsDontWaitForEachOther(t *testing.T) {
+	defer func(timeout time.Duration, retries int) {
+		UDPTrackerTimeout, UDPTrackerRetries = timeout, retries
+	}(UDPTrackerTimeout, UDPTrackerRetries)
+	UDPTrackerTimeout, UDPTrackerRetries = time.Second, 0
+
+	f := newFakeUDPTracker(t)
+	f.mx.Lock()
+	f.ignoreAnnounces = true
+	f.mx.Unlock()
+	tracker := NewUDPTracker(f.conn.LocalAddr().String())
+
+	announced := make(chan error)
+	go func() {
+		_, err := tracker.Announce(AnnounceRequest{})
+		announced <- err
+	}()
+	for {
+		f.mx.Lock()
+		n := len(f.announces)
+		f.mx.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	_, err := tracker.Scrape([20]byte{1})
+	handleTestErr(err, t)
+	if time.Since(start) >= UDPTrackerTimeout/2 {
+		t.Errorf("The scrape waited %s for the unanswered announce", time.Since(start))
+	}
+
+	if err := <-announced; !errors.Is(err, errUDPTrackerTimeout) {
+		t.Errorf("expected the announce to time out but got: %v", err)
+	}
+}
+
+func TestTrackersPeerFetcherAnnounceRequest(t *testing.T) {
+	fetcher := NewTrackersPeerFetcher([20]byte{1}, []string{"udp://tracker.example.com:6969"})
+	fetcher.SetAnnounceStats(func() AnnounceStats { return AnnounceStats{Uploaded: 10, Downloaded: 20, Left: 30} })
+
+	r := fetcher.announceRequest("udp://tracker.example.com:6969")
+	if r.Event != EventStarted || r.Uploaded != 10 || r.Downloaded != 20 || r.Left != 30 {
+		t.Errorf("first announce should be started with the session stats but got: %+v", r)
+	}
+
+	if r.PeerId != fetcher.announceRequest("udp://tracker.example.com:6969").PeerId {
+		t.Errorf("the peer id should be the same for every announce")
+	}
+}
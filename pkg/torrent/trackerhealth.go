@@ -0,0 +1,242 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+	"tor/pkg/bencode"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How long a probe waits for a tracker to answer
+var TrackerProbeTimeout = 2 * time.Second
+
+// Trackers that failed this many times in a row are tried after the others
+// until TrackerFailureBackoff has passed since their last failure
+var TrackerMaxFailures = 3
+var TrackerFailureBackoff = 10 * time.Minute
+
+// TrackerStats is the history of talking to a tracker
+type TrackerStats struct {
+	// Smoothed round trip time of successful requests
+	Latency             time.Duration
+	Successes           int
+	Failures            int
+	ConsecutiveFailures int
+	LastSuccess         time.Time
+	LastFailure         time.Time
+}
+
+// TrackerHealthChecker keeps track of which trackers answer and how quickly
+type TrackerHealthChecker struct {
+	mx       sync.Mutex
+	trackers map[string]*TrackerStats
+}
+
+// DefaultTrackerHealth is shared by everything talking to trackers
+var DefaultTrackerHealth = NewTrackerHealthChecker()
+
+func NewTrackerHealthChecker() *TrackerHealthChecker {
+	return &TrackerHealthChecker{trackers: make(map[string]*TrackerStats)}
+}
+
+// Record adds the result of a request to a tracker to its history
+func (h *TrackerHealthChecker) Record(trackerUrl string, latency time.Duration, err error) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	s, ok := h.trackers[trackerUrl]
+	if !ok {
+		s = &TrackerStats{}
+		h.trackers[trackerUrl] = s
+	}
+
+	if err != nil {
+		s.Failures++
+		s.ConsecutiveFailures++
+		s.LastFailure = time.Now()
+		return
+	}
+
+	if s.Successes == 0 {
+		s.Latency = latency
+	} else {
+		s.Latency = (7*s.Latency + latency) / 8
+	}
+	s.Successes++
+	s.ConsecutiveFailures = 0
+	s.LastSuccess = time.Now()
+}
+
+func (h *TrackerHealthChecker) Stats(trackerUrl string) (TrackerStats, bool) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	s, ok := h.trackers[trackerUrl]
+	if !ok {
+		return TrackerStats{}, false
+	}
+	return *s, true
+}
+
+// Healthy is false for trackers that keep failing, trackers we haven't
+// heard from yet are given a chance
+func (h *TrackerHealthChecker) Healthy(trackerUrl string) bool {
+	s, ok := h.Stats(trackerUrl)
+	if !ok {
+		return true
+	}
+	return s.ConsecutiveFailures < TrackerMaxFailures || time.Since(s.LastFailure) > TrackerFailureBackoff
+}
+
+// Sort orders trackers by health, healthy ones by latency with the ones we
+// don't know about after them and failing ones last
+func (h *TrackerHealthChecker) Sort(trackerUrls []string) []string {
+	type entry struct {
+		url     string
+		rank    int
+		latency time.Duration
+	}
+
+	entries := make([]entry, len(trackerUrls))
+	for i, u := range trackerUrls {
+		s, known := h.Stats(u)
+		switch {
+		case !h.Healthy(u):
+			entries[i] = entry{u, 2, 0}
+		case !known || s.Successes == 0:
+			entries[i] = entry{u, 1, 0}
+		default:
+			entries[i] = entry{u, 0, s.Latency}
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].rank != entries[j].rank {
+			return entries[i].rank < entries[j].rank
+		}
+		return entries[i].latency < entries[j].latency
+	})
+
+	sorted := make([]string, len(entries))
+	for i, e := range entries {
+		sorted[i] = e.url
+	}
+	return sorted
+}
+
+// healthyFirst moves failing trackers to the end without otherwise changing
+// the order
+func (h *TrackerHealthChecker) healthyFirst(trackerUrls []string) []string {
+	ordered := make([]string, 0, len(trackerUrls))
+	var failing []string
+	for _, u := range trackerUrls {
+		if h.Healthy(u) {
+			ordered = append(ordered, u)
+		} else {
+			failing = append(failing, u)
+		}
+	}
+	return append(ordered, failing...)
+}
+
+// Probe checks a tracker answers with a UDP connect or an HTTP announce for
+// a made up torrent, the result is recorded
+func (h *TrackerHealthChecker) Probe(trackerUrl string) error {
+	start := time.Now()
+	err := probeTracker(trackerUrl)
+	h.Record(trackerUrl, time.Since(start), err)
+	return err
+}
+
+// LiveTrackerUrls probes the trackers at the same time and keeps the ones
+// that answer, sorted by health
+func (h *TrackerHealthChecker) LiveTrackerUrls(trackerUrls []string) []string {
+	var wg sync.WaitGroup
+	var mx sync.Mutex
+	live := make([]string, 0, len(trackerUrls))
+
+	for _, u := range trackerUrls {
+		wg.Add(1)
+		go func(u string) {
+			defer wg.Done()
+			if err := h.Probe(u); err != nil {
+				log.Debugf("Tracker %s didn't answer probe: %s", u, err)
+				return
+			}
+			mx.Lock()
+			live = append(live, u)
+			mx.Unlock()
+		}(u)
+	}
+	wg.Wait()
+	return h.Sort(live)
+}
+
+// LiveTrackerUrls probes the trackers with DefaultTrackerHealth
+func LiveTrackerUrls(trackerUrls []string) []string {
+	return DefaultTrackerHealth.LiveTrackerUrls(trackerUrls)
+}
+
+func probeTracker(trackerUrl string) error {
+	u, err := url.Parse(trackerUrl)
+	if err != nil {
+		return err
+	}
+
+	switch u.Scheme {
+	case "udp":
+		return probeUDPTracker(u.Host)
+	case "http", "https":
+		return probeHTTPTracker(trackerUrl)
+	}
+	return fmt.Errorf("Unsupported tracker scheme: %s", u.Scheme)
+}
+
+func probeUDPTracker(addr string) error {
+	conn, err := net.DialTimeout("udp", addr, TrackerProbeTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = (&UDPTracker{addr: addr}).roundTrip(conn.(*net.UDPConn), actionConnect, TrackerProbeTimeout, genConnectionPacket)
+	return err
+}
+
+// probeHTTPTracker announces a random info hash, the tracker not knowing
+// the torrent still means it's up
+func probeHTTPTracker(announceUrl string) error {
+	r := AnnounceRequest{Key: rand.Uint32(), NumWant: 0, Port: uint16(ListenPort)}
+	rand.Read(r.InfoHash[:])
+	r.PeerId = GenPeerId()
+
+	client := http.Client{Timeout: TrackerProbeTimeout}
+	res, err := client.Get(NewHTTPTracker(announceUrl).announceQuery(r))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxHTTPTrackerResponse))
+	if err != nil {
+		return err
+	}
+
+	decoded, err := bencode.Decode(body)
+	if err != nil {
+		return fmt.Errorf("Tracker returned %s", res.Status)
+	}
+
+	if _, ok := decoded.(map[string]interface{}); !ok {
+		return fmt.Errorf("Expected a dictionary from the tracker")
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package torrent
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTrackerHealthSort(t *testing.T) {
+	h := NewTrackerHealthChecker()
+	h.Record("udp://slow:1", 300*time.Millisecond, nil)
+	h.Record("udp://fast:1", 50*time.Millisecond, nil)
+	for i := 0; i < TrackerMaxFailures; i++ {
+		h.Record("udp://failing:1", 0, errors.New("no"))
+	}
+
+	sorted := h.Sort([]string{"udp://failing:1", "udp://unknown:1", "udp://slow:1", "udp://fast:1"})
+	expected := []string{"udp://fast:1", "udp://slow:1", "udp://unknown:1", "udp://failing:1"}
+	for i := range expected {
+		if sorted[i] != expected[i] {
+			t.Fatalf("expected %v but got: %v", expected, sorted)
+		}
+	}
+
+	if h.Healthy("udp://failing:1") {
+		t.Errorf("a tracker that keeps failing shouldn't be healthy")
+	}
+
+	h.Record("udp://failing:1", time.Millisecond, nil)
+	if !h.Healthy("udp://failing:1") {
+		t.Errorf("a tracker that answers again should be healthy")
+	}
+}
+
+func TestTrackerHealthProbe(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	udpUrl := "udp://" + f.conn.LocalAddr().String()
+
+	// Not knowing the torrent still counts as the tracker being up
+	s := newTestHTTPTracker(t, func(q url.Values) map[string]interface{} {
+		return map[string]interface{}{"failure reason": []byte("unregistered torrent")}
+	})
+	httpUrl := s.URL + "/announce"
+
+	notTracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer notTracker.Close()
+
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	handleTestErr(err, t)
+	defer silent.Close()
+
+	defer func(timeout time.Duration) { TrackerProbeTimeout = timeout }(TrackerProbeTimeout)
+	TrackerProbeTimeout = 100 * time.Millisecond
+
+	h := NewTrackerHealthChecker()
+	live := h.LiveTrackerUrls([]string{udpUrl, httpUrl, notTracker.URL + "/announce", "udp://" + silent.LocalAddr().String()})
+	if len(live) != 2 {
+		t.Fatalf("expected only the UDP and HTTP trackers to be live but got: %v", live)
+	}
+
+	stats, ok := h.Stats(udpUrl)
+	if !ok || stats.Successes != 1 || stats.Latency <= 0 {
+		t.Errorf("the probe should be recorded but got: %+v", stats)
+	}
+
+	if stats, _ := h.Stats(notTracker.URL + "/announce"); stats.Failures != 1 {
+		t.Errorf("the failed probe should be recorded but got: %+v", stats)
+	}
+}
+
+func TestTrackersPeerFetcherSkipsFailingTrackers(t *testing.T) {
+	first := &fakeTracker{}
+	second := &fakeTracker{}
+	fetcher := newTieredTestFetcher([][]*fakeTracker{{first, second}})
+	fetcher.tiers[0] = []string{"udp://tracker0-0.example.com:6969", "udp://tracker0-1.example.com:6969"}
+
+	for i := 0; i < TrackerMaxFailures; i++ {
+		fetcher.health.Record("udp://tracker0-0.example.com:6969", 0, errors.New("no"))
+	}
+
+	now := time.Now()
+	if fetcher.inUse("udp://tracker0-0.example.com:6969", now) || !fetcher.inUse("udp://tracker0-1.example.com:6969", now) {
+		t.Errorf("the failing tracker should be tried last")
+	}
+
+	_, err := fetcher.announceTo("udp://tracker0-1.example.com:6969", fetcher.newAnnounceRequest(AnnounceStats{}, EventStarted))
+	handleTestErr(err, t)
+
+	if stats, _ := fetcher.health.Stats("udp://tracker0-1.example.com:6969"); stats.Successes != 1 {
+		t.Errorf("announces should be recorded but got: %+v", stats)
+	}
+}
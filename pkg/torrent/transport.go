@@ -0,0 +1,219 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"tor/pkg/mse"
+	"tor/pkg/utp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type TransportPolicy int
+
+const (
+	PreferTCP TransportPolicy = iota
+	PreferUTP
+)
+
+func (p TransportPolicy) String() string {
+	switch p {
+	case PreferTCP:
+		return "tcp"
+	case PreferUTP:
+		return "utp"
+	}
+	return "unknown"
+}
+
+const tcpDialTimeout = 500 * time.Millisecond
+
+// uTP has to wait for the SYN to be acked over UDP so give it longer
+const utpDialTimeout = 2 * time.Second
+
+// Which transport is tried first for outgoing peer connections
+var Transport = PreferTCP
+
+// Socket used for uTP peer connections, only TCP is used when nil. It
+// should be listening on ListenPort so peers can connect back to us.
+var UTPSocket *utp.Socket
+
+// Listener for TCP peer connections, shared by every session. Nothing's
+// accepted over TCP when nil. It should be listening on ListenPort
+var TCPListener net.Listener
+
+func dialTCP(addr string) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, tcpDialTimeout)
+}
+
+func dialUTP(addr string) (net.Conn, error) {
+	if UTPSocket == nil {
+		return nil, errors.New("uTP is disabled")
+	}
+	return UTPSocket.DialTimeout(addr, utpDialTimeout)
+}
+
+// dialPeer connects to a peer over the preferred transport falling back to
+// the other one if it fails
+func dialPeer(addr string) (net.Conn, error) {
+	if UTPSocket == nil {
+		return dialTCP(addr)
+	}
+
+	first, second := dialTCP, dialUTP
+	if Transport == PreferUTP {
+		first, second = dialUTP, dialTCP
+	}
+
+	conn, err := first(addr)
+	if err == nil {
+		return conn, nil
+	}
+	log.Debugf("Connecting to %s over %v failed, trying the other transport: %s", addr, Transport, err)
+
+	conn, err2 := second(addr)
+	if err2 != nil {
+		return nil, errors.Join(err, err2)
+	}
+	return conn, nil
+}
+
+// incomingPeers gives the peer connections accepted on our listeners to the
+// session for the torrent they're for, so the listeners can be shared
+var incomingPeers = &peerRouter{
+	sessions:  make(map[[20]byte]routedSession),
+	listening: make(map[net.Listener]bool),
+}
+
+type routedSession struct {
+	conns chan<- net.Conn
+	stop  <-chan struct{}
+}
+
+type peerRouter struct {
+	mx        sync.Mutex
+	sessions  map[[20]byte]routedSession
+	listening map[net.Listener]bool
+}
+
+// register sends the connections for a torrent to conns until stop is closed
+func (r *peerRouter) register(infoHash [20]byte, conns chan<- net.Conn, stop <-chan struct{}) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.sessions[infoHash] = routedSession{conns, stop}
+}
+
+// unregister stops routing a torrent's connections to the session that
+// registered with stop, a newer session for the same torrent keeps its own
+func (r *peerRouter) unregister(infoHash [20]byte, stop <-chan struct{}) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.sessions[infoHash].stop == stop {
+		delete(r.sessions, infoHash)
+	}
+}
+
+func (r *peerRouter) infoHashes() [][20]byte {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	infoHashes := make([][20]byte, 0, len(r.sessions))
+	for infoHash := range r.sessions {
+		infoHashes = append(infoHashes, infoHash)
+	}
+	return infoHashes
+}
+
+// listen accepts connections on l until it's closed, only one loop runs for
+// each listener however many sessions use it
+func (r *peerRouter) listen(l net.Listener) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.listening[l] {
+		return
+	}
+	r.listening[l] = true
+
+	go func() {
+		defer func() {
+			r.mx.Lock()
+			delete(r.listening, l)
+			r.mx.Unlock()
+		}()
+
+		for {
+			conn, err := l.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			go r.route(conn)
+		}
+	}()
+}
+
+// route finds the session for a connection from the info hash in its
+// handshake, the connection's closed if we don't have a session for it
+func (r *peerRouter) route(conn net.Conn) {
+	c, infoHash, err := acceptHandshake(conn, r.infoHashes())
+	if err != nil {
+		log.Warnf("Error from handshake with %s: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	r.mx.Lock()
+	s, ok := r.sessions[infoHash]
+	r.mx.Unlock()
+	if !ok {
+		log.Debugf("%s wants %x which we don't have a session for", conn.RemoteAddr(), infoHash)
+		conn.Close()
+		return
+	}
+
+	select {
+	case s.conns <- c:
+	case <-s.stop:
+		conn.Close()
+	}
+}
+
+// acceptHandshake does the encryption handshake and reads the start of the
+// BitTorrent handshake for its info hash. The conn returned gives the
+// handshake again so the session can read all of it
+func acceptHandshake(conn net.Conn, infoHashes [][20]byte) (net.Conn, [20]byte, error) {
+	c, err := mse.Accept(conn, infoHashes, EncryptionPolicy)
+	if err != nil {
+		return nil, [20]byte{}, err
+	}
+
+	c.SetReadDeadline(time.Now().Add(mse.HandshakeTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	// pstrlen, pstr, reserved and info hash
+	start := make([]byte, 48)
+	if _, err := io.ReadFull(c, start); err != nil {
+		return nil, [20]byte{}, err
+	}
+	if start[0] != 19 || string(start[1:20]) != PSTR {
+		return nil, [20]byte{}, errors.New("Not a BitTorrent handshake")
+	}
+	return &replayConn{c, io.MultiReader(bytes.NewReader(start), c)}, [20]byte(start[28:]), nil
+}
+
+// replayConn reads from r, which starts with what was already read from the
+// connection
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
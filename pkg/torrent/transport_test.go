@@ -0,0 +1,180 @@
+package torrent
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+	"tor/pkg/mse"
+	"tor/pkg/utp"
+)
+
+func TestDialPeerPrefersUTP(t *testing.T) {
+	client, err := utp.Listen("udp", "127.0.0.1:0")
+	handleTestErr(err, t)
+	defer client.Close()
+
+	server, err := utp.Listen("udp", "127.0.0.1:0")
+	handleTestErr(err, t)
+	defer server.Close()
+
+	go func() {
+		c, err := server.Accept()
+		if err == nil {
+			c.Close()
+		}
+	}()
+
+	UTPSocket, Transport = client, PreferUTP
+	defer func() { UTPSocket, Transport = nil, PreferTCP }()
+
+	conn, err := dialPeer(server.Addr().String())
+	handleTestErr(err, t)
+	defer conn.Close()
+
+	if _, ok := conn.(*utp.Conn); !ok {
+		t.Errorf("expected a uTP connection but got: %T", conn)
+	}
+}
+
+func TestDialPeerFallsBackToTCP(t *testing.T) {
+	client, err := utp.Listen("udp", "127.0.0.1:0")
+	handleTestErr(err, t)
+	defer client.Close()
+
+	// Only TCP is listening here so uTP will fail
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	handleTestErr(err, t)
+	defer ln.Close()
+
+	UTPSocket, Transport = client, PreferUTP
+	defer func() { UTPSocket, Transport = nil, PreferTCP }()
+
+	conn, err := dialPeer(ln.Addr().String())
+	handleTestErr(err, t)
+	defer conn.Close()
+
+	if _, ok := conn.(*net.TCPConn); !ok {
+		t.Errorf("expected to fall back to TCP but got: %T", conn)
+	}
+}
+
+func TestIncomingPeersAreRoutedByInfoHash(t *testing.T) {
+	server, err := utp.Listen("udp", "127.0.0.1:0")
+	handleTestErr(err, t)
+	defer server.Close()
+
+	client, err := utp.Listen("udp", "127.0.0.1:0")
+	handleTestErr(err, t)
+	defer client.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	a, b := [20]byte{1}, [20]byte{2}
+	connsA, connsB := make(chan net.Conn), make(chan net.Conn)
+	incomingPeers.register(a, connsA, stop)
+	incomingPeers.register(b, connsB, stop)
+	defer incomingPeers.unregister(a, stop)
+	defer incomingPeers.unregister(b, stop)
+	incomingPeers.listen(server)
+	incomingPeers.listen(server)
+
+	connect := func(infoHash [20]byte, policy mse.Policy) []byte {
+		conn, err := client.Dial(server.Addr().String())
+		handleTestErr(err, t)
+		t.Cleanup(func() { conn.Close() })
+
+		var c net.Conn = conn
+		if policy != mse.Disabled {
+			c, err = mse.Initiate(conn, infoHash, policy)
+			handleTestErr(err, t)
+		}
+		handshake := (&PeerConnection{InfoHash: infoHash}).getHandshakeMessage()
+		_, err = c.Write(handshake)
+		handleTestErr(err, t)
+		return handshake
+	}
+
+	expectHandshake := func(conns chan net.Conn, handshake []byte) {
+		select {
+		case conn := <-conns:
+			defer conn.Close()
+			buf := make([]byte, len(handshake))
+			_, err := io.ReadFull(conn, buf)
+			handleTestErr(err, t)
+			if !bytes.Equal(buf, handshake) {
+				t.Errorf("Expected the session to read the whole handshake but got: %x", buf)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("The connection wasn't routed to its session")
+		}
+	}
+
+	expectHandshake(connsB, connect(b, mse.Disabled))
+	expectHandshake(connsA, connect(a, mse.Required))
+}
+
+func TestSessionsShareTCPListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	handleTestErr(err, t)
+	TCPListener = l
+	defer func() {
+		TCPListener = nil
+		l.Close()
+	}()
+
+	newSession := func(infoHash [20]byte) *TorrentSession {
+		ts := &TorrentSession{
+			InfoHash:       infoHash,
+			TorrentInfo:    TorrentInfo{Pieces: make([]byte, 20), PieceLength: 16384, Length: 16384},
+			pieceBitField:  NewThreadSafeBitfield(make([]byte, 1)),
+			connectedPeers: make(map[netip.AddrPort]bool),
+			peerSlots:      make(chan struct{}, Threads),
+			stop:           make(chan struct{}),
+		}
+		go ts.acceptPeers()
+		t.Cleanup(ts.Stop)
+		return ts
+	}
+	a, b := newSession([20]byte{1}), newSession([20]byte{2})
+
+	for _, ts := range []*TorrentSession{b, a} {
+		var conn net.Conn
+		// The session may not have registered yet
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			conn, err = net.Dial("tcp", l.Addr().String())
+			handleTestErr(err, t)
+			_, err = conn.Write((&PeerConnection{InfoHash: ts.InfoHash}).getHandshakeMessage())
+			handleTestErr(err, t)
+
+			res := make([]byte, 68)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = io.ReadFull(conn, res)
+			if err == nil {
+				if [20]byte(res[28:48]) != ts.InfoHash {
+					t.Errorf("Expected the handshake for %x but got %x", ts.InfoHash, res[28:48])
+				}
+				break
+			}
+			conn.Close()
+			if time.Now().After(deadline) {
+				t.Fatalf("No session answered for %x: %s", ts.InfoHash, err)
+			}
+		}
+		defer conn.Close()
+	}
+
+	for _, ts := range []*TorrentSession{a, b} {
+		// The peer's counted once our side of the handshake is done too
+		deadline := time.Now().Add(5 * time.Second)
+		for ts.Stats().Peers != 1 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if peers := ts.Stats().Peers; peers != 1 {
+			t.Errorf("Expected a peer for %x but got %v", ts.InfoHash, peers)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A web seed that fails waits WebSeedRetryDelay before being used again,
+// doubling on each failure up to MaxWebSeedBackoff
+var WebSeedRetryDelay = 5 * time.Second
+var MaxWebSeedBackoff = 10 * time.Minute
+
+var webSeedClient = &http.Client{Timeout: 60 * time.Second}
+
+// WebSeed downloads pieces from an HTTP server with the torrent's files
+// (BEP 19)
+type WebSeed struct {
+	url  string
+	info TorrentInfo
+
+	failures int
+	retryAt  time.Time
+}
+
+func NewWebSeed(seedUrl string, info TorrentInfo) (*WebSeed, error) {
+	u, err := url.Parse(seedUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("Unsupported web seed scheme: %s", u.Scheme)
+	}
+	return &WebSeed{url: seedUrl, info: info}, nil
+}
+
+// fileRange is the part of a file a piece covers
+type fileRange struct {
+	path   []string
+	offset int64
+	length int64
+}
+
+// pieceRanges maps a piece onto the files it spans
+func (ws *WebSeed) pieceRanges(pieceIndex, pieceSize int) []fileRange {
+	start := int64(pieceIndex) * int64(ws.info.PieceLength)
+	end := start + int64(pieceSize)
+
+	if ws.info.IsSingleFile() {
+		return []fileRange{{offset: start, length: end - start}}
+	}
+
+	var ranges []fileRange
+	var fileStart int64
+	for _, f := range ws.info.Files {
+		fileEnd := fileStart + int64(f.Length)
+		if fileEnd > start && fileStart < end {
+			from := start
+			if fileStart > from {
+				from = fileStart
+			}
+			to := end
+			if fileEnd < to {
+				to = fileEnd
+			}
+			ranges = append(ranges, fileRange{path: f.Path, offset: from - fileStart, length: to - from})
+		}
+		fileStart = fileEnd
+	}
+	return ranges
+}
+
+// fileUrl follows BEP 19, a URL ending in / is a directory the torrent's
+// name is added to, multi-file torrents always are
+func (ws *WebSeed) fileUrl(path []string) string {
+	if ws.info.IsSingleFile() {
+		if strings.HasSuffix(ws.url, "/") {
+			return ws.url + url.PathEscape(ws.info.Name)
+		}
+		return ws.url
+	}
+
+	base := ws.url
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+
+	parts := []string{url.PathEscape(ws.info.Name)}
+	for _, p := range path {
+		parts = append(parts, url.PathEscape(p))
+	}
+	return base + strings.Join(parts, "/")
+}
+
+func (ws *WebSeed) GetPiece(pieceIndex, pieceSize int) ([]byte, error) {
+	piece := make([]byte, 0, pieceSize)
+	for _, r := range ws.pieceRanges(pieceIndex, pieceSize) {
+		b, err := ws.getRange(ws.fileUrl(r.path), r.offset, r.length)
+		if err != nil {
+			return nil, err
+		}
+		piece = append(piece, b...)
+	}
+	return piece, nil
+}
+
+func (ws *WebSeed) getRange(fileUrl string, offset, length int64) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, fileUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%v-%v", offset, offset+length-1))
+
+	res, err := webSeedClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body := io.Reader(res.Body)
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range so skip to it
+		if _, err := io.CopyN(io.Discard, body, offset); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Web seed %s returned %s", fileUrl, res.Status)
+	}
+
+	b := make([]byte, length)
+	if _, err := io.ReadFull(body, b); err != nil {
+		return nil, fmt.Errorf("Web seed %s: %w", fileUrl, err)
+	}
+	return b, nil
+}
+
+// backoff is how long to wait before using the web seed again
+func (ws *WebSeed) backoff(now time.Time) time.Duration {
+	if now.Before(ws.retryAt) {
+		return ws.retryAt.Sub(now)
+	}
+	return 0
+}
+
+func (ws *WebSeed) failed(now time.Time) {
+	ws.failures++
+	delay := WebSeedRetryDelay << (ws.failures - 1)
+	if delay > MaxWebSeedBackoff || delay <= 0 {
+		delay = MaxWebSeedBackoff
+	}
+	ws.retryAt = now.Add(delay)
+}
+
+func (ws *WebSeed) succeeded() {
+	ws.failures = 0
+	ws.retryAt = time.Time{}
+}
+
+// AddWebSeeds adds the torrent's url-list, they're used like peers once the
+// session starts
+func (ts *TorrentSession) AddWebSeeds(urls []string) {
+	for _, u := range urls {
+		ws, err := NewWebSeed(u, ts.TorrentInfo)
+		if err != nil {
+			log.Warnf("Skipping web seed %s: %s", u, err)
+			continue
+		}
+		ts.webSeeds = append(ts.webSeeds, ws)
+	}
+}
+
+// handleWebSeed takes work from the piece picker like a peer connection
+func (ts *TorrentSession) handleWebSeed(ws *WebSeed) {
+	for !ts.gotAllPieces() {
+		if wait := ws.backoff(time.Now()); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ts.stop:
+				return
+			}
+		}
+
+		var pieceIndex int
+		select {
+		case pieceIndex = <-ts.workChan:
+		case <-ts.stop:
+			return
+		}
+
+		piece, err := ws.GetPiece(pieceIndex, ts.pieceSize(pieceIndex))
+		if err != nil {
+			ws.failed(time.Now())
+			log.Warnf("Error getting piece %v from web seed, backing off: %s", pieceIndex, err)
+			ts.failedWorkChan <- pieceIndex
+			continue
+		}
+
+		log.Infof("Downloaded Piece: %v from web seed\n", pieceIndex)
+		if !ts.savePiece(pieceIndex, piece) {
+			ws.failed(time.Now())
+			continue
+		}
+		ws.succeeded()
+	}
+}
@@ -0,0 +1,134 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWebSeedPieceRanges(t *testing.T) {
+	ws, err := NewWebSeed("http://example.com/seeds", TorrentInfo{
+		Name:        "dir",
+		PieceLength: 10,
+		Files:       []TorrentFile{{Length: 4, Path: []string{"a"}}, {Length: 12, Path: []string{"sub", "b c"}}, {Length: 10, Path: []string{"d"}}},
+	})
+	handleTestErr(err, t)
+
+	ranges := ws.pieceRanges(1, 10)
+	if len(ranges) != 2 || ranges[0].offset != 6 || ranges[0].length != 6 || ranges[1].offset != 0 || ranges[1].length != 4 {
+		t.Errorf("unexpected ranges for a piece spanning files: %+v", ranges)
+	}
+
+	if u := ws.fileUrl(ranges[0].path); u != "http://example.com/seeds/dir/sub/b%20c" {
+		t.Errorf("unexpected file url: %s", u)
+	}
+
+	single, err := NewWebSeed("http://example.com/files/", TorrentInfo{Name: "f.iso", Length: 10, PieceLength: 10})
+	handleTestErr(err, t)
+	if u := single.fileUrl(nil); u != "http://example.com/files/f.iso" {
+		t.Errorf("a directory url should have the name added but got: %s", u)
+	}
+
+	if _, err := NewWebSeed("ftp://example.com/f.iso", TorrentInfo{}); err == nil {
+		t.Errorf("FTP web seeds aren't supported")
+	}
+}
+
+func TestWebSeedDownload(t *testing.T) {
+	seedDir := t.TempDir()
+	torrentDir := filepath.Join(seedDir, "webseeded")
+	handleTestErr(os.MkdirAll(filepath.Join(torrentDir, "sub"), 0755), t)
+
+	ti := TorrentInfo{
+		Name:        "webseeded",
+		PieceLength: 16384,
+		Files:       []TorrentFile{{Length: 10000, Path: []string{"a"}}, {Length: 5, Path: []string{"sub", "b"}}, {Length: 30000, Path: []string{"c"}}},
+	}
+
+	var all []byte
+	for _, f := range ti.Files {
+		b := make([]byte, f.Length)
+		rand.Read(b)
+		handleTestErr(os.WriteFile(filepath.Join(torrentDir, filepath.Join(f.Path...)), b, 0644), t)
+		all = append(all, b...)
+	}
+
+	for i := 0; i < len(all); i += ti.PieceLength {
+		end := i + ti.PieceLength
+		if end > len(all) {
+			end = len(all)
+		}
+		h := sha1.Sum(all[i:end])
+		ti.Pieces = append(ti.Pieces, h[:]...)
+	}
+
+	s := httptest.NewServer(http.FileServer(http.Dir(seedDir)))
+	defer s.Close()
+
+	downloadDir := t.TempDir()
+	ts := NewTorrentSessionWithDir([20]byte{1}, ti, MultiPeerFetcher{}, downloadDir)
+	ts.AddWebSeeds([]string{s.URL})
+
+	done := make(chan struct{})
+	go func() {
+		ts.StartSession()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatalf("timed out downloading from the web seed")
+	}
+	ts.Stop()
+
+	var got []byte
+	for _, f := range ti.Files {
+		b, err := os.ReadFile(filepath.Join(downloadDir, ti.Name, filepath.Join(f.Path...)))
+		handleTestErr(err, t)
+		got = append(got, b...)
+	}
+
+	if !bytes.Equal(got, all) {
+		t.Errorf("the files weren't downloaded properly")
+	}
+}
+
+func TestWebSeedBacksOff(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "", http.StatusServiceUnavailable)
+	}))
+	defer s.Close()
+
+	ws, err := NewWebSeed(s.URL+"/f", TorrentInfo{Name: "f", Length: 10, PieceLength: 10})
+	handleTestErr(err, t)
+
+	if _, err := ws.GetPiece(0, 10); err == nil {
+		t.Fatalf("expected an error from the web seed")
+	}
+
+	now := time.Now()
+	ws.failed(now)
+	ws.failed(now)
+	if ws.backoff(now) != 2*WebSeedRetryDelay {
+		t.Errorf("the backoff should double but got: %v", ws.backoff(now))
+	}
+
+	for i := 0; i < 30; i++ {
+		ws.failed(now)
+	}
+	if ws.backoff(now) != MaxWebSeedBackoff {
+		t.Errorf("the backoff should be capped but got: %v", ws.backoff(now))
+	}
+
+	ws.succeeded()
+	if ws.backoff(now) != 0 {
+		t.Errorf("a success should reset the backoff")
+	}
+}
@@ -0,0 +1,166 @@
+package tracker
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"tor/pkg/bencode"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ServeHTTP answers announces on /announce and scrapes on /scrape
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var resp map[string]interface{}
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/announce"):
+		resp = s.handleHTTPAnnounce(r)
+	case strings.HasSuffix(r.URL.Path, "/scrape"):
+		resp = s.handleHTTPScrape(r)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	b, err := bencode.Encode(resp)
+	if err != nil {
+		log.Errorf("Couldn't encode tracker response: %s", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(b)
+}
+
+func httpFailure(reason string) map[string]interface{} {
+	return map[string]interface{}{"failure reason": []byte(reason)}
+}
+
+func (s *Server) handleHTTPAnnounce(r *http.Request) map[string]interface{} {
+	q, err := parseQuery(r.URL.RawQuery)
+	if err != nil {
+		return httpFailure("Bad query")
+	}
+
+	ar := AnnounceRequest{NumWant: -1}
+	if !copyHash(ar.InfoHash[:], q.Get("info_hash")) || !copyHash(ar.PeerId[:], q.Get("peer_id")) {
+		return httpFailure("info_hash and peer_id must be 20 bytes")
+	}
+
+	port, err := strconv.ParseUint(q.Get("port"), 10, 16)
+	if err != nil || port == 0 {
+		return httpFailure("Bad port")
+	}
+
+	remote, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return httpFailure("Couldn't work out your address")
+	}
+	ar.Addr = netip.AddrPortFrom(remote.Addr().Unmap(), uint16(port))
+
+	ar.Uploaded, _ = strconv.ParseUint(q.Get("uploaded"), 10, 64)
+	ar.Downloaded, _ = strconv.ParseUint(q.Get("downloaded"), 10, 64)
+	ar.Left, _ = strconv.ParseUint(q.Get("left"), 10, 64)
+	if n, err := strconv.Atoi(q.Get("numwant")); err == nil {
+		ar.NumWant = n
+	}
+
+	switch q.Get("event") {
+	case "started":
+		ar.Event = EventStarted
+	case "completed":
+		ar.Event = EventCompleted
+	case "stopped":
+		ar.Event = EventStopped
+	}
+
+	res, err := s.Announce(ar)
+	if err != nil {
+		return httpFailure(err.Error())
+	}
+
+	resp := map[string]interface{}{
+		"interval":     int(res.Interval / time.Second),
+		"min interval": int(res.MinInterval / time.Second),
+		"complete":     res.Seeders,
+		"incomplete":   res.Leechers,
+	}
+
+	if q.Get("compact") == "0" {
+		peers := make([]interface{}, 0, len(res.Peers))
+		for _, p := range res.Peers {
+			peers = append(peers, map[string]interface{}{
+				"peer id": p.PeerId[:],
+				"ip":      []byte(p.Addr.Addr().String()),
+				"port":    int(p.Addr.Port()),
+			})
+		}
+		resp["peers"] = peers
+	} else {
+		resp["peers"] = appendCompactPeers([]byte{}, res.Peers, false)
+		resp["peers6"] = appendCompactPeers([]byte{}, res.Peers, true)
+	}
+	return resp
+}
+
+func (s *Server) handleHTTPScrape(r *http.Request) map[string]interface{} {
+	q, err := parseQuery(r.URL.RawQuery)
+	if err != nil {
+		return httpFailure("Bad query")
+	}
+
+	var infoHashes [][20]byte
+	for _, v := range q["info_hash"] {
+		var ih [20]byte
+		if !copyHash(ih[:], v) {
+			return httpFailure(fmt.Sprintf("Bad info_hash: %x", v))
+		}
+		infoHashes = append(infoHashes, ih)
+	}
+
+	files := make(map[string]interface{})
+	for ih, sr := range s.Scrape(infoHashes...) {
+		files[string(ih[:])] = map[string]interface{}{
+			"complete":   sr.Seeders,
+			"downloaded": sr.Completed,
+			"incomplete": sr.Leechers,
+		}
+	}
+	return map[string]interface{}{"files": files}
+}
+
+// parseQuery is url.ParseQuery without turning + into a space, clients don't
+// always escape it in binary values like info_hash and peer_id
+func parseQuery(rawQuery string) (url.Values, error) {
+	q := make(url.Values)
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+
+		k, v, _ := strings.Cut(pair, "=")
+		key, err := url.PathUnescape(k)
+		if err != nil {
+			return nil, err
+		}
+		value, err := url.PathUnescape(v)
+		if err != nil {
+			return nil, err
+		}
+		q[key] = append(q[key], value)
+	}
+	return q, nil
+}
+
+func copyHash(dst []byte, v string) bool {
+	if len(v) != 20 {
+		return false
+	}
+	copy(dst, v)
+	return true
+}
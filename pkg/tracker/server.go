@@ -0,0 +1,254 @@
+package tracker
+
+import (
+	"crypto/rand"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Interval given to clients between announces
+var AnnounceInterval = 30 * time.Minute
+var MinAnnounceInterval = time.Minute
+
+// Peers that haven't announced for this long are dropped
+var PeerTimeout = 45 * time.Minute
+
+// Peers given when the client doesn't ask for a number, and the most given
+var DefaultNumWant = 50
+var MaxNumWant = 200
+
+// Announce events, the values are the ones used by UDP trackers
+const (
+	EventNone      uint32 = 0
+	EventCompleted uint32 = 1
+	EventStarted   uint32 = 2
+	EventStopped   uint32 = 3
+)
+
+var errNotWhitelisted = errors.New("Torrent not allowed on this tracker")
+
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerId     [20]byte
+	Addr       netip.AddrPort
+	Downloaded uint64
+	Left       uint64
+	Uploaded   uint64
+	Event      uint32
+	// Negative for the default
+	NumWant int
+}
+
+type Peer struct {
+	PeerId [20]byte
+	Addr   netip.AddrPort
+}
+
+type AnnounceResponse struct {
+	Interval    time.Duration
+	MinInterval time.Duration
+	Seeders     int
+	Leechers    int
+	Peers       []Peer
+}
+
+type ScrapeResponse struct {
+	Seeders int
+	// Number of times the torrent has been downloaded
+	Completed int
+	Leechers  int
+}
+
+type swarmPeer struct {
+	Peer
+	left     uint64
+	lastSeen time.Time
+}
+
+type swarm struct {
+	peers     map[netip.AddrPort]*swarmPeer
+	completed int
+}
+
+// empty swarms can be forgotten, the completed count is kept for scrapes
+func (s *swarm) empty() bool {
+	return len(s.peers) == 0 && s.completed == 0
+}
+
+func (s *swarm) counts() (seeders, leechers int) {
+	for _, p := range s.peers {
+		if p.left == 0 {
+			seeders++
+		} else {
+			leechers++
+		}
+	}
+	return seeders, leechers
+}
+
+// Server keeps the swarms in memory and answers announces and scrapes
+// over UDP (ServeUDP) and HTTP (it's an http.Handler)
+type Server struct {
+	mx     sync.Mutex
+	swarms map[[20]byte]*swarm
+	// Empty allows every torrent
+	whitelist map[[20]byte]bool
+
+	// Signs UDP connection ids so we don't have to remember them
+	secret [16]byte
+}
+
+func NewServer() *Server {
+	s := &Server{
+		swarms:    make(map[[20]byte]*swarm),
+		whitelist: make(map[[20]byte]bool),
+	}
+	rand.Read(s.secret[:])
+	return s
+}
+
+// Allow adds torrents to the whitelist, once anything is on it only
+// whitelisted torrents are tracked
+func (s *Server) Allow(infoHashes ...[20]byte) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for _, ih := range infoHashes {
+		s.whitelist[ih] = true
+	}
+}
+
+func (s *Server) allowed(infoHash [20]byte) bool {
+	return len(s.whitelist) == 0 || s.whitelist[infoHash]
+}
+
+func (s *Server) Announce(r AnnounceRequest) (AnnounceResponse, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if !s.allowed(r.InfoHash) {
+		return AnnounceResponse{}, errNotWhitelisted
+	}
+
+	now := time.Now()
+	sw, ok := s.swarms[r.InfoHash]
+	if !ok {
+		sw = &swarm{peers: make(map[netip.AddrPort]*swarmPeer)}
+		s.swarms[r.InfoHash] = sw
+	}
+	expireSwarm(sw, now)
+
+	if r.Event == EventStopped {
+		delete(sw.peers, r.Addr)
+	} else {
+		p, ok := sw.peers[r.Addr]
+		if r.Event == EventCompleted && (!ok || p.left != 0) {
+			sw.completed++
+		}
+		if !ok {
+			p = &swarmPeer{}
+			sw.peers[r.Addr] = p
+		}
+		p.Peer = Peer{PeerId: r.PeerId, Addr: r.Addr}
+		p.left = r.Left
+		p.lastSeen = now
+	}
+
+	res := AnnounceResponse{Interval: AnnounceInterval, MinInterval: MinAnnounceInterval}
+	res.Seeders, res.Leechers = sw.counts()
+	if r.Event != EventStopped {
+		res.Peers = pickPeers(sw, r)
+	}
+
+	if sw.empty() {
+		delete(s.swarms, r.InfoHash)
+	}
+	return res, nil
+}
+
+// pickPeers gives up to NumWant other peers, seeders only get leechers.
+// Map iteration order is random so different peers get different peers.
+func pickPeers(sw *swarm, r AnnounceRequest) []Peer {
+	numWant := r.NumWant
+	if numWant < 0 {
+		numWant = DefaultNumWant
+	}
+	if numWant > MaxNumWant {
+		numWant = MaxNumWant
+	}
+
+	peers := make([]Peer, 0, numWant)
+	for addr, p := range sw.peers {
+		if len(peers) >= numWant {
+			break
+		}
+		if addr == r.Addr || (r.Left == 0 && p.left == 0) {
+			continue
+		}
+		peers = append(peers, p.Peer)
+	}
+	return peers
+}
+
+// Scrape gives the counts of the torrents that are tracked, others are
+// left out
+func (s *Server) Scrape(infoHashes ...[20]byte) map[[20]byte]ScrapeResponse {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	now := time.Now()
+	res := make(map[[20]byte]ScrapeResponse, len(infoHashes))
+	for _, ih := range infoHashes {
+		if !s.allowed(ih) {
+			continue
+		}
+
+		sw, ok := s.swarms[ih]
+		if !ok {
+			continue
+		}
+		expireSwarm(sw, now)
+
+		seeders, leechers := sw.counts()
+		res[ih] = ScrapeResponse{Seeders: seeders, Completed: sw.completed, Leechers: leechers}
+	}
+	return res
+}
+
+// ExpirePeers drops the peers that stopped announcing from every swarm,
+// swarms are otherwise only tidied when they're announced to
+func (s *Server) ExpirePeers() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	now := time.Now()
+	for ih, sw := range s.swarms {
+		expireSwarm(sw, now)
+		if sw.empty() {
+			delete(s.swarms, ih)
+		}
+	}
+}
+
+// RunExpiry calls ExpirePeers until stop is closed
+func (s *Server) RunExpiry(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.ExpirePeers()
+		}
+	}
+}
+
+func expireSwarm(sw *swarm, now time.Time) {
+	for addr, p := range sw.peers {
+		if now.Sub(p.lastSeen) > PeerTimeout {
+			delete(sw.peers, addr)
+		}
+	}
+}
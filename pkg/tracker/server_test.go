@@ -0,0 +1,177 @@
+package tracker
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+	"tor/pkg/torrent"
+)
+
+func handleTestErr(err error, t *testing.T) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerAnnounce(t *testing.T) {
+	s := NewServer()
+	infoHash := [20]byte{1}
+	seeder := netip.MustParseAddrPort("10.0.0.1:6881")
+	leecher := netip.MustParseAddrPort("10.0.0.2:6881")
+
+	_, err := s.Announce(AnnounceRequest{InfoHash: infoHash, Addr: seeder, Event: EventStarted, NumWant: -1})
+	handleTestErr(err, t)
+
+	res, err := s.Announce(AnnounceRequest{InfoHash: infoHash, Addr: leecher, Left: 10, Event: EventStarted, NumWant: -1})
+	handleTestErr(err, t)
+	if res.Seeders != 1 || res.Leechers != 1 || len(res.Peers) != 1 || res.Peers[0].Addr != seeder {
+		t.Errorf("the leecher should get the seeder but got: %+v", res)
+	}
+
+	res, err = s.Announce(AnnounceRequest{InfoHash: infoHash, Addr: leecher, Event: EventCompleted, NumWant: -1})
+	handleTestErr(err, t)
+	if res.Seeders != 2 || len(res.Peers) != 0 {
+		t.Errorf("seeders shouldn't be given other seeders but got: %+v", res)
+	}
+
+	_, err = s.Announce(AnnounceRequest{InfoHash: infoHash, Addr: seeder, Event: EventStopped})
+	handleTestErr(err, t)
+
+	sr := s.Scrape(infoHash)[infoHash]
+	if sr.Seeders != 1 || sr.Completed != 1 || sr.Leechers != 0 {
+		t.Errorf("unexpected scrape after the seeder stopped: %+v", sr)
+	}
+}
+
+func TestServerExpiresPeers(t *testing.T) {
+	defer func(timeout time.Duration) { PeerTimeout = timeout }(PeerTimeout)
+	PeerTimeout = time.Millisecond
+
+	s := NewServer()
+	infoHash := [20]byte{1}
+	_, err := s.Announce(AnnounceRequest{InfoHash: infoHash, Addr: netip.MustParseAddrPort("10.0.0.1:6881"), Left: 10})
+	handleTestErr(err, t)
+
+	time.Sleep(5 * time.Millisecond)
+	s.ExpirePeers()
+	if len(s.Scrape(infoHash)) != 0 {
+		t.Errorf("the swarm should be gone once its peers expire")
+	}
+}
+
+func TestServerWhitelist(t *testing.T) {
+	s := NewServer()
+	s.Allow([20]byte{1})
+
+	if _, err := s.Announce(AnnounceRequest{InfoHash: [20]byte{2}}); err == nil {
+		t.Errorf("torrents that aren't whitelisted should be refused")
+	}
+
+	if _, err := s.Announce(AnnounceRequest{InfoHash: [20]byte{1}, Addr: netip.MustParseAddrPort("10.0.0.1:6881")}); err != nil {
+		t.Errorf("whitelisted torrents should be allowed but got: %s", err)
+	}
+}
+
+func TestServerUDP(t *testing.T) {
+	s := NewServer()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	handleTestErr(err, t)
+	defer conn.Close()
+	go s.ServeUDP(conn)
+
+	infoHash := [20]byte{1}
+	other := netip.MustParseAddrPort("10.0.0.1:6881")
+	_, err = s.Announce(AnnounceRequest{InfoHash: infoHash, Addr: other, Left: 10})
+	handleTestErr(err, t)
+
+	client := torrent.NewUDPTracker(conn.LocalAddr().String())
+	res, err := client.Announce(torrent.AnnounceRequest{InfoHash: infoHash, Left: 10, Port: 6882, NumWant: -1})
+	handleTestErr(err, t)
+	if len(res.Peers) != 1 || res.Peers[0].AddrPort != other {
+		t.Errorf("expected the other peer but got: %v", res.Peers)
+	}
+
+	sr, err := client.Scrape(infoHash, [20]byte{2})
+	handleTestErr(err, t)
+	if len(sr) != 2 || sr[0].Leechers != 2 || sr[1].Leechers != 0 {
+		t.Errorf("unexpected scrape: %+v", sr)
+	}
+
+	s.Allow(infoHash)
+	_, err = client.Announce(torrent.AnnounceRequest{InfoHash: [20]byte{2}})
+	if err == nil || err.Error() != "Tracker error: "+errNotWhitelisted.Error() {
+		t.Errorf("expected the whitelist error but got: %v", err)
+	}
+}
+
+func TestServerUDPConnectionIds(t *testing.T) {
+	s := NewServer()
+	addr := netip.MustParseAddr("10.0.0.1")
+	now := time.Now()
+
+	id := s.connectionId(addr, now)
+	if !s.validConnectionId(id, addr, now.Add(udpConnectionIdWindow)) {
+		t.Errorf("connection ids should last into the next window")
+	}
+	if s.validConnectionId(id, addr, now.Add(2*udpConnectionIdWindow)) {
+		t.Errorf("connection ids should expire")
+	}
+	if s.validConnectionId(id, netip.MustParseAddr("10.0.0.2"), now) {
+		t.Errorf("connection ids should only work from the address they were given to")
+	}
+}
+
+func TestServerHTTP(t *testing.T) {
+	s := NewServer()
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+
+	infoHash := [20]byte{1, ' ', '+'}
+	other := netip.MustParseAddrPort("[2001:db8::1]:6881")
+	_, err := s.Announce(AnnounceRequest{InfoHash: infoHash, Addr: other, Left: 10})
+	handleTestErr(err, t)
+
+	client := torrent.NewHTTPTracker(hs.URL + "/announce")
+	res, err := client.Announce(torrent.AnnounceRequest{InfoHash: infoHash, Left: 10, Port: 6882, NumWant: -1})
+	handleTestErr(err, t)
+	if len(res.Peers) != 1 || res.Peers[0].AddrPort != other {
+		t.Errorf("expected the IPv6 peer but got: %v", res.Peers)
+	}
+
+	sr, err := client.Scrape(infoHash, [20]byte{2})
+	handleTestErr(err, t)
+	if len(sr) != 1 || sr[0].InfoHash != infoHash || sr[0].Leechers != 2 {
+		t.Errorf("unexpected scrape: %+v", sr)
+	}
+}
+
+// Some clients leave + unescaped in info_hash and peer_id
+func TestServerHTTPUnescapedPlus(t *testing.T) {
+	s := NewServer()
+	hs := httptest.NewServer(s)
+	defer hs.Close()
+
+	infoHash := [20]byte{1, '+'}
+	query := "info_hash=%01+" + strings.Repeat("%00", 18) + "&peer_id=" + strings.Repeat("+", 20) + "&port=6881&left=10"
+	res, err := http.Get(hs.URL + "/announce?" + query)
+	handleTestErr(err, t)
+	res.Body.Close()
+
+	if sr := s.Scrape(infoHash)[infoHash]; sr.Leechers != 1 {
+		t.Errorf("expected the announce to be for %x but got: %+v", infoHash, s.Scrape(infoHash))
+	}
+
+	res, err = http.Get(hs.URL + "/scrape?info_hash=%01+" + strings.Repeat("%00", 18))
+	handleTestErr(err, t)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	handleTestErr(err, t)
+	if !strings.Contains(string(body), string(infoHash[:])) {
+		t.Errorf("expected the scrape to have %x but got: %q", infoHash, body)
+	}
+}
@@ -0,0 +1,180 @@
+package tracker
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// UDP tracker actions (BEP 15)
+const (
+	actionConnect  uint32 = 0
+	actionAnnounce uint32 = 1
+	actionScrape   uint32 = 2
+	actionError    uint32 = 3
+)
+
+const udpTrackerProtocolId uint64 = 0x41727101980
+
+// Connection ids are good for the window they're made in and the next one,
+// so between one and two minutes
+const udpConnectionIdWindow = time.Minute
+
+// Most info hashes in a UDP scrape
+const maxUDPScrapeInfoHashes = 74
+
+// ServeUDP answers UDP tracker requests on conn until it's closed
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		resp := s.handleUDP(buf[:n], udpAddr.AddrPort(), time.Now())
+		if resp == nil {
+			continue
+		}
+
+		if _, err := conn.WriteTo(resp, addr); err != nil {
+			log.Debugf("Couldn't reply to %s: %s", addr, err)
+		}
+	}
+}
+
+// handleUDP gives the response to a request or nil to ignore it
+func (s *Server) handleUDP(b []byte, from netip.AddrPort, now time.Time) []byte {
+	if len(b) < 16 {
+		return nil
+	}
+
+	connectionId := binary.BigEndian.Uint64(b)
+	action := binary.BigEndian.Uint32(b[8:])
+	transactionId := binary.BigEndian.Uint32(b[12:])
+	from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+
+	if action == actionConnect {
+		if connectionId != udpTrackerProtocolId {
+			return nil
+		}
+		resp := udpHeader(actionConnect, transactionId)
+		return binary.BigEndian.AppendUint64(resp, s.connectionId(from.Addr(), now))
+	}
+
+	if !s.validConnectionId(connectionId, from.Addr(), now) {
+		return udpError(transactionId, "Connection id expired")
+	}
+
+	switch action {
+	case actionAnnounce:
+		return s.handleUDPAnnounce(b, from, transactionId)
+	case actionScrape:
+		return s.handleUDPScrape(b, transactionId)
+	}
+	return udpError(transactionId, "Unknown action")
+}
+
+func (s *Server) handleUDPAnnounce(b []byte, from netip.AddrPort, transactionId uint32) []byte {
+	if len(b) < 98 {
+		return udpError(transactionId, "Announce too short")
+	}
+
+	r := AnnounceRequest{
+		Downloaded: binary.BigEndian.Uint64(b[56:]),
+		Left:       binary.BigEndian.Uint64(b[64:]),
+		Uploaded:   binary.BigEndian.Uint64(b[72:]),
+		Event:      binary.BigEndian.Uint32(b[80:]),
+		NumWant:    int(int32(binary.BigEndian.Uint32(b[92:]))),
+		// The IP address field is ignored, peers are where the packet came from
+		Addr: netip.AddrPortFrom(from.Addr(), binary.BigEndian.Uint16(b[96:])),
+	}
+	copy(r.InfoHash[:], b[16:])
+	copy(r.PeerId[:], b[36:])
+
+	res, err := s.Announce(r)
+	if err != nil {
+		return udpError(transactionId, err.Error())
+	}
+
+	resp := udpHeader(actionAnnounce, transactionId)
+	resp = binary.BigEndian.AppendUint32(resp, uint32(res.Interval/time.Second))
+	resp = binary.BigEndian.AppendUint32(resp, uint32(res.Leechers))
+	resp = binary.BigEndian.AppendUint32(resp, uint32(res.Seeders))
+	// Peers of the same address family as the request
+	return appendCompactPeers(resp, res.Peers, from.Addr().Is6())
+}
+
+func (s *Server) handleUDPScrape(b []byte, transactionId uint32) []byte {
+	var infoHashes [][20]byte
+	for i := 16; i+20 <= len(b) && len(infoHashes) < maxUDPScrapeInfoHashes; i += 20 {
+		var ih [20]byte
+		copy(ih[:], b[i:])
+		infoHashes = append(infoHashes, ih)
+	}
+
+	scraped := s.Scrape(infoHashes...)
+	resp := udpHeader(actionScrape, transactionId)
+	for _, ih := range infoHashes {
+		// Unknown torrents are all zeros since the response is positional
+		sr := scraped[ih]
+		resp = binary.BigEndian.AppendUint32(resp, uint32(sr.Seeders))
+		resp = binary.BigEndian.AppendUint32(resp, uint32(sr.Completed))
+		resp = binary.BigEndian.AppendUint32(resp, uint32(sr.Leechers))
+	}
+	return resp
+}
+
+func (s *Server) connectionId(addr netip.Addr, now time.Time) uint64 {
+	return s.connectionIdForWindow(addr, now.Unix()/int64(udpConnectionIdWindow/time.Second))
+}
+
+func (s *Server) validConnectionId(connectionId uint64, addr netip.Addr, now time.Time) bool {
+	window := now.Unix() / int64(udpConnectionIdWindow/time.Second)
+	return connectionId == s.connectionIdForWindow(addr, window) || connectionId == s.connectionIdForWindow(addr, window-1)
+}
+
+func (s *Server) connectionIdForWindow(addr netip.Addr, window int64) uint64 {
+	mac := hmac.New(sha1.New, s.secret[:])
+	b, _ := addr.MarshalBinary()
+	mac.Write(b)
+	binary.Write(mac, binary.BigEndian, window)
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+func udpHeader(action uint32, transactionId uint32) []byte {
+	b := binary.BigEndian.AppendUint32(make([]byte, 0, 20), action)
+	return binary.BigEndian.AppendUint32(b, transactionId)
+}
+
+func udpError(transactionId uint32, msg string) []byte {
+	return append(udpHeader(actionError, transactionId), msg...)
+}
+
+// appendCompactPeers adds the 6 byte IPv4 or 18 byte IPv6 compact form of
+// the peers of one address family
+func appendCompactPeers(b []byte, peers []Peer, ipv6 bool) []byte {
+	for _, p := range peers {
+		if p.Addr.Addr().Is6() != ipv6 {
+			continue
+		}
+		addr, _ := p.Addr.Addr().MarshalBinary()
+		b = append(b, addr...)
+		b = binary.BigEndian.AppendUint16(b, p.Addr.Port())
+	}
+	return b
+}
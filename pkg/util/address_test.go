@@ -3,8 +3,8 @@ package util
 import "testing"
 
 func TestParseTrackerAddressFromUrls(t *testing.T) {
-	urls := []string{"udp://open.stealth.si:80/announcee", "udp://tracker.tiny-vps.com:6969/announcee"}
-	expectedAddresses := []string{"open.stealth.si:80", "tracker.tiny-vps.com:6969"}
+	urls := []string{"udp://open.stealth.si:80/announcee", "udp://tracker.tiny-vps.com:6969/announcee", "udp://[2001:db8::1]:6969/announce", "http://tracker.example.com/announce", "https://tracker.example.com/announce?passkey=abc"}
+	expectedAddresses := []string{"open.stealth.si:80", "tracker.tiny-vps.com:6969", "[2001:db8::1]:6969", "tracker.example.com:80", "tracker.example.com:443"}
 	trackerAddresses := ParseTrackerAddressFromUrls(urls)
 
 	for i := range expectedAddresses {
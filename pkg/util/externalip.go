@@ -0,0 +1,108 @@
+package util
+
+import (
+	"net/netip"
+	"sync"
+)
+
+// MaxExternalIPVoters bounds how many sources are remembered when voting
+var MaxExternalIPVoters = 256
+
+// ExternalIPVoter works out our external IP from what other hosts (peers,
+// DHT nodes, trackers) report seeing us connect from. Each source gets a
+// single vote so one host can't sway the result on its own.
+type ExternalIPVoter struct {
+	mx     sync.Mutex
+	votes  map[string]netip.Addr
+	order  []string
+	counts map[netip.Addr]int
+}
+
+// ExternalIP is the voter shared by the torrent and dht packages
+var ExternalIP = NewExternalIPVoter()
+
+func NewExternalIPVoter() *ExternalIPVoter {
+	return &ExternalIPVoter{
+		votes:  make(map[string]netip.Addr),
+		counts: make(map[netip.Addr]int),
+	}
+}
+
+// Vote records that source saw us as addr. Addresses that can't be our
+// external address (private, loopback etc) are ignored.
+func (v *ExternalIPVoter) Vote(source string, addr netip.Addr) {
+	addr = addr.Unmap()
+	if !IsGlobalAddr(addr) {
+		return
+	}
+
+	v.mx.Lock()
+	defer v.mx.Unlock()
+
+	if prev, voted := v.votes[source]; voted {
+		v.counts[prev]--
+		if v.counts[prev] <= 0 {
+			delete(v.counts, prev)
+		}
+	} else {
+		v.order = append(v.order, source)
+		if len(v.order) > MaxExternalIPVoters {
+			v.forget(v.order[0])
+			v.order = v.order[1:]
+		}
+	}
+
+	v.votes[source] = addr
+	v.counts[addr]++
+}
+
+func (v *ExternalIPVoter) forget(source string) {
+	prev, voted := v.votes[source]
+	if !voted {
+		return
+	}
+	delete(v.votes, source)
+	v.counts[prev]--
+	if v.counts[prev] <= 0 {
+		delete(v.counts, prev)
+	}
+}
+
+// Get returns the address with the most votes
+func (v *ExternalIPVoter) Get() (netip.Addr, bool) {
+	return v.get(func(netip.Addr) bool { return true })
+}
+
+// GetFamily returns the address with the most votes for IPv4 or IPv6
+func (v *ExternalIPVoter) GetFamily(ipv6 bool) (netip.Addr, bool) {
+	return v.get(func(a netip.Addr) bool { return a.Is6() == ipv6 })
+}
+
+func (v *ExternalIPVoter) get(include func(netip.Addr) bool) (netip.Addr, bool) {
+	v.mx.Lock()
+	defer v.mx.Unlock()
+
+	var best netip.Addr
+	bestCount := 0
+	for addr, count := range v.counts {
+		if !include(addr) {
+			continue
+		}
+		// Break ties on the address so the result is stable
+		if count > bestCount || (count == bestCount && addr.Less(best)) {
+			best = addr
+			bestCount = count
+		}
+	}
+	return best, bestCount > 0
+}
+
+// IsGlobalAddr reports whether addr is routable on the internet
+func IsGlobalAddr(addr netip.Addr) bool {
+	return addr.IsValid() &&
+		!addr.IsUnspecified() &&
+		!addr.IsLoopback() &&
+		!addr.IsPrivate() &&
+		!addr.IsLinkLocalUnicast() &&
+		!addr.IsMulticast()
+}
@@ -0,0 +1,60 @@
+package util
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestExternalIPVoting(t *testing.T) {
+	v := NewExternalIPVoter()
+
+	if _, ok := v.Get(); ok {
+		t.Errorf("shouldn't have an external IP without any votes")
+	}
+
+	a := netip.MustParseAddr("203.0.113.7")
+	b := netip.MustParseAddr("198.51.100.1")
+
+	v.Vote("peer1", a)
+	v.Vote("peer2", a)
+	v.Vote("peer3", b)
+
+	if ip, _ := v.Get(); ip != a {
+		t.Errorf("expected external IP to be %s but got: %s", a, ip)
+	}
+
+	// The same source changing its mind shouldn't count twice
+	v.Vote("peer3", b)
+	v.Vote("peer1", b)
+	if ip, _ := v.Get(); ip != b {
+		t.Errorf("expected external IP to be %s but got: %s", b, ip)
+	}
+}
+
+func TestExternalIPIgnoresLocalAddresses(t *testing.T) {
+	v := NewExternalIPVoter()
+	v.Vote("peer1", netip.MustParseAddr("192.168.1.2"))
+	v.Vote("peer2", netip.MustParseAddr("127.0.0.1"))
+	v.Vote("peer3", netip.MustParseAddr("::ffff:10.0.0.1"))
+
+	if ip, ok := v.Get(); ok {
+		t.Errorf("shouldn't use local addresses but got: %s", ip)
+	}
+}
+
+func TestExternalIPFamily(t *testing.T) {
+	v := NewExternalIPVoter()
+	v4 := netip.MustParseAddr("203.0.113.7")
+	v6 := netip.MustParseAddr("2001:db8::1")
+	v.Vote("peer1", v4)
+	v.Vote("peer2", v6)
+	v.Vote("peer3", v6)
+
+	if ip, _ := v.GetFamily(false); ip != v4 {
+		t.Errorf("expected IPv4 external IP to be %s but got: %s", v4, ip)
+	}
+
+	if ip, _ := v.GetFamily(true); ip != v6 {
+		t.Errorf("expected IPv6 external IP to be %s but got: %s", v6, ip)
+	}
+}
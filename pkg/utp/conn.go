@@ -0,0 +1,569 @@
+package utp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	maxPayloadSize = 1200
+	// Bytes we'll buffer for the application before advertising a zero window
+	recvBufferSize = 1 << 20
+	// How far ahead of the last in order packet we'll keep packets
+	maxReorderDistance = 2048
+	maxRetransmits     = 8
+
+	minRTO     = 500 * time.Millisecond
+	initialRTO = time.Second
+	maxRTO     = 30 * time.Second
+	tickPeriod = 50 * time.Millisecond
+
+	closeLinger = 10 * time.Second
+)
+
+var ErrConnReset = errors.New("uTP connection reset by peer")
+var ErrConnTimeout = errors.New("uTP connection timed out")
+
+type connState int
+
+const (
+	stateSynSent connState = iota
+	stateConnected
+	stateClosed
+)
+
+type outgoingPacket struct {
+	typ           packetType
+	seqNr         uint16
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+}
+
+// Conn is a single uTP connection. It implements net.Conn so it can be used
+// wherever a TCP connection would be.
+type Conn struct {
+	socket *Socket
+	remote net.Addr
+	recvId uint16
+	sendId uint16
+
+	mx      sync.Mutex
+	changed chan struct{}
+	done    chan struct{}
+	state   connState
+	err     error
+
+	// Sending
+	seqNr     uint16
+	outgoing  []*outgoingPacket
+	inFlight  int
+	cc        *ledbat
+	peerWnd   uint32
+	rtt       time.Duration
+	rttVar    time.Duration
+	rto       time.Duration
+	lastAckNr uint16
+	dupAcks   int
+	finSent   bool
+	// Highest sequence number sent when we noticed a loss, until it's acked
+	// we're recovering and retransmit each hole as soon as it's uncovered
+	recovering bool
+	recoverNr  uint16
+
+	// Receiving
+	ackNr         uint16
+	replyMicro    uint32
+	readBuf       []byte
+	reorder       map[uint16]*outgoingPacket
+	eof           bool
+	closedLocally bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(s *Socket, remote net.Addr, recvId, sendId uint16) *Conn {
+	return &Conn{
+		socket:  s,
+		remote:  remote,
+		recvId:  recvId,
+		sendId:  sendId,
+		changed: make(chan struct{}),
+		done:    make(chan struct{}),
+		cc:      newLedbat(),
+		peerWnd: recvBufferSize,
+		rto:     initialRTO,
+		reorder: make(map[uint16]*outgoingPacket),
+	}
+}
+
+// broadcast wakes anything waiting on the connection state. Must hold mx.
+func (c *Conn) broadcast() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// wait releases mx until the connection state changes or the deadline passes
+func (c *Conn) wait(deadline time.Time) error {
+	changed := c.changed
+	c.mx.Unlock()
+	defer c.mx.Lock()
+
+	if deadline.IsZero() {
+		<-changed
+		return nil
+	}
+
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-changed:
+		return nil
+	case <-t.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (c *Conn) recvWindow() uint32 {
+	if len(c.readBuf) >= recvBufferSize {
+		return 0
+	}
+	return uint32(recvBufferSize - len(c.readBuf))
+}
+
+// sendPacket writes a packet to the socket. Must hold mx.
+func (c *Conn) sendPacket(typ packetType, seqNr uint16, payload []byte) {
+	h := header{
+		typ:           typ,
+		connId:        c.sendId,
+		timestamp:     timestampMicro(time.Now()),
+		timestampDiff: c.replyMicro,
+		wndSize:       c.recvWindow(),
+		seqNr:         seqNr,
+		ackNr:         c.ackNr,
+	}
+	if typ == stSyn {
+		h.connId = c.recvId
+	}
+	c.socket.writeTo(h.marshal(payload), c.remote)
+}
+
+// queuePacket sends a packet that takes up a sequence number and keeps it
+// until it's acked. Must hold mx.
+func (c *Conn) queuePacket(typ packetType, payload []byte) {
+	p := &outgoingPacket{
+		typ:           typ,
+		seqNr:         c.seqNr,
+		payload:       payload,
+		sentAt:        time.Now(),
+		transmissions: 1,
+	}
+	c.seqNr++
+	c.outgoing = append(c.outgoing, p)
+	c.inFlight += len(payload)
+	c.sendPacket(p.typ, p.seqNr, p.payload)
+}
+
+func (c *Conn) resend(p *outgoingPacket) {
+	p.sentAt = time.Now()
+	p.transmissions++
+	c.sendPacket(p.typ, p.seqNr, p.payload)
+}
+
+func (c *Conn) sendAck() {
+	c.sendPacket(stState, c.seqNr, nil)
+}
+
+// handlePacket processes a packet from the socket addressed to this connection
+func (c *Conn) handlePacket(h header, payload []byte, now time.Time) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	defer c.broadcast()
+
+	if c.state == stateClosed {
+		return
+	}
+
+	c.replyMicro = timestampMicro(now) - h.timestamp
+
+	if h.typ == stReset {
+		c.fail(ErrConnReset)
+		return
+	}
+
+	if h.typ == stSyn {
+		// Our state packet must have been lost
+		c.sendAck()
+		return
+	}
+
+	if c.state == stateSynSent {
+		if h.typ != stState {
+			return
+		}
+		c.state = stateConnected
+		c.ackNr = h.seqNr - 1
+	}
+
+	c.peerWnd = h.wndSize
+	c.handleAck(h, now)
+
+	if h.typ == stData || h.typ == stFin {
+		c.handleData(h, payload)
+		c.sendAck()
+	}
+}
+
+func (c *Conn) handleAck(h header, now time.Time) {
+	bytesAcked := 0
+	retransmitted := false
+	var newest *outgoingPacket
+	for len(c.outgoing) > 0 && !seqLess(h.ackNr, c.outgoing[0].seqNr) {
+		p := c.outgoing[0]
+		c.outgoing = c.outgoing[1:]
+		c.inFlight -= len(p.payload)
+		bytesAcked += len(p.payload)
+		retransmitted = retransmitted || p.transmissions > 1
+		newest = p
+	}
+
+	// Acks that cover a retransmission include the time spent recovering so
+	// they don't give a fair round trip time
+	if newest != nil && !retransmitted {
+		c.updateRTT(now.Sub(newest.sentAt))
+	}
+
+	if bytesAcked > 0 || (len(c.outgoing) == 0 && h.ackNr != c.lastAckNr) {
+		c.dupAcks = 0
+		c.resetRTO()
+		c.cc.onAck(h.timestampDiff, bytesAcked, now)
+
+		if c.recovering {
+			if len(c.outgoing) == 0 || !seqLess(h.ackNr, c.recoverNr) {
+				c.recovering = false
+			} else {
+				// Partial ack, the next packet was lost too
+				c.resend(c.outgoing[0])
+			}
+		}
+	} else if h.typ == stState && len(c.outgoing) > 0 && h.ackNr == c.lastAckNr {
+		c.dupAcks++
+		if c.dupAcks == 3 && !c.recovering {
+			// Fast retransmit, the packet after the one being acked was lost
+			c.cc.onLoss()
+			c.startRecovery()
+		}
+	}
+	c.lastAckNr = h.ackNr
+}
+
+// startRecovery retransmits the oldest unacked packet and keeps retransmitting
+// on partial acks until everything sent so far has been acked
+func (c *Conn) startRecovery() {
+	c.recovering = true
+	c.recoverNr = c.seqNr - 1
+	c.resend(c.outgoing[0])
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+
+	c.resetRTO()
+}
+
+// resetRTO recalculates the retransmit timeout dropping any backoff
+func (c *Conn) resetRTO() {
+	if c.rtt == 0 {
+		return
+	}
+
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < minRTO {
+		c.rto = minRTO
+	}
+}
+
+func (c *Conn) handleData(h header, payload []byte) {
+	if !seqLess(c.ackNr, h.seqNr) {
+		// Already have it
+		return
+	}
+
+	if h.seqNr-c.ackNr > maxReorderDistance {
+		return
+	}
+
+	c.reorder[h.seqNr] = &outgoingPacket{typ: h.typ, seqNr: h.seqNr, payload: append([]byte{}, payload...)}
+
+	for {
+		p, ok := c.reorder[c.ackNr+1]
+		if !ok {
+			break
+		}
+		delete(c.reorder, p.seqNr)
+		c.ackNr = p.seqNr
+
+		if p.typ == stFin {
+			c.eof = true
+			break
+		}
+		c.readBuf = append(c.readBuf, p.payload...)
+	}
+}
+
+// tick retransmits packets that haven't been acked in time
+func (c *Conn) tick(now time.Time) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.state == stateClosed || len(c.outgoing) == 0 {
+		return
+	}
+
+	oldest := c.outgoing[0]
+	if now.Sub(oldest.sentAt) < c.rto {
+		return
+	}
+
+	if oldest.transmissions > maxRetransmits {
+		c.fail(ErrConnTimeout)
+		return
+	}
+
+	c.cc.onTimeout()
+	c.rto *= 2
+	if c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+	c.startRecovery()
+	c.broadcast()
+}
+
+func (c *Conn) timerLoop() {
+	t := time.NewTicker(tickPeriod)
+	defer t.Stop()
+
+	for {
+		select {
+		case now := <-t.C:
+			c.tick(now)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// fail closes the connection with an error. Must hold mx.
+func (c *Conn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.destroy()
+}
+
+// destroy releases the connection. Must hold mx.
+func (c *Conn) destroy() {
+	if c.state == stateClosed {
+		return
+	}
+	c.state = stateClosed
+	close(c.done)
+	c.socket.removeConn(c)
+	c.broadcast()
+}
+
+// waitConnected blocks until the SYN has been acked
+func (c *Conn) waitConnected(deadline time.Time) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	for c.state == stateSynSent {
+		err := c.wait(deadline)
+		if err != nil {
+			c.fail(ErrConnTimeout)
+			return err
+		}
+	}
+
+	if c.state == stateClosed {
+		if c.err != nil {
+			return c.err
+		}
+		return net.ErrClosed
+	}
+	return nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	for {
+		if len(c.readBuf) > 0 {
+			wasFull := c.recvWindow() < maxPayloadSize
+			n := copy(b, c.readBuf)
+			c.readBuf = c.readBuf[n:]
+			if len(c.readBuf) == 0 {
+				c.readBuf = nil
+			}
+			// Let the peer know it can send again
+			if wasFull && c.state == stateConnected {
+				c.sendAck()
+			}
+			return n, nil
+		}
+
+		if c.eof {
+			return 0, io.EOF
+		}
+
+		if c.closedLocally {
+			return 0, net.ErrClosed
+		}
+
+		if c.err != nil {
+			return 0, c.err
+		}
+
+		err := c.wait(c.readDeadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	written := 0
+	for written < len(b) {
+		if c.closedLocally {
+			return written, net.ErrClosed
+		}
+
+		if c.err != nil {
+			return written, c.err
+		}
+
+		if c.state == stateClosed {
+			return written, syscall.EPIPE
+		}
+
+		chunk := len(b) - written
+		if chunk > maxPayloadSize {
+			chunk = maxPayloadSize
+		}
+
+		window := c.cc.Window()
+		if int(c.peerWnd) < window {
+			window = int(c.peerWnd)
+		}
+
+		// Always allow a packet when nothing is in flight so a zero window is probed
+		if c.inFlight > 0 && c.inFlight+chunk > window {
+			err := c.wait(c.writeDeadline)
+			if err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		payload := make([]byte, chunk)
+		copy(payload, b[written:])
+		c.queuePacket(stData, payload)
+		written += chunk
+	}
+	return written, nil
+}
+
+// Close sends a FIN and lingers in the background until everything we've
+// sent has been acked
+func (c *Conn) Close() error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.closedLocally {
+		return nil
+	}
+	c.closedLocally = true
+	c.broadcast()
+
+	if c.state != stateConnected {
+		c.destroy()
+		return nil
+	}
+
+	c.queuePacket(stFin, nil)
+	c.finSent = true
+
+	go c.linger()
+	return nil
+}
+
+func (c *Conn) linger() {
+	deadline := time.Now().Add(closeLinger)
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	for c.state != stateClosed && len(c.outgoing) > 0 {
+		if c.wait(deadline) != nil {
+			break
+		}
+	}
+	c.destroy()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.socket.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.broadcast()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.readDeadline = t
+	c.broadcast()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.writeDeadline = t
+	c.broadcast()
+	return nil
+}
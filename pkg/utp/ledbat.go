@@ -0,0 +1,109 @@
+package utp
+
+import "time"
+
+// LEDBAT congestion control parameters (BEP 29)
+const (
+	targetDelay             = 100 * time.Millisecond
+	maxCwndIncreasePerRTT   = 3000
+	minWindow               = maxPayloadSize
+	maxWindow               = 1 << 20
+	initialWindow           = 2 * maxPayloadSize
+	baseDelayHistoryMinutes = 2
+)
+
+// ledbat keeps the congestion window for a connection. The window grows
+// while the measured queuing delay is under the target and shrinks when it
+// goes over so uTP backs off before TCP traffic on the same link suffers.
+type ledbat struct {
+	window float64
+
+	// Minimum delay seen per minute, the lowest is our base delay
+	history       [baseDelayHistoryMinutes + 1]uint32
+	historySet    [baseDelayHistoryMinutes + 1]bool
+	currentMinute int64
+}
+
+func newLedbat() *ledbat {
+	return &ledbat{window: initialWindow}
+}
+
+func (l *ledbat) Window() int {
+	return int(l.window)
+}
+
+func (l *ledbat) addDelaySample(delay uint32, now time.Time) {
+	minute := now.Unix() / 60
+	if minute != l.currentMinute {
+		// Roll the history along dropping minutes that have passed
+		shift := minute - l.currentMinute
+		for i := len(l.history) - 1; i >= 0; i-- {
+			from := int64(i) - shift
+			if from >= 0 && from < int64(len(l.history)) {
+				l.history[i] = l.history[from]
+				l.historySet[i] = l.historySet[from]
+			} else {
+				l.historySet[i] = false
+			}
+		}
+		l.currentMinute = minute
+	}
+
+	if !l.historySet[0] || int32(delay-l.history[0]) < 0 {
+		l.history[0] = delay
+		l.historySet[0] = true
+	}
+}
+
+func (l *ledbat) baseDelay() uint32 {
+	var base uint32
+	set := false
+	for i := range l.history {
+		if l.historySet[i] && (!set || int32(l.history[i]-base) < 0) {
+			base = l.history[i]
+			set = true
+		}
+	}
+	return base
+}
+
+// onAck grows or shrinks the window based on the latest one way delay
+// reported by the peer and how many bytes were acked
+func (l *ledbat) onAck(delay uint32, bytesAcked int, now time.Time) {
+	if bytesAcked <= 0 {
+		return
+	}
+
+	if delay != 0 {
+		l.addDelaySample(delay, now)
+	}
+
+	ourDelay := time.Duration(delay-l.baseDelay()) * time.Microsecond
+	offTarget := float64(targetDelay-ourDelay) / float64(targetDelay)
+	if offTarget < -1 {
+		offTarget = -1
+	}
+
+	l.window += maxCwndIncreasePerRTT * offTarget * float64(bytesAcked) / l.window
+	l.clamp()
+}
+
+// onLoss halves the window when a packet looks to have been dropped
+func (l *ledbat) onLoss() {
+	l.window /= 2
+	l.clamp()
+}
+
+// onTimeout resets the window to a single packet
+func (l *ledbat) onTimeout() {
+	l.window = minWindow
+}
+
+func (l *ledbat) clamp() {
+	if l.window < minWindow {
+		l.window = minWindow
+	}
+	if l.window > maxWindow {
+		l.window = maxWindow
+	}
+}
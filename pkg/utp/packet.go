@@ -0,0 +1,101 @@
+package utp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+type packetType uint8
+
+const (
+	stData  packetType = 0
+	stFin   packetType = 1
+	stState packetType = 2
+	stReset packetType = 3
+	stSyn   packetType = 4
+)
+
+const protocolVersion = 1
+const headerSize = 20
+
+var packetTypeToString = map[packetType]string{
+	stData:  "ST_DATA",
+	stFin:   "ST_FIN",
+	stState: "ST_STATE",
+	stReset: "ST_RESET",
+	stSyn:   "ST_SYN",
+}
+
+type header struct {
+	typ           packetType
+	connId        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	wndSize       uint32
+	seqNr         uint16
+	ackNr         uint16
+}
+
+// marshal encodes the header followed by the payload. We never send
+// extensions so the extension field is always 0.
+func (h *header) marshal(payload []byte) []byte {
+	b := make([]byte, headerSize+len(payload))
+	b[0] = byte(h.typ)<<4 | protocolVersion
+	b[1] = 0
+	binary.BigEndian.PutUint16(b[2:], h.connId)
+	binary.BigEndian.PutUint32(b[4:], h.timestamp)
+	binary.BigEndian.PutUint32(b[8:], h.timestampDiff)
+	binary.BigEndian.PutUint32(b[12:], h.wndSize)
+	binary.BigEndian.PutUint16(b[16:], h.seqNr)
+	binary.BigEndian.PutUint16(b[18:], h.ackNr)
+	copy(b[headerSize:], payload)
+	return b
+}
+
+// parsePacket decodes a packet skipping over any extensions
+func parsePacket(b []byte) (header, []byte, error) {
+	h := header{}
+	if !IsUTPPacket(b) {
+		return h, nil, fmt.Errorf("Not a uTP packet")
+	}
+
+	h.typ = packetType(b[0] >> 4)
+	h.connId = binary.BigEndian.Uint16(b[2:])
+	h.timestamp = binary.BigEndian.Uint32(b[4:])
+	h.timestampDiff = binary.BigEndian.Uint32(b[8:])
+	h.wndSize = binary.BigEndian.Uint32(b[12:])
+	h.seqNr = binary.BigEndian.Uint16(b[16:])
+	h.ackNr = binary.BigEndian.Uint16(b[18:])
+
+	extension := b[1]
+	payload := b[headerSize:]
+	for extension != 0 {
+		if len(payload) < 2 {
+			return h, nil, fmt.Errorf("Truncated uTP extension")
+		}
+		extension = payload[0]
+		l := int(payload[1])
+		if len(payload) < 2+l {
+			return h, nil, fmt.Errorf("Truncated uTP extension")
+		}
+		payload = payload[2+l:]
+	}
+
+	return h, payload, nil
+}
+
+// IsUTPPacket reports whether a datagram looks like uTP. It's used to tell
+// uTP apart from other protocols (e.g. DHT) sharing the same UDP socket.
+func IsUTPPacket(b []byte) bool {
+	return len(b) >= headerSize && b[0]&0x0f == protocolVersion && packetType(b[0]>>4) <= stSyn
+}
+
+func timestampMicro(t time.Time) uint32 {
+	return uint32(t.UnixMicro())
+}
+
+// seqLess compares sequence numbers taking wrapping into account
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
@@ -0,0 +1,339 @@
+package utp
+
+import (
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const acceptBacklog = 32
+const otherPacketBacklog = 256
+
+type connKey struct {
+	addr   string
+	recvId uint16
+}
+
+type datagram struct {
+	b    []byte
+	addr net.Addr
+}
+
+// Socket runs uTP connections over a single UDP socket. It implements
+// net.Listener for incoming connections. Datagrams that aren't uTP are
+// passed on to PacketConn so the socket can be shared with e.g. the DHT.
+type Socket struct {
+	pc net.PacketConn
+
+	mx     sync.Mutex
+	conns  map[connKey]*Conn
+	accept chan *Conn
+	other  chan datagram
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Listen opens a UDP socket and starts handling uTP on it
+func Listen(network, addr string) (*Socket, error) {
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(pc), nil
+}
+
+// NewSocket starts handling uTP on an existing packet connection
+func NewSocket(pc net.PacketConn) *Socket {
+	s := &Socket{
+		pc:     pc,
+		conns:  make(map[connKey]*Conn),
+		accept: make(chan *Conn, acceptBacklog),
+		other:  make(chan datagram, otherPacketBacklog),
+		closed: make(chan struct{}),
+	}
+	go s.readLoop()
+	return s
+}
+
+func (s *Socket) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			log.Warnf("uTP socket read failed: %s", err)
+			s.Close()
+			return
+		}
+
+		b := make([]byte, n)
+		copy(b, buf[:n])
+
+		if !IsUTPPacket(b) {
+			select {
+			case s.other <- datagram{b, addr}:
+			default:
+				// Nobody is reading fast enough so drop it
+			}
+			continue
+		}
+
+		s.handlePacket(b, addr)
+	}
+}
+
+func (s *Socket) handlePacket(b []byte, addr net.Addr) {
+	h, payload, err := parsePacket(b)
+	if err != nil {
+		log.Debugf("Dropping bad uTP packet from %s: %s", addr, err)
+		return
+	}
+
+	now := time.Now()
+	key := connKey{addr.String(), h.connId}
+	if h.typ == stSyn {
+		key.recvId = h.connId + 1
+	}
+
+	s.mx.Lock()
+	c, exists := s.conns[key]
+	if !exists && h.typ == stSyn {
+		c = s.newIncomingConn(h, addr, now)
+	}
+	s.mx.Unlock()
+
+	if c == nil {
+		log.Tracef("Dropping uTP %s packet for unknown connection %v from %s", packetTypeToString[h.typ], h.connId, addr)
+		return
+	}
+
+	if exists {
+		c.handlePacket(h, payload, now)
+	}
+}
+
+// newIncomingConn accepts a SYN. Must hold mx.
+func (s *Socket) newIncomingConn(h header, addr net.Addr, now time.Time) *Conn {
+	select {
+	case <-s.closed:
+		return nil
+	default:
+	}
+
+	c := newConn(s, addr, h.connId+1, h.connId)
+	c.state = stateConnected
+	c.seqNr = uint16(rand.Uint32())
+	c.ackNr = h.seqNr
+	c.peerWnd = h.wndSize
+	c.replyMicro = timestampMicro(now) - h.timestamp
+
+	select {
+	case s.accept <- c:
+	default:
+		log.Debugf("uTP accept backlog full, resetting connection from %s", addr)
+		c.sendPacket(stReset, c.seqNr, nil)
+		return nil
+	}
+
+	s.conns[connKey{addr.String(), c.recvId}] = c
+	go c.timerLoop()
+
+	c.mx.Lock()
+	c.sendAck()
+	c.mx.Unlock()
+	return c
+}
+
+func (s *Socket) removeConn(c *Conn) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	key := connKey{c.remote.String(), c.recvId}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *Socket) writeTo(b []byte, addr net.Addr) {
+	_, err := s.pc.WriteTo(b, addr)
+	if err != nil {
+		log.Debugf("uTP write to %s failed: %s", addr, err)
+	}
+}
+
+// Dial opens a uTP connection to addr
+func (s *Socket) Dial(addr string) (*Conn, error) {
+	return s.DialTimeout(addr, 0)
+}
+
+func (s *Socket) DialTimeout(addr string, timeout time.Duration) (*Conn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mx.Lock()
+	select {
+	case <-s.closed:
+		s.mx.Unlock()
+		return nil, net.ErrClosed
+	default:
+	}
+
+	// Pick a connection id that isn't already in use
+	var recvId uint16
+	for {
+		recvId = uint16(rand.Uint32())
+		if _, taken := s.conns[connKey{udpAddr.String(), recvId}]; !taken {
+			break
+		}
+	}
+
+	c := newConn(s, udpAddr, recvId, recvId+1)
+	c.seqNr = 1
+	s.conns[connKey{udpAddr.String(), recvId}] = c
+	s.mx.Unlock()
+
+	go c.timerLoop()
+
+	c.mx.Lock()
+	c.queuePacket(stSyn, nil)
+	c.mx.Unlock()
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	err = c.waitConnected(deadline)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Accept waits for the next incoming connection
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *Socket) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.pc.Close()
+
+		s.mx.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mx.Unlock()
+
+		for _, c := range conns {
+			c.mx.Lock()
+			c.fail(net.ErrClosed)
+			c.mx.Unlock()
+		}
+	})
+	return err
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// PacketConn returns a net.PacketConn that reads the datagrams that aren't
+// uTP and writes straight to the shared UDP socket
+func (s *Socket) PacketConn() net.PacketConn {
+	return &sharedPacketConn{socket: s, closed: make(chan struct{})}
+}
+
+type sharedPacketConn struct {
+	socket *Socket
+
+	mx           sync.Mutex
+	readDeadline time.Time
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+func (p *sharedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	p.mx.Lock()
+	deadline := p.readDeadline
+	p.mx.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case d := <-p.socket.other:
+		return copy(b, d.b), d.addr, nil
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-p.closed:
+		return 0, nil, net.ErrClosed
+	case <-p.socket.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (p *sharedPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-p.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return p.socket.pc.WriteTo(b, addr)
+}
+
+// Close only stops this view of the socket, the uTP socket stays open
+func (p *sharedPacketConn) Close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+	return nil
+}
+
+func (p *sharedPacketConn) LocalAddr() net.Addr {
+	return p.socket.Addr()
+}
+
+func (p *sharedPacketConn) SetDeadline(t time.Time) error {
+	return p.SetReadDeadline(t)
+}
+
+func (p *sharedPacketConn) SetReadDeadline(t time.Time) error {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	p.readDeadline = t
+	return nil
+}
+
+func (p *sharedPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,281 @@
+package utp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	h := header{
+		typ:           stData,
+		connId:        1234,
+		timestamp:     5678,
+		timestampDiff: 91011,
+		wndSize:       1 << 20,
+		seqNr:         65535,
+		ackNr:         42,
+	}
+	b := h.marshal([]byte("payload"))
+
+	if !IsUTPPacket(b) {
+		t.Fatalf("marshalled header should be recognised as uTP")
+	}
+
+	parsed, payload, err := parsePacket(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed != h {
+		t.Errorf("expected header %+v but got: %+v", h, parsed)
+	}
+
+	if string(payload) != "payload" {
+		t.Errorf("expected payload to be payload but got: %s", payload)
+	}
+}
+
+func TestParsePacketSkipsExtensions(t *testing.T) {
+	h := header{typ: stState}
+	b := h.marshal(nil)
+	// Selective ack extension with a 4 byte bitmask
+	b[1] = 1
+	b = append(b, 0, 4, 1, 2, 3, 4)
+	b = append(b, []byte("data")...)
+
+	_, payload, err := parsePacket(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(payload) != "data" {
+		t.Errorf("expected payload after extensions to be data but got: %s", payload)
+	}
+}
+
+func TestIsUTPPacket(t *testing.T) {
+	if IsUTPPacket([]byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe")) {
+		t.Errorf("DHT messages shouldn't look like uTP")
+	}
+}
+
+func TestSeqLess(t *testing.T) {
+	if !seqLess(1, 2) || seqLess(2, 1) {
+		t.Errorf("seqLess is wrong for small numbers")
+	}
+
+	if !seqLess(65535, 0) || seqLess(0, 65535) {
+		t.Errorf("seqLess should handle wrapping")
+	}
+}
+
+func TestLedbatBacksOffOverTarget(t *testing.T) {
+	now := time.Now()
+	l := newLedbat()
+	l.onAck(1000, maxPayloadSize, now)
+	grown := l.window
+	if grown <= initialWindow {
+		t.Errorf("window should grow when there's no queuing delay")
+	}
+
+	// 200ms of queuing delay on top of the base delay
+	l.onAck(1000+200000, maxPayloadSize, now)
+	if l.window >= grown {
+		t.Errorf("window should shrink when delay is over target")
+	}
+
+	l.onTimeout()
+	if l.window != minWindow {
+		t.Errorf("window should be a single packet after a timeout")
+	}
+}
+
+// lossyPacketConn drops every nth datagram written
+type lossyPacketConn struct {
+	net.PacketConn
+	n       int64
+	counter int64
+}
+
+func (l *lossyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if atomic.AddInt64(&l.counter, 1)%l.n == 0 {
+		return len(b), nil
+	}
+	return l.PacketConn.WriteTo(b, addr)
+}
+
+func newTestSocket(t *testing.T, dropEvery int64) *Socket {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropEvery > 0 {
+		pc = &lossyPacketConn{PacketConn: pc, n: dropEvery}
+	}
+	s := NewSocket(pc)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func connectSockets(t *testing.T, client, server *Socket) (net.Conn, net.Conn) {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := server.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+
+	dialed, err := client.DialTimeout(server.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case c := <-accepted:
+		return dialed, c
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting to accept")
+	}
+	return nil, nil
+}
+
+func transfer(t *testing.T, from, to net.Conn, size int) {
+	data := make([]byte, size)
+	rand.Read(data)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var writeErr error
+	go func() {
+		defer wg.Done()
+		_, writeErr = from.Write(data)
+	}()
+
+	to.SetReadDeadline(time.Now().Add(30 * time.Second))
+	received := make([]byte, size)
+	_, err := io.ReadFull(to, received)
+	wg.Wait()
+
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Errorf("received data doesn't match what was sent")
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	client := newTestSocket(t, 0)
+	server := newTestSocket(t, 0)
+	a, b := connectSockets(t, client, server)
+
+	transfer(t, a, b, 512*1024)
+	transfer(t, b, a, 64*1024)
+}
+
+func TestTransferWithLoss(t *testing.T) {
+	client := newTestSocket(t, 7)
+	server := newTestSocket(t, 11)
+	a, b := connectSockets(t, client, server)
+
+	transfer(t, a, b, 128*1024)
+	transfer(t, b, a, 32*1024)
+}
+
+func TestCloseGivesEOF(t *testing.T) {
+	client := newTestSocket(t, 0)
+	server := newTestSocket(t, 0)
+	a, b := connectSockets(t, client, server)
+
+	a.Write([]byte("bye"))
+	a.Close()
+
+	b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(received) != "bye" {
+		t.Errorf("expected to read bye before EOF but got: %s", received)
+	}
+
+	if _, err := a.Write([]byte("more")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("writing to a closed connection should fail but got: %v", err)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	client := newTestSocket(t, 0)
+	server := newTestSocket(t, 0)
+	a, _ := connectSockets(t, client, server)
+
+	a.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := a.Read(make([]byte, 10))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected deadline exceeded but got: %v", err)
+	}
+}
+
+func TestSharedPacketConn(t *testing.T) {
+	s := newTestSocket(t, 0)
+	other, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	pc := s.PacketConn()
+	msg := []byte("d1:y1:qe")
+	other.WriteTo(msg, s.Addr())
+
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	n, addr, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf[:n], msg) || addr.String() != other.LocalAddr().String() {
+		t.Errorf("expected to read %s from %s but got: %s from %s", msg, other.LocalAddr(), buf[:n], addr)
+	}
+
+	_, err = pc.WriteTo([]byte("reply"), other.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err = other.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "reply" {
+		t.Errorf("expected reply through the shared socket but got: %s %v", buf[:n], err)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	client := newTestSocket(t, 0)
+
+	// Nothing is speaking uTP on this socket
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	_, err = client.DialTimeout(silent.LocalAddr().String(), 200*time.Millisecond)
+	if err == nil {
+		t.Errorf("dialing something that doesn't answer should fail")
+	}
+}